@@ -27,6 +27,7 @@ func newBackupCmd() *cobra.Command {
 			if err != nil {
 				return fmt.Errorf("failed to initialize backup service: %w", err)
 			}
+			defer service.Close()
 
 			ctx := context.Background()
 
@@ -66,7 +67,7 @@ func runBackupAll(ctx context.Context, service *backup.Service, paths []string)
 }
 
 func printBackupResults(allResults map[string][]*backup.BackupResult) error {
-	var totalSuccess, totalFailure int
+	var totalSuccess, totalFailure, totalPartial int
 	var hasErrors bool
 
 	logrus.Info("=== Backup Results ===")
@@ -87,23 +88,38 @@ func printBackupResults(allResults map[string][]*backup.BackupResult) error {
 				logrus.WithFields(logrus.Fields{
 					"service":  serviceName,
 					"path":     result.Path,
-					"s3_key":   result.BackupInfo.Key,
+					"key":      result.BackupInfo.Key,
 					"size_mb":  fmt.Sprintf("%.2f", float64(result.ArchiveSize)/1024/1024),
 					"duration": result.Duration,
 				}).Info("Backup completed successfully")
 				totalSuccess++
+
+				for _, upload := range result.FailedUploads() {
+					logrus.WithFields(logrus.Fields{
+						"service":     serviceName,
+						"path":        result.Path,
+						"destination": upload.Destination,
+						"error":       upload.Error,
+					}).Warn("Upload to destination failed")
+					totalPartial++
+				}
 			}
 		}
 	}
 
 	logrus.WithFields(logrus.Fields{
-		"successful": totalSuccess,
-		"failed":     totalFailure,
+		"successful":          totalSuccess,
+		"failed":              totalFailure,
+		"failed_destinations": totalPartial,
 	}).Info("Backup summary")
 
 	if hasErrors {
 		return fmt.Errorf("backup completed with %d failures", totalFailure)
 	}
 
+	if totalPartial > 0 {
+		return fmt.Errorf("backup completed with %d failed destination uploads", totalPartial)
+	}
+
 	return nil
 }
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/volcie/stash/internal/config"
+	"github.com/volcie/stash/internal/inspect"
+)
+
+func newCatCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cat service_name path_name timestamp file",
+		Short: "Write a single file from a backup to stdout",
+		Long: `Stream a backup and write the content of a single file in it to stdout, stopping the download
+as soon as the file has been read. The timestamp is YYYYMMDD-HHMMSS, or "latest".
+
+  stash cat web-server data 20240101-030000 wp-config.php | diff - /var/www/html/wp-config.php`,
+		Args: cobra.ExactArgs(4),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg := config.Get()
+			if cfg == nil {
+				return fmt.Errorf("configuration not loaded")
+			}
+
+			destination, _ := cmd.Flags().GetString("destination")
+
+			opts := &inspect.CatOptions{
+				ServiceName: args[0],
+				Path:        args[1],
+				Timestamp:   args[2],
+				File:        args[3],
+			}
+			if opts.Timestamp == "latest" {
+				opts.Timestamp = ""
+			}
+
+			service, err := inspect.NewService(cfg, destination)
+			if err != nil {
+				return fmt.Errorf("failed to initialize inspect service: %w", err)
+			}
+			defer service.Close()
+
+			ctx := context.Background()
+			return runCat(ctx, service, opts)
+		},
+	}
+
+	cmd.Flags().String("destination", "", "read the backup from this destination (defaults to the first configured)")
+
+	return cmd
+}
+
+func runCat(ctx context.Context, service *inspect.Service, opts *inspect.CatOptions) error {
+	out := bufio.NewWriter(os.Stdout)
+
+	if err := service.Cat(ctx, opts, out); err != nil {
+		return fmt.Errorf("cat failed: %w", err)
+	}
+
+	return out.Flush()
+}
@@ -31,6 +31,7 @@ func newCleanupCmd() *cobra.Command {
 			if err != nil {
 				return fmt.Errorf("failed to initialize cleanup service: %w", err)
 			}
+			defer service.Close()
 
 			ctx := context.Background()
 			return runCleanup(ctx, service, opts)
@@ -90,7 +91,7 @@ func runCleanup(ctx context.Context, service *cleanup.Service, opts *cleanup.Cle
 func printCleanupResults(result *cleanup.CleanupResult, dryRun bool) error {
 	deletedCount := len(result.DeletedBackups)
 
-	if deletedCount == 0 {
+	if deletedCount == 0 && result.DeletedChunks == 0 {
 		logrus.Info("No backups found for deletion")
 		return nil
 	}
@@ -148,11 +149,13 @@ func printCleanupResults(result *cleanup.CleanupResult, dryRun bool) error {
 	if dryRun {
 		logrus.WithFields(logrus.Fields{
 			"would_delete": deletedCount,
+			"chunks":       result.DeletedChunks,
 			"would_free":   utils.FormatBytes(result.TotalSize),
 		}).Info("Cleanup preview summary")
 	} else {
 		logrus.WithFields(logrus.Fields{
 			"deleted": deletedCount,
+			"chunks":  result.DeletedChunks,
 			"freed":   utils.FormatBytes(result.TotalSize),
 		}).Info("Cleanup completed")
 	}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"runtime"
 
 	"github.com/sirupsen/logrus"
@@ -38,8 +40,16 @@ func newConfigShowCmd() *cobra.Command {
 
 			// Config show output should go to stdout for user consumption
 			logrus.Printf("Configuration: %s\n\n", getConfigPath())
-			logrus.Printf("S3 Bucket: %s\n", cfg.S3.Bucket)
-			logrus.Printf("S3 Prefix: %s\n", cfg.S3.Prefix)
+			destinations := cfg.GetDestinations()
+			if len(cfg.Destinations) > 0 {
+				logrus.Printf("Destinations: %d\n", len(destinations))
+				for _, dest := range destinations {
+					logrus.Printf("  %s (%s): %s\n", dest.Name, getOrDefault(dest.Type, config.StorageTypeS3), describeDestination(dest))
+				}
+			} else {
+				logrus.Printf("Storage Type: %s\n", destinations[0].Type)
+				logrus.Printf("Storage Location: %s\n", describeDestination(destinations[0]))
+			}
 			logrus.Printf("Retention: %d days\n", cfg.Retention)
 			logrus.Printf("Services: %d\n", len(cfg.Services))
 
@@ -132,6 +142,9 @@ func newConfigInitCmd() *cobra.Command {
 #
 # Test your configuration with: stash config test
 
+storage:
+  type: s3
+
 s3:
   bucket: your-s3-bucket-name
   prefix: backups
@@ -158,7 +171,7 @@ notifications:
 backup:
   temp_dir: /tmp/stash-backups
   preserve_acls: true
-  compression: true
+  compression: gzip
   min_size: 1024
 `
 
@@ -177,13 +190,17 @@ backup:
 func newConfigTestCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "test",
-		Short: "Test S3 configuration and connectivity",
+		Short: "Test storage configuration and connectivity",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cfg := config.Get()
 			if cfg == nil {
 				return fmt.Errorf("no configuration loaded")
 			}
 
+			if len(cfg.Destinations) > 0 || (cfg.Storage.Type != "" && cfg.Storage.Type != config.StorageTypeS3) {
+				return testDestinations(cfg)
+			}
+
 			// Config test output should go to stdout for user consumption
 			logrus.Println("Testing S3 Configuration")
 			logrus.Println("-------------------------")
@@ -223,6 +240,46 @@ func newConfigTestCmd() *cobra.Command {
 	}
 }
 
+func testDestinations(cfg *config.Config) error {
+	var failed int
+
+	for _, dest := range cfg.GetDestinations() {
+		logrus.Printf("Testing destination %s (%s)\n", dest.Name, getOrDefault(dest.Type, config.StorageTypeS3))
+		logrus.Println("-------------------------")
+
+		backend, err := storage.NewBackendByName(cfg, dest.Name)
+		if err != nil {
+			logrus.WithError(err).Errorf("Connection test failed for destination %s", dest.Name)
+			failed++
+			continue
+		}
+
+		logrus.Printf("Location: %s\n", backend.Location())
+		if err := backend.Close(); err != nil {
+			logrus.Warnf("Failed to close destination %s: %v", dest.Name, err)
+		}
+		logrus.Infof("Connection test successful for destination %s", dest.Name)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("storage connection test failed for %d destinations", failed)
+	}
+
+	return nil
+}
+
+// describeDestination returns a short description of where a destination stores backups
+func describeDestination(dest config.Destination) string {
+	switch dest.Type {
+	case config.StorageTypeLocal:
+		return filepath.Join(dest.Local.Path, dest.Local.Prefix)
+	case config.StorageTypeSFTP:
+		return fmt.Sprintf("sftp://%s@%s%s", dest.SFTP.User, dest.SFTP.Host, path.Join(dest.SFTP.Path, dest.SFTP.Prefix))
+	default:
+		return fmt.Sprintf("s3://%s/%s", dest.S3.Bucket, dest.S3.Prefix)
+	}
+}
+
 func getMaskedEnv(key string) string {
 	value := os.Getenv(key)
 	if value == "" {
@@ -241,6 +298,13 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getOrDefault(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
 func getConfigPath() string {
 	if configPath != "" {
 		return configPath
@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/volcie/stash/internal/archive"
+	"github.com/volcie/stash/internal/config"
+	"github.com/volcie/stash/internal/inspect"
+	"github.com/volcie/stash/internal/utils"
+)
+
+func newDiffCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff service_name path_name from_timestamp [to_timestamp]",
+		Short: "Show what changed between two backups, or between a backup and the live files",
+		Long: `Compare two backups of the same path, or a backup with the current files of the configured
+source path when to_timestamp is omitted, and report added, removed and modified files with their
+size and checksum. Timestamps are YYYYMMDD-HHMMSS, or "latest". Manifests are used when available,
+so usually no archive is downloaded.`,
+		Args: cobra.RangeArgs(3, 4),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg := config.Get()
+			if cfg == nil {
+				return fmt.Errorf("configuration not loaded")
+			}
+
+			destination, _ := cmd.Flags().GetString("destination")
+			jsonOutput, _ := cmd.Flags().GetBool("json")
+
+			opts := &inspect.DiffOptions{
+				ServiceName: args[0],
+				Path:        args[1],
+				From:        args[2],
+			}
+			if opts.From == "latest" {
+				opts.From = ""
+			}
+			if len(args) > 3 {
+				opts.To = args[3]
+				if opts.To == "latest" {
+					opts.To = ""
+				}
+			} else {
+				opts.Live = true
+			}
+
+			service, err := inspect.NewService(cfg, destination)
+			if err != nil {
+				return fmt.Errorf("failed to initialize inspect service: %w", err)
+			}
+			defer service.Close()
+
+			ctx := context.Background()
+			return runDiff(ctx, service, opts, jsonOutput)
+		},
+	}
+
+	cmd.Flags().Bool("json", false, "print the differences as JSON")
+	cmd.Flags().String("destination", "", "read backups from this destination (defaults to the first configured)")
+
+	return cmd
+}
+
+func runDiff(ctx context.Context, service *inspect.Service, opts *inspect.DiffOptions, jsonOutput bool) error {
+	result, err := service.Diff(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("diff failed: %w", err)
+	}
+
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+
+	to := result.To.Key
+	if result.To.Source != "" {
+		to = result.To.Source
+	}
+	fmt.Printf("--- %s\n+++ %s\n", result.From.Key, to)
+
+	for _, change := range result.Changes {
+		switch change.Change {
+		case inspect.ChangeAdded:
+			fmt.Printf("+ %s  %s\n", change.Path, describeEntry(change.New))
+		case inspect.ChangeRemoved:
+			fmt.Printf("- %s  %s\n", change.Path, describeEntry(change.Old))
+		case inspect.ChangeModified:
+			fmt.Printf("M %s  %s\n", change.Path, describeModification(change))
+		}
+	}
+
+	if !result.From.Checksums || !result.To.Checksums {
+		logrus.Warn("Some backups have no manifest, their files were compared by size and modification time")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"added":    result.Added,
+		"removed":  result.Removed,
+		"modified": result.Modified,
+	}).Info("Diff summary")
+
+	return nil
+}
+
+// describeEntry summarizes an added or removed entry
+func describeEntry(entry *archive.ManifestEntry) string {
+	if entry.Type == archive.EntryFile {
+		return utils.FormatBytes(entry.Size)
+	}
+	return entry.Type
+}
+
+// describeModification lists what changed in a modified entry, with the old and new values
+func describeModification(change inspect.Change) string {
+	var parts []string
+	for _, field := range change.Fields {
+		switch field {
+		case inspect.FieldType:
+			parts = append(parts, fmt.Sprintf("type %s -> %s", change.Old.Type, change.New.Type))
+		case inspect.FieldSize:
+			parts = append(parts, fmt.Sprintf("size %s -> %s", utils.FormatBytes(change.Old.Size), utils.FormatBytes(change.New.Size)))
+		case inspect.FieldContent:
+			parts = append(parts, fmt.Sprintf("sha256 %s -> %s", shortSum(change.Old.SHA256), shortSum(change.New.SHA256)))
+		case inspect.FieldModTime:
+			parts = append(parts, fmt.Sprintf("mtime %s -> %s",
+				change.Old.ModTime.Local().Format("2006-01-02 15:04:05"),
+				change.New.ModTime.Local().Format("2006-01-02 15:04:05")))
+		case inspect.FieldMode:
+			parts = append(parts, fmt.Sprintf("mode %04o -> %04o", change.Old.Mode, change.New.Mode))
+		case inspect.FieldLink:
+			parts = append(parts, fmt.Sprintf("link %s -> %s", change.Old.Link, change.New.Link))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// shortSum abbreviates a checksum for display
+func shortSum(sum string) string {
+	if len(sum) > 12 {
+		return sum[:12]
+	}
+	return sum
+}
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/volcie/stash/internal/archive"
+	"github.com/volcie/stash/internal/config"
+	"github.com/volcie/stash/internal/inspect"
+	"github.com/volcie/stash/internal/utils"
+)
+
+func newInspectCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "inspect service_name path_name [timestamp]",
+		Aliases: []string{"ls-files"},
+		Short:   "List the files inside a backup",
+		Long: `List the files inside a backup with their size, mode and modification time, without restoring it.
+The backup's manifest is used when there is one, otherwise the archive is streamed and only its
+headers are read. Without a timestamp (YYYYMMDD-HHMMSS), the latest backup is listed.
+Incremental and differential backups only contain the files that changed.`,
+		Args: cobra.RangeArgs(2, 3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg := config.Get()
+			if cfg == nil {
+				return fmt.Errorf("configuration not loaded")
+			}
+
+			destination, _ := cmd.Flags().GetString("destination")
+			patterns, _ := cmd.Flags().GetStringArray("glob")
+
+			opts := &inspect.ListOptions{
+				ServiceName: args[0],
+				Path:        args[1],
+				Patterns:    patterns,
+			}
+			if len(args) > 2 {
+				opts.Timestamp = args[2]
+			}
+
+			service, err := inspect.NewService(cfg, destination)
+			if err != nil {
+				return fmt.Errorf("failed to initialize inspect service: %w", err)
+			}
+			defer service.Close()
+
+			ctx := context.Background()
+			return runInspect(ctx, service, opts)
+		},
+	}
+
+	cmd.Flags().StringArray("glob", nil, "list only entries matching this pattern, in exclude syntax (repeatable)")
+	cmd.Flags().String("destination", "", "read the backup from this destination (defaults to the first configured)")
+
+	return cmd
+}
+
+func runInspect(ctx context.Context, service *inspect.Service, opts *inspect.ListOptions) error {
+	listing, err := service.ListFiles(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("inspect failed: %w", err)
+	}
+
+	var total int64
+	for _, entry := range listing.Entries {
+		fmt.Printf("%s %10s  %s  %s\n",
+			entryMode(entry),
+			utils.FormatBytes(entry.Size),
+			entry.ModTime.Local().Format("2006-01-02 15:04:05"),
+			entryName(entry))
+		total += entry.Size
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"key":           listing.Backup.Key,
+		"kind":          listing.Backup.Kind,
+		"entries":       len(listing.Entries),
+		"total_size":    utils.FormatBytes(total),
+		"from_manifest": listing.FromManifest,
+	}).Info("Listed backup contents")
+
+	return nil
+}
+
+// entryMode formats the type and permissions of an entry like ls -l
+func entryMode(entry archive.ManifestEntry) string {
+	mode := fs.FileMode(entry.Mode & 0777)
+	if entry.Mode&04000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if entry.Mode&02000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if entry.Mode&01000 != 0 {
+		mode |= fs.ModeSticky
+	}
+
+	switch entry.Type {
+	case archive.EntryDir:
+		mode |= fs.ModeDir
+	case archive.EntrySymlink:
+		mode |= fs.ModeSymlink
+	case archive.EntryFifo:
+		mode |= fs.ModeNamedPipe
+	case archive.EntryChar:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case archive.EntryBlock:
+		mode |= fs.ModeDevice
+	}
+
+	return mode.String()
+}
+
+// entryName returns the path of an entry, with the target of links
+func entryName(entry archive.ManifestEntry) string {
+	switch entry.Type {
+	case archive.EntrySymlink:
+		return entry.Path + " -> " + entry.Link
+	case archive.EntryHardlink:
+		return entry.Path + " => " + entry.Link
+	}
+	return entry.Path
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"os"
 	"sort"
 	"time"
 
@@ -25,6 +26,7 @@ func newListCmd() *cobra.Command {
 			}
 
 			serviceName, _ := cmd.Flags().GetString("service")
+			destination, _ := cmd.Flags().GetString("destination")
 			s3Flag, _ := cmd.Flags().GetBool("s3")
 			localFlag, _ := cmd.Flags().GetBool("local")
 
@@ -34,11 +36,13 @@ func newListCmd() *cobra.Command {
 			}
 
 			if s3Flag {
-				return listS3Backups(cfg, serviceName)
+				if err := listRemoteBackups(cfg, serviceName, destination); err != nil {
+					return err
+				}
 			}
 
 			if localFlag {
-				return fmt.Errorf("local backup listing not available yet")
+				return listLocalBackups(cfg, serviceName)
 			}
 
 			return nil
@@ -46,31 +50,67 @@ func newListCmd() *cobra.Command {
 	}
 
 	cmd.Flags().String("service", "", "filter by service name")
-	cmd.Flags().Bool("local", false, "list local backups")
-	cmd.Flags().Bool("s3", false, "list S3 backups (default if no flags specified)")
+	cmd.Flags().String("destination", "", "list backups in this destination (defaults to the first configured)")
+	cmd.Flags().Bool("local", false, "list local backups (archives in backup.local_dir)")
+	cmd.Flags().Bool("s3", false, "list remote backups (default if no flags specified)")
 
 	return cmd
 }
 
-func listS3Backups(cfg *config.Config, serviceName string) error {
-	s3Client, err := storage.NewS3Client(cfg.S3.Bucket, cfg.S3.Prefix)
+func listRemoteBackups(cfg *config.Config, serviceName, destination string) error {
+	backend, err := storage.NewBackendByName(cfg, destination)
 	if err != nil {
-		return fmt.Errorf("failed to create S3 client: %w", err)
+		return fmt.Errorf("failed to create storage backend: %w", err)
 	}
+	defer backend.Close()
 
 	ctx := context.Background()
-	backups, err := s3Client.List(ctx, serviceName)
+	backups, err := backend.List(ctx, serviceName)
 	if err != nil {
 		return fmt.Errorf("failed to list backups: %w", err)
 	}
 
+	// List command output should go to stdout for user consumption
+	logrus.Debugf("Remote Backups (%s)\n\n", backend.Location())
+
+	printBackupList(backups, serviceName)
+	return nil
+}
+
+func listLocalBackups(cfg *config.Config, serviceName string) error {
+	localDir := cfg.Backup.LocalArchiveDir()
+
+	if _, err := os.Stat(localDir); os.IsNotExist(err) {
+		logrus.Infof("No local backups found (%s does not exist)", localDir)
+		return nil
+	}
+
+	// Local archives use the same service/path/timestamp layout as remote storage
+	localClient, err := storage.NewLocalClient(localDir, "")
+	if err != nil {
+		return fmt.Errorf("failed to open local backup directory: %w", err)
+	}
+
+	ctx := context.Background()
+	backups, err := localClient.List(ctx, serviceName)
+	if err != nil {
+		return fmt.Errorf("failed to list local backups: %w", err)
+	}
+
+	logrus.Debugf("Local Backups (%s)\n\n", localDir)
+
+	printBackupList(backups, serviceName)
+	return nil
+}
+
+func printBackupList(backups []*storage.BackupInfo, serviceName string) {
 	if len(backups) == 0 {
 		if serviceName != "" {
 			logrus.Infof("No backups found for service: %s", serviceName)
 		} else {
 			logrus.Info("No backups found")
 		}
-		return nil
+		return
 	}
 
 	// Sort by date (newest first)
@@ -84,17 +124,15 @@ func listS3Backups(cfg *config.Config, serviceName string) error {
 		serviceGroups[backup.Service] = append(serviceGroups[backup.Service], backup)
 	}
 
-	// List command output should go to stdout for user consumption
-	logrus.Debugf("S3 Backups (s3://%s/%s)\n\n", cfg.S3.Bucket, cfg.S3.Prefix)
-
 	for service, serviceBackups := range serviceGroups {
 		logrus.Printf("%s (%d backups)\n", service, len(serviceBackups))
 
 		for _, backup := range serviceBackups {
 			age := time.Since(backup.Date)
-			logrus.Printf("  %s | %s | %s | %s ago\n",
+			logrus.Printf("  %s | %s | %s | %s | %s ago\n",
 				backup.Path,
 				backup.Date.Format("2006-01-02 15:04"),
+				backup.Kind,
 				utils.FormatBytes(backup.Size),
 				formatDuration(age))
 		}
@@ -102,7 +140,6 @@ func listS3Backups(cfg *config.Config, serviceName string) error {
 	}
 
 	logrus.WithField("total", len(backups)).Debug("Listed backups")
-	return nil
 }
 
 func formatDuration(d time.Duration) string {
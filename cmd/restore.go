@@ -6,6 +6,7 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/volcie/stash/internal/config"
 	"github.com/volcie/stash/internal/restore"
 )
@@ -21,7 +22,7 @@ func newRestoreCmd() *cobra.Command {
 				return fmt.Errorf("configuration not loaded")
 			}
 
-			opts, err := parseRestoreFlags(cmd, args[0])
+			opts, err := parseRestoreFlags(cmd, args)
 			if err != nil {
 				return err
 			}
@@ -30,6 +31,7 @@ func newRestoreCmd() *cobra.Command {
 			if err != nil {
 				return fmt.Errorf("failed to initialize restore service: %w", err)
 			}
+			defer service.Close()
 
 			ctx := context.Background()
 			return runRestore(ctx, service, opts)
@@ -38,26 +40,49 @@ func newRestoreCmd() *cobra.Command {
 
 	cmd.Flags().Bool("from-s3", false, "restore from S3 (default if no source specified)")
 	cmd.Flags().String("from-local", "", "restore from local file")
+	cmd.Flags().Bool("from-local-store", false, "restore from local archives kept by backup.keep_local")
+	cmd.Flags().StringSlice("paths", nil, "restore only these paths (comma-separated)")
+	cmd.Flags().StringArray("include", nil, "restore only entries matching this glob, e.g. 'uploads/2024/**' (repeatable)")
+	cmd.Flags().StringArray("file", nil, "restore only this file, by name or path inside the backup (repeatable)")
+	cmd.Flags().String("destination", "", "restore from this destination (defaults to the first configured)")
 	cmd.Flags().String("date", "", "specific backup date (YYYYMMDD or YYYYMMDD-HHMMSS)")
 	cmd.Flags().Bool("latest", false, "use latest backup (default)")
 	cmd.Flags().Bool("dry-run", false, "show what would be restored (won't trigger notifications)")
 	cmd.Flags().Bool("force", false, "skip confirmation prompts")
+	cmd.Flags().Bool("staged", false, "extract next to the destination and swap it into place once verified, keeping the previous tree for --rollback")
+	cmd.Flags().Bool("rollback", false, "undo the last staged restore, swapping the previous tree back into place")
 	cmd.Flags().String("dest", "", "destination path (defaults to configured service path)")
 
+	// --path reads better when selecting a single path
+	cmd.Flags().SetNormalizeFunc(func(f *pflag.FlagSet, name string) pflag.NormalizedName {
+		if name == "path" {
+			name = "paths"
+		}
+		return pflag.NormalizedName(name)
+	})
+
 	return cmd
 }
 
-func parseRestoreFlags(cmd *cobra.Command, serviceName string) (*restore.RestoreOptions, error) {
+func parseRestoreFlags(cmd *cobra.Command, args []string) (*restore.RestoreOptions, error) {
+	serviceName := args[0]
 	fromS3, _ := cmd.Flags().GetBool("from-s3")
 	fromLocal, _ := cmd.Flags().GetString("from-local")
+	localStore, _ := cmd.Flags().GetBool("from-local-store")
+	paths, _ := cmd.Flags().GetStringSlice("paths")
+	include, _ := cmd.Flags().GetStringArray("include")
+	files, _ := cmd.Flags().GetStringArray("file")
+	destination, _ := cmd.Flags().GetString("destination")
 	date, _ := cmd.Flags().GetString("date")
 	latest, _ := cmd.Flags().GetBool("latest")
 	dryRun, _ := cmd.Flags().GetBool("dry-run")
 	force, _ := cmd.Flags().GetBool("force")
+	staged, _ := cmd.Flags().GetBool("staged")
+	rollback, _ := cmd.Flags().GetBool("rollback")
 	destPath, _ := cmd.Flags().GetString("dest")
 
 	// Default to S3 if no source specified
-	if !fromS3 && fromLocal == "" {
+	if !fromS3 && fromLocal == "" && !localStore {
 		fromS3 = true
 	}
 
@@ -71,25 +96,64 @@ func parseRestoreFlags(cmd *cobra.Command, serviceName string) (*restore.Restore
 		return nil, fmt.Errorf("cannot specify both --from-s3 and --from-local")
 	}
 
+	if fromS3 && localStore {
+		return nil, fmt.Errorf("cannot specify both --from-s3 and --from-local-store")
+	}
+
+	if fromLocal != "" && localStore {
+		return nil, fmt.Errorf("cannot specify both --from-local and --from-local-store")
+	}
+
 	if fromLocal != "" && date != "" {
-		return nil, fmt.Errorf("cannot specify --date when using --from-local")
+		return nil, fmt.Errorf("cannot specify --date when restoring from a local file")
+	}
+
+	if destination != "" && !fromS3 {
+		return nil, fmt.Errorf("cannot specify --destination when restoring from local archives")
+	}
+
+	if fromLocal != "" && len(paths) > 0 {
+		return nil, fmt.Errorf("cannot specify --paths when restoring from a local file")
+	}
+
+	if staged && (len(include) > 0 || len(files) > 0) {
+		return nil, fmt.Errorf("cannot specify --staged with --include or --file, a staged restore replaces the whole tree")
+	}
+
+	if staged && fromLocal != "" {
+		return nil, fmt.Errorf("cannot specify --staged when restoring from a local file")
+	}
+
+	if rollback && (staged || fromLocal != "" || date != "" || len(include) > 0 || len(files) > 0) {
+		return nil, fmt.Errorf("--rollback only accepts --paths, --dest and --dry-run")
 	}
 
 	return &restore.RestoreOptions{
 		ServiceName: serviceName,
 		FromS3:      fromS3,
 		FromLocal:   fromLocal,
+		LocalStore:  localStore,
+		Paths:       paths,
+		Include:     include,
+		Files:       files,
+		Destination: destination,
 		Date:        date,
 		Latest:      latest,
 		DryRun:      dryRun,
 		Force:       force,
+		Staged:      staged,
+		Rollback:    rollback,
 		DestPath:    destPath,
 	}, nil
 }
 
 func runRestore(ctx context.Context, service *restore.Service, opts *restore.RestoreOptions) error {
-	if opts.FromLocal != "" {
+	if opts.Rollback {
+		logrus.Infof("Rolling back the last staged restore for service: %s", opts.ServiceName)
+	} else if opts.FromLocal != "" {
 		logrus.Infof("Starting restore from local file: %s", opts.FromLocal)
+	} else if opts.LocalStore {
+		logrus.Infof("Starting restore from local archives for service: %s", opts.ServiceName)
 	} else {
 		logrus.Infof("Starting restore for service: %s", opts.ServiceName)
 	}
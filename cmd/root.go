@@ -54,6 +54,10 @@ func newRootCmd() *cobra.Command {
 	cmd.AddCommand(newRestoreCmd())
 	cmd.AddCommand(newListCmd())
 	cmd.AddCommand(newCleanupCmd())
+	cmd.AddCommand(newVerifyCmd())
+	cmd.AddCommand(newInspectCmd())
+	cmd.AddCommand(newCatCmd())
+	cmd.AddCommand(newDiffCmd())
 	cmd.AddCommand(newConfigCmd())
 
 	return cmd
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/volcie/stash/internal/config"
+	"github.com/volcie/stash/internal/verify"
+)
+
+func newVerifyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify [service_name]",
+		Short: "Check that backups are intact and restorable",
+		Long: `Download backups and read them to the end, checking compression, encryption and tar framing,
+and compare the archive and every file in it with the checksums in its manifest.
+Without a service name, every configured service is verified.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg := config.Get()
+			if cfg == nil {
+				return fmt.Errorf("configuration not loaded")
+			}
+
+			opts := parseVerifyFlags(cmd, args)
+
+			service, err := verify.NewService(cfg, noNotify)
+			if err != nil {
+				return fmt.Errorf("failed to initialize verify service: %w", err)
+			}
+
+			ctx := context.Background()
+			return runVerify(ctx, service, opts)
+		},
+	}
+
+	cmd.Flags().String("date", "", "verify backups from this date (YYYYMMDD or YYYYMMDD-HHMMSS)")
+	cmd.Flags().Bool("all", false, "verify every backup instead of the latest of each path")
+	cmd.Flags().String("destination", "", "verify backups in this destination (defaults to the first configured)")
+
+	return cmd
+}
+
+func parseVerifyFlags(cmd *cobra.Command, args []string) *verify.VerifyOptions {
+	date, _ := cmd.Flags().GetString("date")
+	all, _ := cmd.Flags().GetBool("all")
+	destination, _ := cmd.Flags().GetString("destination")
+
+	opts := &verify.VerifyOptions{
+		Destination: destination,
+		Date:        date,
+		All:         all,
+	}
+	if len(args) > 0 {
+		opts.ServiceName = args[0]
+	}
+	return opts
+}
+
+func runVerify(ctx context.Context, service *verify.Service, opts *verify.VerifyOptions) error {
+	results, err := service.VerifyBackups(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("verify failed: %w", err)
+	}
+
+	if len(results) == 0 {
+		logrus.Info("No backups found to verify")
+		return nil
+	}
+
+	logrus.Info("=== Verify Results ===")
+
+	var intact, corrupt int
+	for _, result := range results {
+		fields := logrus.Fields{
+			"service":  result.Service,
+			"path":     result.Path,
+			"key":      result.BackupInfo.Key,
+			"checked":  result.Check,
+			"entries":  result.Files,
+			"duration": result.Duration,
+		}
+
+		if result.Error != nil {
+			fields["error"] = result.Error
+			logrus.WithFields(fields).Error("Backup failed verification")
+			for _, problem := range result.Problems {
+				logrus.Errorf("  %s", problem)
+			}
+			corrupt++
+			continue
+		}
+
+		logrus.WithFields(fields).Info("Backup is intact")
+		intact++
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"intact":  intact,
+		"corrupt": corrupt,
+	}).Info("Verify summary")
+
+	if corrupt > 0 {
+		return fmt.Errorf("%d of %d backups failed verification", corrupt, len(results))
+	}
+
+	return nil
+}
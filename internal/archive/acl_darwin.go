@@ -0,0 +1,18 @@
+package archive
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// aclWarning makes sure the missing macOS ACL support is reported once per run, not per file
+var aclWarning sync.Once
+
+// warnExtendedACLs reports that macOS ACLs aren't archived. They are kept apart from extended
+// attributes and only readable through libc (acl_get_link_np), which would need cgo.
+func warnExtendedACLs() {
+	aclWarning.Do(func() {
+		logrus.Warn("macOS ACLs are not supported and are not archived, only extended attributes are kept")
+	})
+}
@@ -0,0 +1,6 @@
+//go:build !darwin
+
+package archive
+
+// warnExtendedACLs does nothing, ACLs are extended attributes or read with getfacl/icacls here
+func warnExtendedACLs() {}
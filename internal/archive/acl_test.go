@@ -0,0 +1,88 @@
+//go:build linux
+
+package archive
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/volcie/stash/internal/config"
+)
+
+// requireACLs skips the test unless setfacl and getfacl work on files in dir
+func requireACLs(t *testing.T, dir string) {
+	t.Helper()
+
+	for _, tool := range []string{"setfacl", "getfacl"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+
+	probe := filepath.Join(dir, "probe")
+	if err := os.WriteFile(probe, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(probe)
+
+	if output, err := exec.Command("setfacl", "-m", fmt.Sprintf("u:%d:r", os.Getuid()), probe).CombinedOutput(); err != nil {
+		t.Skipf("filesystem doesn't support ACLs: %v: %s", err, output)
+	}
+}
+
+func getACL(t *testing.T, path string) string {
+	t.Helper()
+
+	output, err := exec.Command("getfacl", "-n", "-p", path).CombinedOutput()
+	if err != nil {
+		t.Fatalf("getfacl %s: %v: %s", path, err, output)
+	}
+	return string(output)
+}
+
+func TestExtractArchiveRestoresACLToDestination(t *testing.T) {
+	root := t.TempDir()
+	requireACLs(t, root)
+
+	// The file the backup was taken from, recorded by getfacl in the "# file:" line
+	original := filepath.Join(root, "original", "file")
+	if err := os.MkdirAll(filepath.Dir(original), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(original, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := fmt.Sprintf("user:%d:r--", os.Getuid())
+	acl := fmt.Sprintf("# file: %s\n# owner: %d\n# group: %d\nuser::rw-\n%s\ngroup::r--\nmask::r--\nother::r--\n",
+		original, os.Getuid(), os.Getgid(), entry)
+
+	archive := buildTar(t, tarEntry{
+		header: tar.Header{
+			Name:       "file",
+			Typeflag:   tar.TypeReg,
+			Format:     tar.FormatPAX,
+			PAXRecords: map[string]string{"STASH.acl": base64.StdEncoding.EncodeToString([]byte(acl))},
+		},
+		content: "content",
+	})
+
+	destPath := filepath.Join(root, "dest")
+	archiver := NewArchiver(config.CompressionNone, true)
+	if _, err := archiver.ExtractArchive(archive, destPath); err != nil {
+		t.Fatalf("ExtractArchive() error = %v", err)
+	}
+
+	if got := getACL(t, filepath.Join(destPath, "file")); !strings.Contains(got, entry) {
+		t.Errorf("extracted file is missing ACL entry %q:\n%s", entry, got)
+	}
+	if got := getACL(t, original); strings.Contains(got, entry) {
+		t.Errorf("ACL was applied to the original path %s:\n%s", original, got)
+	}
+}
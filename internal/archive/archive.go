@@ -2,8 +2,10 @@ package archive
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
@@ -12,22 +14,41 @@ import (
 	"runtime"
 	"strings"
 
+	"filippo.io/age"
 	"github.com/schollz/progressbar/v3"
 	"github.com/sirupsen/logrus"
 )
 
 type Archiver struct {
-	compression  bool
-	preserveACLs bool
+	compression       string
+	compressionLevel  int
+	preserveACLs      bool
+	preserveOwnership bool
+	excludes          []string
+	includes          *PathFilter // entries extracted, nil for all
+	recordSnapshot    bool
+	baseSnapshot      *Snapshot
+	recipients        []age.Recipient
+	identities        []age.Identity
 }
 
 type ArchiveStats struct {
 	FilesProcessed int
 	TotalSize      int64
 	CompressedSize int64
+	Snapshot       *Snapshot // Set when snapshot recording is enabled
+	Manifest       *Manifest // Every entry written, with the checksum of the archive
 }
 
-func NewArchiver(compression, preserveACLs bool) *Archiver {
+// ExtractStats summarizes an extraction
+type ExtractStats struct {
+	Entries int // entries extracted
+	Skipped int // entries left out by the include patterns
+}
+
+// NewArchiver creates an archiver writing archives with the given compression format
+// (see config.Compression*). Extraction detects the format on its own.
+func NewArchiver(compression string, preserveACLs bool) *Archiver {
 	return &Archiver{
 		compression:  compression,
 		preserveACLs: preserveACLs,
@@ -40,14 +61,23 @@ func (a *Archiver) CreateArchive(writer io.Writer, sourcePath string, includeFol
 
 func (a *Archiver) CreateArchiveWithProgress(writer io.Writer, sourcePath string, includeFolders []string, progressBar *progressbar.ProgressBar) (*ArchiveStats, error) {
 	stats := &ArchiveStats{}
+	manifest := &Manifest{Version: manifestVersion, Files: []ManifestEntry{}}
 
-	var finalWriter io.Writer = writer
-	var gzipWriter *gzip.Writer
+	// Hash the archive as it is stored, so it can be verified without trusting the storage
+	archiveHash := newHashingWriter(writer)
 
-	if a.compression {
-		gzipWriter = gzip.NewWriter(writer)
-		finalWriter = gzipWriter
-		defer gzipWriter.Close()
+	// Encryption wraps the compressed stream so ciphertext is the last layer before storage
+	encryptedWriter, encryptCloser, err := a.encryptWriter(archiveHash)
+	if err != nil {
+		return nil, err
+	}
+
+	finalWriter, compressCloser, err := a.compressWriter(encryptedWriter)
+	if err != nil {
+		return nil, err
+	}
+	if compressCloser != nil {
+		defer compressCloser.Close()
 	}
 
 	tarWriter := tar.NewWriter(finalWriter)
@@ -58,7 +88,18 @@ func (a *Archiver) CreateArchiveWithProgress(writer io.Writer, sourcePath string
 		logrus.Infof("Including specific folders: %v", includeFolders)
 	}
 
-	err := filepath.Walk(sourcePath, func(path string, info os.FileInfo, err error) error {
+	excludes := a.newExcludeMatcher(sourcePath)
+	hardlinks := make(map[fileID]string)
+
+	var snapshot *Snapshot
+	if a.recordSnapshot {
+		snapshot = newSnapshot()
+	}
+	if a.baseSnapshot != nil {
+		logrus.Infof("Archiving changes since the previous snapshot (%d paths)", len(a.baseSnapshot.Files))
+	}
+
+	err = filepath.Walk(sourcePath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			logrus.Warnf("Error accessing %s: %v", path, err)
 			return nil // Continue processing other files
@@ -81,26 +122,87 @@ func (a *Archiver) CreateArchiveWithProgress(writer io.Writer, sourcePath string
 		// Convert Windows paths to Unix-style for tar
 		relPath = filepath.ToSlash(relPath)
 
+		// Skip paths matching exclude patterns or .stashignore rules
+		if skip, err := excludes.skipExcluded(relPath, info); skip {
+			return err
+		}
+
+		// Symlinks are stored with their target instead of being followed
+		var linkTarget string
+		if info.Mode()&os.ModeSymlink != 0 {
+			linkTarget, err = os.Readlink(path)
+			if err != nil {
+				logrus.Warnf("Failed to read symlink %s: %v", path, err)
+				a.keepBaseEntry(snapshot, relPath)
+				return nil // Continue with other files
+			}
+		}
+
+		// Incremental archives only store what changed since the base snapshot
+		if a.skipUnchanged(relPath, info) {
+			a.keepBaseEntry(snapshot, relPath)
+			return nil
+		}
+
+		// Regular files are opened before their header is written, so one that can't be read
+		// is left out instead of corrupting the archive
+		var file *os.File
+		if info.Mode().IsRegular() {
+			file, err = os.Open(path)
+			if err != nil {
+				logrus.Warnf("Failed to open file %s: %v", path, err)
+				a.keepBaseEntry(snapshot, relPath)
+				// CountFiles counted it, keep the bar in step
+				if progressBar != nil {
+					progressBar.Add(1)
+				}
+				return nil // Continue with other files
+			}
+			defer file.Close()
+		}
+
 		// Create tar header
-		header, err := tar.FileInfoHeader(info, "")
+		header, err := tar.FileInfoHeader(info, linkTarget)
 		if err != nil {
 			return fmt.Errorf("failed to create tar header: %w", err)
 		}
 
 		header.Name = relPath
 
-		// Add ACL information to PAX headers if ACL preservation is enabled
-		if a.preserveACLs {
-			aclData, err := a.getFileACL(path)
-			if err != nil {
-				logrus.Warnf("Failed to get ACL for %s: %v", path, err)
-			} else if aclData != "" {
-				if header.PAXRecords == nil {
-					header.PAXRecords = make(map[string]string)
+		// PAX keeps access times and sub-second modification times for restore
+		header.Format = tar.FormatPAX
+
+		// Files with several links are stored once, later links point at the first copy
+		if info.Mode().IsRegular() {
+			if id, ok := hardlinkID(info); ok {
+				if firstPath, seen := hardlinks[id]; seen {
+					header.Typeflag = tar.TypeLink
+					header.Linkname = firstPath
+					header.Size = 0
+				} else {
+					hardlinks[id] = relPath
+				}
+			}
+		}
+
+		// Add ACL information to PAX headers if ACL preservation is enabled.
+		// Links share the ACL of their target, so there is nothing to store for them.
+		if a.preserveACLs && header.Typeflag != tar.TypeSymlink && header.Typeflag != tar.TypeLink {
+			if nativeXattrs {
+				// POSIX ACLs are the system.posix_acl_* extended attributes, macOS keeps its ACLs apart
+				a.addXattrs(path, header)
+				warnExtendedACLs()
+			} else {
+				aclData, err := a.getFileACL(path)
+				if err != nil {
+					logrus.Warnf("Failed to get ACL for %s: %v", path, err)
+				} else if aclData != "" {
+					if header.PAXRecords == nil {
+						header.PAXRecords = make(map[string]string)
+					}
+					header.PAXRecords["STASH.acl"] = aclData
+					logrus.Debugf("Stored ACL for %s", relPath)
 				}
-				header.PAXRecords["STASH.acl"] = aclData
-				header.Format = tar.FormatPAX // Ensure we use PAX format for extended attributes
-				logrus.Debugf("Stored ACL for %s", relPath)
 			}
 		}
 
@@ -109,22 +211,31 @@ func (a *Archiver) CreateArchiveWithProgress(writer io.Writer, sourcePath string
 			return fmt.Errorf("failed to write tar header: %w", err)
 		}
 
-		// Write file content if it's a regular file
-		if info.Mode().IsRegular() {
-			file, err := os.Open(path)
-			if err != nil {
-				logrus.Warnf("Failed to open file %s: %v", path, err)
-				return nil // Continue with other files
+		entry := newManifestEntry(header)
+		changed := false
+
+		switch header.Typeflag {
+		case tar.TypeLink:
+			stats.FilesProcessed++
+			if progressBar != nil {
+				progressBar.Add(1)
 			}
-			defer file.Close()
+			logrus.Debugf("Added hardlink: %s -> %s", relPath, header.Linkname)
+
+		case tar.TypeSymlink:
+			logrus.Debugf("Added symlink: %s -> %s", relPath, header.Linkname)
 
-			written, err := io.Copy(tarWriter, file)
+		case tar.TypeReg:
+			// The header is already written, so exactly header.Size bytes must follow it
+			fileHash := sha256.New()
+			complete, err := copyContent(io.MultiWriter(tarWriter, fileHash), file, path, header.Size)
 			if err != nil {
-				logrus.Warnf("Failed to write file %s to archive: %v", path, err)
-				return nil // Continue with other files
+				return fmt.Errorf("failed to write file %s to archive: %w", path, err)
 			}
+			changed = !complete
+			entry.SHA256 = hex.EncodeToString(fileHash.Sum(nil))
 
-			stats.TotalSize += written
+			stats.TotalSize += header.Size
 			stats.FilesProcessed++
 
 			// Update progress bar if provided
@@ -132,9 +243,18 @@ func (a *Archiver) CreateArchiveWithProgress(writer io.Writer, sourcePath string
 				progressBar.Add(1)
 			}
 
-			logrus.Debugf("Added file: %s (%d bytes)", relPath, written)
+			logrus.Debugf("Added file: %s (%d bytes)", relPath, header.Size)
 		}
 
+		// Only recorded once archived, a path missing from the snapshot is archived again next time.
+		// A file that changed while being archived is left out too, its copy is incomplete.
+		if changed {
+			a.keepBaseEntry(snapshot, relPath)
+		} else if snapshot != nil {
+			snapshot.Files[relPath] = snapshotEntry(info)
+		}
+
+		manifest.Files = append(manifest.Files, entry)
 		return nil
 	})
 
@@ -142,86 +262,199 @@ func (a *Archiver) CreateArchiveWithProgress(writer io.Writer, sourcePath string
 		return nil, fmt.Errorf("failed to create archive: %w", err)
 	}
 
+	if a.baseSnapshot != nil {
+		if manifest.Deleted, err = a.writeDeletions(tarWriter, snapshot); err != nil {
+			return nil, err
+		}
+	}
+	stats.Snapshot = snapshot
+
 	// Close writers to ensure all data is flushed
 	if err := tarWriter.Close(); err != nil {
 		return nil, fmt.Errorf("failed to close tar writer: %w", err)
 	}
 
-	if gzipWriter != nil {
-		if err := gzipWriter.Close(); err != nil {
-			return nil, fmt.Errorf("failed to close gzip writer: %w", err)
+	if compressCloser != nil {
+		if err := compressCloser.Close(); err != nil {
+			return nil, fmt.Errorf("failed to finish compression: %w", err)
+		}
+	}
+
+	if encryptCloser != nil {
+		if err := encryptCloser.Close(); err != nil {
+			return nil, fmt.Errorf("failed to finish encryption: %w", err)
 		}
 	}
 
+	manifest.ArchiveSize = archiveHash.written
+	manifest.ArchiveSHA256 = archiveHash.sum()
+	stats.Manifest = manifest
+
 	logrus.Infof("Archive created successfully: %d files, %d bytes", stats.FilesProcessed, stats.TotalSize)
 
 	return stats, nil
 }
 
-func (a *Archiver) ExtractArchive(reader io.Reader, destPath string) error {
+func (a *Archiver) ExtractArchive(reader io.Reader, destPath string) (*ExtractStats, error) {
 	return a.ExtractArchiveWithProgress(reader, destPath, nil)
 }
 
-func (a *Archiver) ExtractArchiveWithProgress(reader io.Reader, destPath string, progressBar *progressbar.ProgressBar) error {
-	var finalReader io.Reader = reader
+func (a *Archiver) ExtractArchiveWithProgress(reader io.Reader, destPath string, progressBar *progressbar.ProgressBar) (*ExtractStats, error) {
+	stats := &ExtractStats{}
 
-	// Try to detect if it's gzipped
-	if a.compression {
-		gzipReader, err := gzip.NewReader(reader)
-		if err != nil {
-			logrus.Warnf("Failed to create gzip reader, assuming uncompressed: %v", err)
-			finalReader = reader
-		} else {
-			finalReader = gzipReader
-			defer gzipReader.Close()
-		}
+	reader, err := a.decryptReader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	// Detect the compression from the archive itself so backups made with
+	// a different compression setting still restore
+	finalReader, decompressCloser, err := decompressReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	if decompressCloser != nil {
+		defer decompressCloser.Close()
 	}
 
 	tarReader := tar.NewReader(finalReader)
 
 	logrus.Infof("Extracting archive to %s", destPath)
 
+	owners := a.newOwnerMapperIfRoot()
+	var dirs []*tar.Header
+	extractedDirs := make(map[string]bool)
+
 	for {
 		header, err := tarReader.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return fmt.Errorf("failed to read tar header: %w", err)
+			return nil, fmt.Errorf("failed to read tar header: %w", err)
+		}
+
+		// Incremental archives list the paths deleted since the previous backup
+		if isDeletions(header) {
+			if err := a.applyDeletions(tarReader, destPath); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Selective restores skip everything outside the include patterns
+		if !a.includes.Match(header.Name, header.Typeflag == tar.TypeDir) {
+			stats.Skipped++
+			continue
+		}
+
+		// Convert Unix-style paths back to OS-specific paths, refusing anything that
+		// would land outside destPath
+		targetPath, err := safeJoin(destPath, header.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		// Never write through a symlink extracted earlier (e.g. "dir -> /etc" followed by "dir/passwd")
+		if err := checkNoSymlinks(destPath, filepath.Dir(targetPath)); err != nil {
+			return nil, err
 		}
 
-		// Convert Unix-style paths back to OS-specific paths
-		targetPath := filepath.Join(destPath, filepath.FromSlash(header.Name))
+		// A directory's metadata is applied after the whole archive is extracted, so it must not be
+		// swapped for something else (e.g. a symlink to /etc) in between
+		if header.Typeflag != tar.TypeDir && extractedDirs[targetPath] {
+			return nil, fmt.Errorf("refusing to extract %q: replaces a directory extracted earlier from this archive", header.Name)
+		}
 
 		// Ensure the target directory exists
 		if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-			return fmt.Errorf("failed to create directory: %w", err)
+			return nil, fmt.Errorf("failed to create directory: %w", err)
 		}
 
 		switch header.Typeflag {
 		case tar.TypeDir:
-			if err := os.MkdirAll(targetPath, os.FileMode(header.Mode)); err != nil {
-				return fmt.Errorf("failed to create directory %s: %w", targetPath, err)
+			// Replace a file or symlink left where the directory goes
+			if info, err := os.Lstat(targetPath); err == nil && !info.IsDir() {
+				if err := removeExisting(targetPath); err != nil {
+					return nil, err
+				}
+			}
+
+			// Created writable, the archived mode is applied once its contents are extracted
+			if err := os.MkdirAll(targetPath, 0755); err != nil {
+				return nil, fmt.Errorf("failed to create directory %s: %w", targetPath, err)
 			}
+			dirs = append(dirs, header)
+			extractedDirs[targetPath] = true
 		case tar.TypeReg:
+			// Replace whatever is left at the target instead of writing into it, so neither
+			// a symlink's target nor the other names of a hardlinked file are modified
+			if err := removeExisting(targetPath); err != nil {
+				return nil, err
+			}
+
 			file, err := os.OpenFile(targetPath, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
 			if err != nil {
-				return fmt.Errorf("failed to create file %s: %w", targetPath, err)
+				return nil, fmt.Errorf("failed to create file %s: %w", targetPath, err)
 			}
 
 			if _, err := io.Copy(file, tarReader); err != nil {
 				file.Close()
-				return fmt.Errorf("failed to extract file %s: %w", targetPath, err)
+				return nil, fmt.Errorf("failed to extract file %s: %w", targetPath, err)
 			}
 
 			file.Close()
+			a.restoreMetadata(targetPath, header, owners)
 			logrus.Debugf("Extracted file: %s", header.Name)
+		case tar.TypeSymlink:
+			if err := removeExisting(targetPath); err != nil {
+				return nil, err
+			}
+			if err := os.Symlink(header.Linkname, targetPath); err != nil {
+				return nil, fmt.Errorf("failed to create symlink %s: %w", targetPath, err)
+			}
+			a.restoreMetadata(targetPath, header, owners)
+			logrus.Debugf("Extracted symlink: %s -> %s", header.Name, header.Linkname)
+		case tar.TypeLink:
+			linkTarget, err := safeJoin(destPath, header.Linkname)
+			if err != nil {
+				return nil, err
+			}
+			if err := checkNoSymlinks(destPath, filepath.Dir(linkTarget)); err != nil {
+				return nil, err
+			}
+			// The first copy of the file may have been left out by the include patterns
+			if _, err := os.Lstat(linkTarget); err != nil && a.includes != nil {
+				logrus.Warnf("Skipping hardlink %s: %s was not restored", header.Name, header.Linkname)
+				continue
+			}
+			if err := removeExisting(targetPath); err != nil {
+				return nil, err
+			}
+			if err := os.Link(linkTarget, targetPath); err != nil {
+				return nil, fmt.Errorf("failed to create hardlink %s: %w", targetPath, err)
+			}
+			logrus.Debugf("Extracted hardlink: %s -> %s", header.Name, header.Linkname)
+		case tar.TypeFifo, tar.TypeChar, tar.TypeBlock:
+			if err := removeExisting(targetPath); err != nil {
+				return nil, err
+			}
+			if err := makeSpecialFile(targetPath, header); err != nil {
+				// Device nodes need root, don't fail the entire restore for them
+				logrus.Warnf("Failed to create special file %s: %v", targetPath, err)
+			} else {
+				a.restoreMetadata(targetPath, header, owners)
+				logrus.Debugf("Extracted special file: %s", header.Name)
+			}
 		default:
 			logrus.Warnf("Unsupported file type for %s: %c", header.Name, header.Typeflag)
 		}
 
 		// Restore ACL information if present
-		if a.preserveACLs && header.PAXRecords != nil {
+		if a.preserveACLs && header.PAXRecords != nil && header.Typeflag != tar.TypeSymlink {
+			a.restoreXattrs(targetPath, header)
+
+			// Archives from older versions (and Windows) carry the ACL as getfacl/icacls output
 			if aclData, exists := header.PAXRecords["STASH.acl"]; exists && aclData != "" {
 				if err := a.setFileACL(targetPath, aclData); err != nil {
 					logrus.Warnf("Failed to restore ACL for %s: %v", targetPath, err)
@@ -232,13 +465,97 @@ func (a *Archiver) ExtractArchiveWithProgress(reader io.Reader, destPath string,
 			}
 		}
 
+		stats.Entries++
+
 		// Update progress bar if provided
 		if progressBar != nil {
 			progressBar.Add(1)
 		}
 	}
 
+	// Apply directory permissions and times last, deepest first, since extracting
+	// their contents would have changed the times and may need write access
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dirPath, err := safeJoin(destPath, dirs[i].Name)
+		if err != nil {
+			return nil, err
+		}
+
+		// chmod and chtimes follow symlinks, only touch what is still a real directory inside destPath
+		if err := checkNoSymlinks(destPath, dirPath); err != nil {
+			logrus.Warnf("Not restoring metadata of %s: %v", dirPath, err)
+			continue
+		}
+		if info, err := os.Lstat(dirPath); err != nil || !info.IsDir() {
+			logrus.Warnf("Not restoring metadata of %s: no longer a directory", dirPath)
+			continue
+		}
+
+		a.restoreMetadata(dirPath, dirs[i], owners)
+	}
+
+	if a.includes != nil {
+		logrus.Infof("Extracted %d matching entries, skipped %d", stats.Entries, stats.Skipped)
+	}
+
 	logrus.Info("Archive extracted successfully")
+	return stats, nil
+}
+
+// safeJoin joins an archive entry name onto destPath, rejecting absolute
+// names and names that escape destPath through ".." components
+func safeJoin(destPath, name string) (string, error) {
+	localName := filepath.FromSlash(name)
+
+	if filepath.IsAbs(localName) || strings.HasPrefix(name, "/") || filepath.VolumeName(localName) != "" {
+		return "", fmt.Errorf("refusing to extract %q: absolute paths are not allowed in archives", name)
+	}
+
+	cleaned := filepath.Clean(localName)
+	if cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("refusing to extract %q: path escapes the restore directory", name)
+	}
+
+	return filepath.Join(destPath, cleaned), nil
+}
+
+// checkNoSymlinks returns an error if any existing directory between destPath and dir is a symlink
+func checkNoSymlinks(destPath, dir string) error {
+	relDir, err := filepath.Rel(destPath, dir)
+	if err != nil || relDir == "." {
+		return nil
+	}
+
+	current := destPath
+	for _, part := range strings.Split(relDir, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil // The rest of the path will be created as plain directories
+		}
+		if err != nil {
+			return fmt.Errorf("failed to check %s: %w", current, err)
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to extract into %s: path goes through a symlink", dir)
+		}
+	}
+
+	return nil
+}
+
+// removeExisting removes a file or directory left at path so another entry can be created in its place
+func removeExisting(path string) error {
+	if _, err := os.Lstat(path); err != nil {
+		return nil
+	}
+
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("failed to replace existing file %s: %w", path, err)
+	}
+
 	return nil
 }
 
@@ -271,7 +588,8 @@ func (a *Archiver) shouldInclude(path, basePath string, includeFolders []string)
 	return false
 }
 
-// getFileACL extracts ACL information from a file in a platform-specific way
+// getFileACL extracts ACL information from a file in a platform-specific way,
+// on platforms where extended attributes aren't read natively
 func (a *Archiver) getFileACL(path string) (string, error) {
 	if !a.preserveACLs {
 		return "", nil
@@ -344,24 +662,12 @@ func (a *Archiver) setUnixACL(path, aclData string) error {
 		return fmt.Errorf("failed to decode ACL data: %w", err)
 	}
 
-	// Create a temporary file with ACL rules
-	tmpFile, err := os.CreateTemp("", "acl_rules")
-	if err != nil {
-		return fmt.Errorf("failed to create temp ACL file: %w", err)
-	}
-	defer os.Remove(tmpFile.Name())
-
-	if _, err := tmpFile.Write(decoded); err != nil {
-		tmpFile.Close()
-		return fmt.Errorf("failed to write ACL rules: %w", err)
-	}
-	tmpFile.Close()
-
-	// Apply ACL using setfacl
-	cmd := exec.Command("setfacl", "--restore", tmpFile.Name())
-	if err := cmd.Run(); err != nil {
-		logrus.Warnf("Failed to set ACL for %s: %v", path, err)
-		return nil // Don't fail the entire operation for ACL issues
+	// Apply the rules to the extracted path. setfacl --restore would apply them to the
+	// "# file:" path recorded by getfacl, which is where the backup was taken from.
+	cmd := exec.Command("setfacl", "--set-file=-", "--", path)
+	cmd.Stdin = bytes.NewReader(decoded)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("setfacl failed: %w: %s", err, strings.TrimSpace(string(output)))
 	}
 
 	return nil
@@ -436,6 +742,8 @@ func (a *Archiver) setWindowsACL(path, aclData string) error {
 // CountFiles counts the number of files that will be processed for progress tracking
 func (a *Archiver) CountFiles(sourcePath string, includeFolders []string) (int, error) {
 	count := 0
+	excludes := a.newExcludeMatcher(sourcePath)
+
 	err := filepath.Walk(sourcePath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil // Continue processing other files
@@ -449,8 +757,18 @@ func (a *Archiver) CountFiles(sourcePath string, includeFolders []string) (int,
 			return nil
 		}
 
-		// Count regular files
-		if info.Mode().IsRegular() {
+		// Skip paths matching exclude patterns or .stashignore rules
+		relPath, err := filepath.Rel(sourcePath, path)
+		if err != nil {
+			return nil
+		}
+		if skip, err := excludes.skipExcluded(filepath.ToSlash(relPath), info); skip {
+			return err
+		}
+
+		// Count regular files, only the changed ones for incremental archives. Every name of a
+		// hardlinked file counts, CreateArchive ticks once for the copy and once per link entry.
+		if info.Mode().IsRegular() && !a.skipUnchanged(filepath.ToSlash(relPath), info) {
 			count++
 		}
 
@@ -459,3 +777,32 @@ func (a *Archiver) CountFiles(sourcePath string, includeFolders []string) (int,
 
 	return count, err
 }
+
+// copyContent copies exactly size bytes of file to writer, the size recorded in its header.
+// A file that shrank is padded with zeros and one that grew is cut, both with a warning;
+// complete is false then. Errors are failures to write.
+func copyContent(writer io.Writer, file io.Reader, path string, size int64) (complete bool, err error) {
+	written, readErr := io.CopyN(writer, file, size)
+	if readErr != nil {
+		logrus.Warnf("File %s changed while being archived, stored %d of %d bytes padded with zeros: %v", path, written, size, readErr)
+		if _, err := io.CopyN(writer, zeroReader{}, size-written); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+
+	if n, _ := file.Read(make([]byte, 1)); n > 0 {
+		logrus.Warnf("File %s grew while being archived, stored its first %d bytes", path, size)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// zeroReader pads the entries of files that shrank while being archived
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,95 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/volcie/stash/internal/config"
+)
+
+// Blob formats, recorded in the first byte of a blob before encryption. Unlike archives, a raw blob
+// can start with anything, so the compression can't be detected from the content alone.
+const (
+	blobRaw        byte = 0
+	blobCompressed byte = 1
+)
+
+// SealBlob compresses and encrypts data the same way archives are, for storing it as a
+// standalone object such as a deduplicated chunk
+func (a *Archiver) SealBlob(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	encryptedWriter, encryptCloser, err := a.encryptWriter(&buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	format := blobCompressed
+	if a.compression == config.CompressionNone {
+		format = blobRaw
+	}
+	if _, err := encryptedWriter.Write([]byte{format}); err != nil {
+		return nil, fmt.Errorf("failed to write blob: %w", err)
+	}
+
+	compressedWriter, compressCloser, err := a.compressWriter(encryptedWriter)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := compressedWriter.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to write blob: %w", err)
+	}
+
+	if compressCloser != nil {
+		if err := compressCloser.Close(); err != nil {
+			return nil, fmt.Errorf("failed to finish compression: %w", err)
+		}
+	}
+
+	if encryptCloser != nil {
+		if err := encryptCloser.Close(); err != nil {
+			return nil, fmt.Errorf("failed to finish encryption: %w", err)
+		}
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// OpenBlob reverses SealBlob, decrypting with the configured identities
+func (a *Archiver) OpenBlob(reader io.Reader) ([]byte, error) {
+	decrypted, err := a.decryptReader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	format := make([]byte, 1)
+	if _, err := io.ReadFull(decrypted, format); err != nil {
+		return nil, fmt.Errorf("failed to read blob: %w", err)
+	}
+
+	var content io.Reader
+	switch format[0] {
+	case blobRaw:
+		content = decrypted
+	case blobCompressed:
+		decompressed, decompressCloser, err := decompressReader(decrypted)
+		if err != nil {
+			return nil, err
+		}
+		if decompressCloser != nil {
+			defer decompressCloser.Close()
+		}
+		content = decompressed
+	default:
+		return nil, fmt.Errorf("unknown blob format %d", format[0])
+	}
+
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob: %w", err)
+	}
+
+	return data, nil
+}
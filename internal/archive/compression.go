@@ -0,0 +1,132 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+	"github.com/ulikunitz/xz"
+	"github.com/volcie/stash/internal/config"
+)
+
+// Magic bytes at the start of each compressed stream
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// xzDictSizes maps xz preset levels 0-9 to their dictionary sizes, as in xz(1)
+var xzDictSizes = []int{
+	256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20,
+	8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20,
+}
+
+// Extension returns the file extension for archives in the given compression format
+func Extension(compression string) string {
+	switch compression {
+	case config.CompressionGzip:
+		return ".tar.gz"
+	case config.CompressionZstd:
+		return ".tar.zst"
+	case config.CompressionXz:
+		return ".tar.xz"
+	default:
+		return ".tar"
+	}
+}
+
+// Extension returns the file extension for archives created by this archiver
+func (a *Archiver) Extension() string {
+	return Extension(a.compression)
+}
+
+// SetCompressionLevel sets the compression level, 0 uses the format's default
+func (a *Archiver) SetCompressionLevel(level int) {
+	a.compressionLevel = level
+}
+
+// compressWriter wraps writer with the configured compression.
+// The returned closer must be closed to flush the compressed stream.
+func (a *Archiver) compressWriter(writer io.Writer) (io.Writer, io.Closer, error) {
+	switch a.compression {
+	case config.CompressionGzip:
+		level := gzip.DefaultCompression
+		if a.compressionLevel > 0 {
+			level = a.compressionLevel
+		}
+		gzipWriter, err := gzip.NewWriterLevel(writer, level)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create gzip writer: %w", err)
+		}
+		return gzipWriter, gzipWriter, nil
+
+	case config.CompressionZstd:
+		level := zstd.SpeedDefault
+		if a.compressionLevel > 0 {
+			level = zstd.EncoderLevelFromZstd(a.compressionLevel)
+		}
+		zstdWriter, err := zstd.NewWriter(writer, zstd.WithEncoderLevel(level))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create zstd writer: %w", err)
+		}
+		return zstdWriter, zstdWriter, nil
+
+	case config.CompressionXz:
+		xzConfig := xz.WriterConfig{}
+		if a.compressionLevel > 0 {
+			xzConfig.DictCap = xzDictSizes[a.compressionLevel]
+		}
+		xzWriter, err := xzConfig.NewWriter(writer)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create xz writer: %w", err)
+		}
+		return xzWriter, xzWriter, nil
+
+	default:
+		return writer, nil, nil
+	}
+}
+
+// decompressReader detects the compression format from the stream's magic bytes
+// and wraps reader accordingly. Uncompressed archives are returned as is.
+func decompressReader(reader io.Reader) (io.Reader, io.Closer, error) {
+	buffered := bufio.NewReader(reader)
+
+	// A short peek just means a tiny (or empty) stream, which can't be compressed
+	header, _ := buffered.Peek(len(xzMagic))
+
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		logrus.Debugf("Detected gzip compressed archive")
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create gzip reader: %w", err)
+		}
+		return gzipReader, gzipReader, nil
+
+	case bytes.HasPrefix(header, zstdMagic):
+		logrus.Debugf("Detected zstd compressed archive")
+		zstdReader, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create zstd reader: %w", err)
+		}
+		return zstdReader, zstdReader.IOReadCloser(), nil
+
+	case bytes.HasPrefix(header, xzMagic):
+		logrus.Debugf("Detected xz compressed archive")
+		xzReader, err := xz.NewReader(buffered)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create xz reader: %w", err)
+		}
+		return xzReader, nil, nil
+
+	default:
+		logrus.Debugf("No compression detected, reading archive as plain tar")
+		return buffered, nil, nil
+	}
+}
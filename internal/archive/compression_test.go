@@ -0,0 +1,104 @@
+package archive
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/volcie/stash/internal/config"
+)
+
+func TestDecompressReaderDetectsFormat(t *testing.T) {
+	content := bytes.Repeat([]byte("stash compression test\n"), 1000)
+
+	tests := []struct {
+		compression string
+		level       int
+		magic       []byte
+	}{
+		{config.CompressionGzip, 0, gzipMagic},
+		{config.CompressionGzip, 9, gzipMagic},
+		{config.CompressionZstd, 0, zstdMagic},
+		{config.CompressionZstd, 19, zstdMagic},
+		{config.CompressionXz, 0, xzMagic},
+		{config.CompressionXz, 9, xzMagic},
+		{config.CompressionNone, 0, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.compression, func(t *testing.T) {
+			archiver := NewArchiver(tt.compression, false)
+			archiver.SetCompressionLevel(tt.level)
+
+			var buf bytes.Buffer
+			writer, closer, err := archiver.compressWriter(&buf)
+			if err != nil {
+				t.Fatalf("compressWriter() error = %v", err)
+			}
+			if _, err := writer.Write(content); err != nil {
+				t.Fatal(err)
+			}
+			if closer != nil {
+				if err := closer.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if tt.magic != nil && !bytes.HasPrefix(buf.Bytes(), tt.magic) {
+				t.Errorf("stream starts with %x, want the magic bytes %x", buf.Bytes()[:len(tt.magic)], tt.magic)
+			}
+
+			reader, readCloser, err := decompressReader(&buf)
+			if err != nil {
+				t.Fatalf("decompressReader() error = %v", err)
+			}
+			if readCloser != nil {
+				defer readCloser.Close()
+			}
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("failed to read decompressed stream: %v", err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("decompressed %d bytes, want the original %d", len(got), len(content))
+			}
+		})
+	}
+}
+
+func TestDecompressReaderShortStreams(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"shorter than a magic", []byte{0x1f}},
+		{"plain", []byte("plain tar data")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader, closer, err := decompressReader(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("decompressReader() error = %v", err)
+			}
+			if closer != nil {
+				t.Error("uncompressed stream returned a closer")
+			}
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Errorf("read %q, want the stream unchanged %q", got, tt.data)
+			}
+		})
+	}
+}
+
+func TestDecompressReaderCorruptGzip(t *testing.T) {
+	// The magic alone selects gzip, the broken header must surface as an error
+	if _, _, err := decompressReader(bytes.NewReader([]byte{0x1f, 0x8b, 0x00, 0x00})); err == nil {
+		t.Error("decompressReader() accepted a corrupt gzip header")
+	}
+}
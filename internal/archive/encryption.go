@@ -0,0 +1,133 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/volcie/stash/internal/config"
+)
+
+// PassphraseEnvVar holds the passphrase for passphrase-based encryption
+const PassphraseEnvVar = "STASH_ENCRYPTION_PASSPHRASE"
+
+// ageHeader is the first line of every binary age file
+var ageHeader = []byte("age-encryption.org/v1\n")
+
+// LoadRecipients returns the recipients archives are encrypted to: the configured
+// X25519 public keys, or a passphrase from the environment when none are configured
+func LoadRecipients(cfg config.EncryptionConfig) ([]age.Recipient, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	if len(cfg.Recipients) > 0 {
+		var recipients []age.Recipient
+		for _, publicKey := range cfg.Recipients {
+			recipient, err := age.ParseX25519Recipient(strings.TrimSpace(publicKey))
+			if err != nil {
+				return nil, fmt.Errorf("invalid encryption recipient %q: %w", publicKey, err)
+			}
+			recipients = append(recipients, recipient)
+		}
+		return recipients, nil
+	}
+
+	passphrase := os.Getenv(PassphraseEnvVar)
+	if passphrase == "" {
+		return nil, fmt.Errorf("encryption is enabled but no recipients are configured and %s is not set", PassphraseEnvVar)
+	}
+
+	recipient, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create passphrase recipient: %w", err)
+	}
+
+	return []age.Recipient{recipient}, nil
+}
+
+// LoadIdentities returns every key available for decrypting archives. Returns no
+// identities (and no error) when nothing is configured, so unencrypted archives still restore.
+func LoadIdentities(cfg config.EncryptionConfig) ([]age.Identity, error) {
+	var identities []age.Identity
+
+	if cfg.IdentityFile != "" {
+		file, err := os.Open(cfg.IdentityFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open encryption identity file: %w", err)
+		}
+		defer file.Close()
+
+		fileIdentities, err := age.ParseIdentities(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse encryption identity file %s: %w", cfg.IdentityFile, err)
+		}
+		identities = append(identities, fileIdentities...)
+	}
+
+	if passphrase := os.Getenv(PassphraseEnvVar); passphrase != "" {
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create passphrase identity: %w", err)
+		}
+		identities = append(identities, identity)
+	}
+
+	return identities, nil
+}
+
+// SetRecipients enables encryption of created archives to the given recipients
+func (a *Archiver) SetRecipients(recipients []age.Recipient) {
+	a.recipients = recipients
+}
+
+// SetIdentities sets the keys used to decrypt encrypted archives during extraction
+func (a *Archiver) SetIdentities(identities []age.Identity) {
+	a.identities = identities
+}
+
+// encryptWriter wraps writer so everything written is encrypted, if encryption is enabled.
+// The returned closer must be closed to flush the final encrypted chunk.
+func (a *Archiver) encryptWriter(writer io.Writer) (io.Writer, io.Closer, error) {
+	if len(a.recipients) == 0 {
+		return writer, nil, nil
+	}
+
+	encrypted, err := age.Encrypt(writer, a.recipients...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start encryption: %w", err)
+	}
+
+	return encrypted, encrypted, nil
+}
+
+// decryptReader detects encrypted archives and transparently decrypts them
+func (a *Archiver) decryptReader(reader io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(reader)
+
+	header, err := buffered.Peek(len(ageHeader))
+	if err != nil || !bytes.Equal(header, ageHeader) {
+		// Not encrypted (or too short to tell), let the tar reader deal with it
+		return buffered, nil
+	}
+
+	if len(a.identities) == 0 {
+		return nil, fmt.Errorf("backup is encrypted but no decryption key is configured (set backup.encryption.identity_file or %s)", PassphraseEnvVar)
+	}
+
+	decrypted, err := age.Decrypt(buffered, a.identities...)
+	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		if errors.As(err, &noMatch) {
+			return nil, fmt.Errorf("failed to decrypt backup: the configured key or passphrase does not match this backup")
+		}
+		return nil, fmt.Errorf("failed to decrypt backup: %w", err)
+	}
+
+	return decrypted, nil
+}
@@ -0,0 +1,176 @@
+package archive
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/volcie/stash/internal/config"
+)
+
+func TestLoadRecipients(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		cfg        config.EncryptionConfig
+		passphrase string
+		want       int
+		wantErr    string
+	}{
+		{"disabled", config.EncryptionConfig{Recipients: []string{"invalid"}}, "", 0, ""},
+		{"recipient", config.EncryptionConfig{Enabled: true, Recipients: []string{" " + identity.Recipient().String() + "\n"}}, "", 1, ""},
+		{"invalid recipient", config.EncryptionConfig{Enabled: true, Recipients: []string{"age1invalid"}}, "", 0, `invalid encryption recipient "age1invalid"`},
+		{"recipients take precedence", config.EncryptionConfig{Enabled: true, Recipients: []string{identity.Recipient().String()}}, "secret", 1, ""},
+		{"passphrase", config.EncryptionConfig{Enabled: true}, "secret", 1, ""},
+		{"no key", config.EncryptionConfig{Enabled: true}, "", 0, PassphraseEnvVar + " is not set"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(PassphraseEnvVar, tt.passphrase)
+
+			recipients, err := LoadRecipients(tt.cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadRecipients() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadRecipients() error = %v", err)
+			}
+			if len(recipients) != tt.want {
+				t.Errorf("LoadRecipients() returned %d recipients, want %d", len(recipients), tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadIdentities(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	identityFile := filepath.Join(dir, "key.txt")
+	if err := os.WriteFile(identityFile, []byte("# key\n"+identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	invalidFile := filepath.Join(dir, "invalid.txt")
+	if err := os.WriteFile(invalidFile, []byte("not a key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		identityFile string
+		passphrase   string
+		want         int
+		wantErr      string
+	}{
+		{"nothing configured", "", "", 0, ""},
+		{"identity file", identityFile, "", 1, ""},
+		{"identity file and passphrase", identityFile, "secret", 2, ""},
+		{"passphrase", "", "secret", 1, ""},
+		{"missing identity file", filepath.Join(dir, "missing.txt"), "", 0, "failed to open encryption identity file"},
+		{"invalid identity file", invalidFile, "", 0, "failed to parse encryption identity file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(PassphraseEnvVar, tt.passphrase)
+
+			identities, err := LoadIdentities(config.EncryptionConfig{IdentityFile: tt.identityFile})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadIdentities() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadIdentities() error = %v", err)
+			}
+			if len(identities) != tt.want {
+				t.Errorf("LoadIdentities() returned %d identities, want %d", len(identities), tt.want)
+			}
+		})
+	}
+}
+
+func TestDecryptArchive(t *testing.T) {
+	owner, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := t.TempDir()
+	writeTestFile(t, filepath.Join(source, "file"), "content")
+
+	createArchive := func(recipients []age.Recipient) []byte {
+		archiver := NewArchiver(config.CompressionZstd, false)
+		archiver.SetRecipients(recipients)
+		var buf bytes.Buffer
+		if _, err := archiver.CreateArchive(&buf, source, nil); err != nil {
+			t.Fatalf("CreateArchive() error = %v", err)
+		}
+		return buf.Bytes()
+	}
+	encrypted := createArchive([]age.Recipient{owner.Recipient()})
+	plain := createArchive(nil)
+
+	if !bytes.HasPrefix(encrypted, ageHeader) {
+		t.Fatal("archive isn't encrypted")
+	}
+
+	tests := []struct {
+		name       string
+		archive    []byte
+		identities []age.Identity
+		wantErr    string
+	}{
+		{"matching key", encrypted, []age.Identity{owner}, ""},
+		{"one of several keys", encrypted, []age.Identity{other, owner}, ""},
+		{"no key", encrypted, nil, "no decryption key is configured"},
+		{"wrong key", encrypted, []age.Identity{other}, "does not match this backup"},
+		{"corrupt header", append(append([]byte(nil), ageHeader...), "garbage\n"...), []age.Identity{owner}, "failed to decrypt backup"},
+		{"plain archive with a key", plain, []age.Identity{owner}, ""},
+		{"plain archive without a key", plain, nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archiver := NewArchiver(config.CompressionZstd, false)
+			archiver.SetIdentities(tt.identities)
+
+			manifest, err := archiver.ListArchive(bytes.NewReader(tt.archive))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ListArchive() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ListArchive() error = %v", err)
+			}
+			if len(manifest.Files) == 0 {
+				t.Fatal("ListArchive() returned no entries")
+			}
+			last := manifest.Files[len(manifest.Files)-1]
+			if last.Path != "file" || last.Size != int64(len("content")) {
+				t.Errorf("ListArchive() = %+v, want the archived file", manifest.Files)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package archive
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// IgnoreFileName is the name of the per-directory exclude file honored while archiving
+const IgnoreFileName = ".stashignore"
+
+// excludeRule is a single exclude pattern, using .gitignore-like syntax:
+// patterns without a slash match a name at any depth, patterns with a slash are
+// relative to the directory that declared them, ** matches any number of directories,
+// a trailing slash only matches directories and a leading ! re-includes a path.
+type excludeRule struct {
+	segments []string
+	anchored bool
+	dirOnly  bool
+	negate   bool
+}
+
+func parseExcludeRule(pattern string) (excludeRule, bool) {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return excludeRule{}, false
+	}
+
+	var rule excludeRule
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+
+	rule.anchored = strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	if pattern == "" {
+		return excludeRule{}, false
+	}
+
+	rule.segments = strings.Split(pattern, "/")
+	return rule, true
+}
+
+// matches reports whether relPath (slash separated, relative to the rule's directory) matches
+func (r excludeRule) matches(relPath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+
+	if !r.anchored {
+		return matchSegments(r.segments, []string{path.Base(relPath)})
+	}
+
+	name := strings.Split(relPath, "/")
+	if matchSegments(r.segments, name) {
+		return true
+	}
+
+	// "dir/**" matches everything below dir, so the directory itself can be skipped as a whole
+	last := len(r.segments) - 1
+	return isDir && last > 0 && r.segments[last] == "**" && matchSegments(r.segments[:last], name)
+}
+
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(name) == 0 {
+		return false
+	}
+
+	if ok, _ := path.Match(pattern[0], name[0]); !ok {
+		return false
+	}
+
+	return matchSegments(pattern[1:], name[1:])
+}
+
+// PathFilter selects archive entries with patterns in the exclude syntax. An entry is
+// selected when the last pattern matching it or one of its parent directories isn't negated.
+type PathFilter struct {
+	rules []excludeRule
+}
+
+// NewPathFilter creates a filter from patterns, nil (selecting everything) if there are none
+func NewPathFilter(patterns []string) *PathFilter {
+	var filter PathFilter
+	for _, pattern := range patterns {
+		if rule, ok := parseExcludeRule(pattern); ok {
+			filter.rules = append(filter.rules, rule)
+		}
+	}
+
+	if len(filter.rules) == 0 {
+		return nil
+	}
+	return &filter
+}
+
+// Match reports whether relPath (slash separated, relative to the archive root) is selected
+func (f *PathFilter) Match(relPath string, isDir bool) bool {
+	if f == nil {
+		return true
+	}
+
+	matched := false
+	parts := strings.Split(relPath, "/")
+	for i := 1; i <= len(parts); i++ {
+		candidate := strings.Join(parts[:i], "/")
+		for _, rule := range f.rules {
+			if rule.matches(candidate, isDir || i < len(parts)) {
+				matched = !rule.negate
+			}
+		}
+	}
+
+	return matched
+}
+
+// LiteralPattern escapes the glob characters in name, so it only matches that exact name
+func LiteralPattern(name string) string {
+	var escaped strings.Builder
+	for _, r := range name {
+		if strings.ContainsRune(`*?[\`, r) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+
+	// A leading ! or # would be read as negation or a comment
+	pattern := escaped.String()
+	if strings.HasPrefix(pattern, "!") || strings.HasPrefix(pattern, "#") {
+		pattern = "/" + pattern
+	}
+	return pattern
+}
+
+// excludeMatcher decides which paths of a single walk are excluded, combining the configured
+// patterns with .stashignore files found along the way
+type excludeMatcher struct {
+	root  string
+	rules map[string][]excludeRule // by directory relative to root, "." for the root
+}
+
+func (a *Archiver) newExcludeMatcher(root string) *excludeMatcher {
+	matcher := &excludeMatcher{
+		root:  root,
+		rules: make(map[string][]excludeRule),
+	}
+
+	for _, pattern := range a.excludes {
+		if rule, ok := parseExcludeRule(pattern); ok {
+			matcher.rules["."] = append(matcher.rules["."], rule)
+		}
+	}
+
+	return matcher
+}
+
+// loadIgnoreFile reads the .stashignore file in relDir, if there is one.
+// Must be called for each directory before its contents are checked.
+func (m *excludeMatcher) loadIgnoreFile(relDir string) {
+	ignorePath := filepath.Join(m.root, filepath.FromSlash(relDir), IgnoreFileName)
+
+	file, err := os.Open(ignorePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Warnf("Failed to read %s: %v", ignorePath, err)
+		}
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rule, ok := parseExcludeRule(scanner.Text()); ok {
+			m.rules[relDir] = append(m.rules[relDir], rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logrus.Warnf("Failed to read %s: %v", ignorePath, err)
+	}
+
+	logrus.Debugf("Loaded exclude rules from %s", ignorePath)
+}
+
+// excluded reports whether relPath (slash separated, relative to the root) is excluded.
+// Rules are checked from the root down and the last matching rule wins.
+func (m *excludeMatcher) excluded(relPath string, isDir bool) bool {
+	if relPath == "." || len(m.rules) == 0 {
+		return false
+	}
+
+	excluded := false
+	dirs := []string{"."}
+	parts := strings.Split(relPath, "/")
+	for i := 1; i < len(parts); i++ {
+		dirs = append(dirs, strings.Join(parts[:i], "/"))
+	}
+
+	for _, dir := range dirs {
+		rules := m.rules[dir]
+		if len(rules) == 0 {
+			continue
+		}
+
+		rulePath := relPath
+		if dir != "." {
+			rulePath = strings.TrimPrefix(relPath, dir+"/")
+		}
+
+		for _, rule := range rules {
+			if rule.matches(rulePath, isDir) {
+				excluded = !rule.negate
+			}
+		}
+	}
+
+	return excluded
+}
+
+// SetExcludes sets the glob patterns of paths left out of archives, relative to the source path
+func (a *Archiver) SetExcludes(patterns []string) {
+	a.excludes = patterns
+}
+
+// SetIncludes restricts extraction to the entries matching patterns, see PathFilter
+func (a *Archiver) SetIncludes(patterns []string) {
+	a.includes = NewPathFilter(patterns)
+}
+
+// skipExcluded checks a walked path against the exclude rules, loading any .stashignore
+// file of directories that are kept. Returns filepath.SkipDir for excluded directories.
+func (m *excludeMatcher) skipExcluded(relPath string, info os.FileInfo) (bool, error) {
+	if m.excluded(relPath, info.IsDir()) {
+		logrus.Debugf("Excluded: %s", relPath)
+		if info.IsDir() {
+			return true, filepath.SkipDir
+		}
+		return true, nil
+	}
+
+	if info.IsDir() {
+		m.loadIgnoreFile(relPath)
+	}
+
+	return false, nil
+}
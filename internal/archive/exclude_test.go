@@ -0,0 +1,128 @@
+package archive
+
+import (
+	"bytes"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/volcie/stash/internal/config"
+)
+
+func TestExcludePatterns(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{"name at any depth", []string{"*.log"}, "a/b/debug.log", false, true},
+		{"name at the root", []string{"*.log"}, "debug.log", false, true},
+		{"no match", []string{"*.log"}, "a/debug.txt", false, false},
+		{"directory by name", []string{"cache"}, "a/cache", true, true},
+		{"anchored matches from the root", []string{"/build"}, "build", true, true},
+		{"anchored doesn't match deeper", []string{"/build"}, "src/build", true, false},
+		{"pattern with a slash is anchored", []string{"src/gen"}, "lib/src/gen", true, false},
+		{"directory only matches a directory", []string{"tmp/"}, "tmp", true, true},
+		{"directory only skips files", []string{"tmp/"}, "tmp", false, false},
+		{"double star in the middle", []string{"a/**/z"}, "a/b/c/z", false, true},
+		{"double star matches no directories", []string{"a/**/z"}, "a/z", false, true},
+		{"trailing double star", []string{"logs/**"}, "logs/2025/app.log", false, true},
+		{"trailing double star skips the directory", []string{"logs/**"}, "logs", true, true},
+		{"leading double star", []string{"**/node_modules"}, "web/app/node_modules", true, true},
+		{"negation re-includes", []string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{"last rule wins", []string{"!keep.log", "*.log"}, "keep.log", false, true},
+		{"comment", []string{"# *.log"}, "debug.log", false, false},
+		{"blank", []string{"  "}, "debug.log", false, false},
+		{"root is never excluded", []string{"*"}, ".", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archiver := NewArchiver(config.CompressionNone, false)
+			archiver.SetExcludes(tt.patterns)
+			matcher := archiver.newExcludeMatcher(t.TempDir())
+
+			if got := matcher.excluded(tt.path, tt.isDir); got != tt.want {
+				t.Errorf("excluded(%q) with %v = %v, want %v", tt.path, tt.patterns, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateArchiveStashignore(t *testing.T) {
+	source := t.TempDir()
+	for _, name := range []string{
+		"keep.txt",
+		"debug.log",
+		"app/main.go",
+		"app/app.log",
+		"app/important.log",
+		"app/build/out.bin",
+		"app/sub/build/out.bin",
+		"vendor/lib.go",
+	} {
+		writeTestFile(t, filepath.Join(source, name), name)
+	}
+	writeTestFile(t, filepath.Join(source, IgnoreFileName), "*.log\n# comment\n\nvendor/\n")
+	// Rules of nested files are relative to their directory and override the parent's
+	writeTestFile(t, filepath.Join(source, "app", IgnoreFileName), "!important.log\n/build\n")
+
+	archiver := NewArchiver(config.CompressionNone, false)
+	var buf bytes.Buffer
+	if _, err := archiver.CreateArchive(&buf, source, nil); err != nil {
+		t.Fatalf("CreateArchive() error = %v", err)
+	}
+
+	manifest, err := NewArchiver(config.CompressionNone, false).ListArchive(&buf)
+	if err != nil {
+		t.Fatalf("ListArchive() error = %v", err)
+	}
+	var files []string
+	for _, entry := range manifest.Files {
+		if entry.Type == EntryFile {
+			files = append(files, entry.Path)
+		}
+	}
+	sort.Strings(files)
+
+	want := []string{
+		".stashignore",
+		"app/.stashignore",
+		"app/important.log",
+		"app/main.go",
+		"app/sub/build/out.bin",
+		"keep.txt",
+	}
+	if strings.Join(files, ",") != strings.Join(want, ",") {
+		t.Errorf("archived %v, want %v", files, want)
+	}
+}
+
+func TestPathFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		want     bool
+	}{
+		{"no patterns select everything", nil, "a/b", true},
+		{"directory selects its contents", []string{"/etc"}, "etc/nginx/nginx.conf", true},
+		{"other directory", []string{"/etc"}, "var/log", false},
+		{"negated", []string{"/etc", "!*.bak"}, "etc/hosts.bak", false},
+		{"literal keeps glob characters", []string{LiteralPattern("a[1].txt")}, "a[1].txt", true},
+		{"literal doesn't glob", []string{LiteralPattern("a[1].txt")}, "a1.txt", false},
+		{"literal leading bang", []string{LiteralPattern("!important")}, "!important", true},
+		{"literal leading hash", []string{LiteralPattern("#notes")}, "#notes", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewPathFilter(tt.patterns).Match(tt.path, false); got != tt.want {
+				t.Errorf("Match(%q) with %v = %v, want %v", tt.path, tt.patterns, got, tt.want)
+			}
+		})
+	}
+}
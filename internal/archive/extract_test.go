@@ -0,0 +1,180 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/volcie/stash/internal/config"
+)
+
+// tarEntry is an entry of a test archive, with content for regular files
+type tarEntry struct {
+	header  tar.Header
+	content string
+}
+
+// buildTar returns an uncompressed tar holding entries, in order
+func buildTar(t *testing.T, entries ...tarEntry) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := entry.header
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(entry.content))
+		}
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+		if header.ModTime.IsZero() {
+			header.ModTime = time.Now()
+		}
+		if err := tarWriter.WriteHeader(&header); err != nil {
+			t.Fatalf("failed to write header %s: %v", header.Name, err)
+		}
+		if _, err := tarWriter.Write([]byte(entry.content)); err != nil {
+			t.Fatalf("failed to write %s: %v", header.Name, err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	return &buf
+}
+
+func fileEntry(name, content string) tarEntry {
+	return tarEntry{header: tar.Header{Name: name, Typeflag: tar.TypeReg}, content: content}
+}
+
+func TestExtractArchiveRejectsMaliciousEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries func(outside string) []tarEntry
+		wantErr string
+	}{
+		{
+			name: "parent directory escape",
+			entries: func(outside string) []tarEntry {
+				return []tarEntry{fileEntry("../escaped", "evil")}
+			},
+			wantErr: "path escapes the restore directory",
+		},
+		{
+			name: "nested parent directory escape",
+			entries: func(outside string) []tarEntry {
+				return []tarEntry{fileEntry("a/../../escaped", "evil")}
+			},
+			wantErr: "path escapes the restore directory",
+		},
+		{
+			name: "absolute name",
+			entries: func(outside string) []tarEntry {
+				return []tarEntry{fileEntry(filepath.ToSlash(filepath.Join(outside, "escaped")), "evil")}
+			},
+			wantErr: "absolute paths are not allowed",
+		},
+		{
+			name: "write through a symlink",
+			entries: func(outside string) []tarEntry {
+				return []tarEntry{
+					{header: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outside}},
+					fileEntry("link/escaped", "evil"),
+				}
+			},
+			wantErr: "path goes through a symlink",
+		},
+		{
+			name: "hardlink through a symlink",
+			entries: func(outside string) []tarEntry {
+				return []tarEntry{
+					{header: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outside}},
+					{header: tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "link/escaped"}},
+				}
+			},
+			wantErr: "path goes through a symlink",
+		},
+		{
+			name: "directory replaced by a symlink",
+			entries: func(outside string) []tarEntry {
+				return []tarEntry{
+					{header: tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0777, ModTime: time.Unix(0, 0)}},
+					{header: tar.Header{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: outside}},
+				}
+			},
+			wantErr: "replaces a directory extracted earlier",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			destPath := filepath.Join(root, "dest")
+			outside := filepath.Join(root, "outside")
+			if err := os.MkdirAll(outside, 0700); err != nil {
+				t.Fatal(err)
+			}
+			before, err := os.Stat(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			archiver := NewArchiver(config.CompressionNone, false)
+			_, err = archiver.ExtractArchive(buildTar(t, tt.entries(outside)...), destPath)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ExtractArchive() error = %v, want %q", err, tt.wantErr)
+			}
+
+			if _, err := os.Lstat(filepath.Join(root, "escaped")); err == nil {
+				t.Errorf("file written outside the restore directory: %s", filepath.Join(root, "escaped"))
+			}
+			if _, err := os.Lstat(filepath.Join(outside, "escaped")); err == nil {
+				t.Errorf("file written through a symlink: %s", filepath.Join(outside, "escaped"))
+			}
+
+			after, err := os.Stat(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if after.Mode() != before.Mode() || !after.ModTime().Equal(before.ModTime()) {
+				t.Errorf("metadata of %s changed: mode %v -> %v, mtime %v -> %v",
+					outside, before.Mode(), after.Mode(), before.ModTime(), after.ModTime())
+			}
+		})
+	}
+}
+
+func TestExtractArchiveRestoresDirectoryMetadata(t *testing.T) {
+	destPath := t.TempDir()
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	archive := buildTar(t,
+		tarEntry{header: tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0750, ModTime: modTime}},
+		fileEntry("dir/file", "content"),
+	)
+
+	archiver := NewArchiver(config.CompressionNone, false)
+	stats, err := archiver.ExtractArchive(archive, destPath)
+	if err != nil {
+		t.Fatalf("ExtractArchive() error = %v", err)
+	}
+	if stats.Entries != 2 {
+		t.Errorf("Entries = %d, want 2", stats.Entries)
+	}
+
+	info, err := os.Stat(filepath.Join(destPath, "dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0750 {
+		t.Errorf("dir mode = %v, want 0750", info.Mode().Perm())
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("dir mtime = %v, want %v", info.ModTime(), modTime)
+	}
+}
@@ -0,0 +1,73 @@
+//go:build unix
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/volcie/stash/internal/config"
+)
+
+func TestCreateArchiveProgressWithHardlinks(t *testing.T) {
+	source := t.TempDir()
+	writeTestFile(t, filepath.Join(source, "file"), "content")
+	writeTestFile(t, filepath.Join(source, "other"), "other content")
+	for _, name := range []string{"link1", "dir/link2"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(source, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Link(filepath.Join(source, "file"), filepath.Join(source, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archiver := NewArchiver(config.CompressionNone, false)
+	count, err := archiver.CountFiles(source, nil)
+	if err != nil {
+		t.Fatalf("CountFiles() error = %v", err)
+	}
+	if count != 4 {
+		t.Errorf("CountFiles() = %d, want 4", count)
+	}
+
+	bar := progressbar.NewOptions(count, progressbar.OptionSetWriter(io.Discard))
+	var buf bytes.Buffer
+	stats, err := archiver.CreateArchiveWithProgress(&buf, source, nil, bar)
+	if err != nil {
+		t.Fatalf("CreateArchiveWithProgress() error = %v", err)
+	}
+	if got := bar.State().CurrentNum; got != int64(count) {
+		t.Errorf("progress bar at %d, want %d", got, count)
+	}
+	if stats.FilesProcessed != count {
+		t.Errorf("FilesProcessed = %d, want %d", stats.FilesProcessed, count)
+	}
+
+	// The content is stored once, the other names are link entries
+	var regular, links int
+	reader := tar.NewReader(&buf)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch header.Typeflag {
+		case tar.TypeReg:
+			regular++
+		case tar.TypeLink:
+			links++
+		}
+	}
+	if regular != 2 || links != 2 {
+		t.Errorf("archive holds %d files and %d links, want 2 and 2", regular, links)
+	}
+}
@@ -0,0 +1,209 @@
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/volcie/stash/internal/config"
+	"github.com/volcie/stash/internal/storage"
+)
+
+const manifestVersion = 1
+
+// Manifest lists every entry of an archive with its checksum, so backups can be inspected,
+// verified and compared without downloading the archive itself
+type Manifest struct {
+	Version       int             `json:"version"`
+	Service       string          `json:"service,omitempty"`
+	Path          string          `json:"path,omitempty"`
+	Timestamp     string          `json:"timestamp,omitempty"`
+	Kind          string          `json:"kind,omitempty"`
+	ArchiveSize   int64           `json:"archive_size"`
+	ArchiveSHA256 string          `json:"archive_sha256"` // of the stored archive, after compression and encryption
+	Files         []ManifestEntry `json:"files"`
+	Deleted       []string        `json:"deleted,omitempty"` // paths deleted since the base of an incremental archive
+}
+
+// ManifestEntry describes a single archive entry
+type ManifestEntry struct {
+	Path    string    `json:"path"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	Mode    int64     `json:"mode"` // permission bits, including setuid, setgid and sticky
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256,omitempty"` // regular files only
+	Link    string    `json:"link,omitempty"`   // target of symlinks and hardlinks
+}
+
+// Entry types recorded in manifests
+const (
+	EntryFile     = "file"
+	EntryDir      = "dir"
+	EntrySymlink  = "symlink"
+	EntryHardlink = "hardlink"
+	EntryFifo     = "fifo"
+	EntryChar     = "char"
+	EntryBlock    = "block"
+)
+
+// entryType returns the manifest type of a tar entry
+func entryType(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeDir:
+		return EntryDir
+	case tar.TypeSymlink:
+		return EntrySymlink
+	case tar.TypeLink:
+		return EntryHardlink
+	case tar.TypeFifo:
+		return EntryFifo
+	case tar.TypeChar:
+		return EntryChar
+	case tar.TypeBlock:
+		return EntryBlock
+	default:
+		return EntryFile
+	}
+}
+
+func newManifestEntry(header *tar.Header) ManifestEntry {
+	return ManifestEntry{
+		Path:    header.Name,
+		Type:    entryType(header.Typeflag),
+		Size:    header.Size,
+		Mode:    header.Mode & 07777,
+		ModTime: header.ModTime,
+		Link:    header.Linkname,
+	}
+}
+
+// hashingWriter computes the size and SHA-256 of everything written through it
+type hashingWriter struct {
+	writer  io.Writer
+	hash    hash.Hash
+	written int64
+}
+
+func newHashingWriter(writer io.Writer) *hashingWriter {
+	return &hashingWriter{writer: writer, hash: sha256.New()}
+}
+
+func (hw *hashingWriter) Write(p []byte) (int, error) {
+	n, err := hw.writer.Write(p)
+	hw.hash.Write(p[:n])
+	hw.written += int64(n)
+	return n, err
+}
+
+func (hw *hashingWriter) sum() string {
+	return hex.EncodeToString(hw.hash.Sum(nil))
+}
+
+// ScanTree returns the manifest an archive of sourcePath would have, with the checksum of every
+// regular file, without writing anything. The exclude patterns apply as when archiving.
+func (a *Archiver) ScanTree(sourcePath string, includeFolders []string) (*Manifest, error) {
+	scanner := NewArchiver(config.CompressionNone, false)
+	scanner.excludes = a.excludes
+
+	stats, err := scanner.CreateArchive(io.Discard, sourcePath, includeFolders)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := stats.Manifest
+	manifest.ArchiveSize = 0
+	manifest.ArchiveSHA256 = ""
+	return manifest, nil
+}
+
+// WriteManifest writes a manifest as gzip compressed JSON, encrypted like archives when encryption is enabled
+func (a *Archiver) WriteManifest(writer io.Writer, manifest *Manifest) error {
+	encryptedWriter, encryptCloser, err := a.encryptWriter(writer)
+	if err != nil {
+		return err
+	}
+
+	gzipWriter := gzip.NewWriter(encryptedWriter)
+	if err := json.NewEncoder(gzipWriter).Encode(manifest); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	if err := gzipWriter.Close(); err != nil {
+		return fmt.Errorf("failed to finish manifest compression: %w", err)
+	}
+
+	if encryptCloser != nil {
+		if err := encryptCloser.Close(); err != nil {
+			return fmt.Errorf("failed to finish manifest encryption: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ReadManifest reads a manifest written by WriteManifest
+func (a *Archiver) ReadManifest(reader io.Reader) (*Manifest, error) {
+	decrypted, err := a.decryptReader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	gzipReader, err := gzip.NewReader(decrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	defer gzipReader.Close()
+
+	var manifest Manifest
+	if err := json.NewDecoder(gzipReader).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	if manifest.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", manifest.Version)
+	}
+
+	return &manifest, nil
+}
+
+// LoadManifest downloads and decrypts the manifest stored next to a backup. Backups made before
+// manifests were introduced, or whose manifest upload failed, have none.
+func (a *Archiver) LoadManifest(ctx context.Context, backend storage.Backend, backup *storage.BackupInfo) (*Manifest, error) {
+	reader, err := backend.Download(ctx, storage.ManifestKey(backup.Key))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return a.ReadManifest(reader)
+}
+
+// MergeManifests returns the entries by path left after restoring the backups of a chain
+// in order, given their manifests, oldest first
+func MergeManifests(manifests []*Manifest) map[string]ManifestEntry {
+	files := make(map[string]ManifestEntry)
+	for _, manifest := range manifests {
+		for _, deleted := range manifest.Deleted {
+			delete(files, CleanEntryName(deleted))
+		}
+		for _, entry := range manifest.Files {
+			files[CleanEntryName(entry.Path)] = entry
+		}
+	}
+	return files
+}
+
+// CleanEntryName normalizes a path inside an archive, e.g. "./wp-config.php" to "wp-config.php"
+func CleanEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
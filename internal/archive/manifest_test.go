@@ -0,0 +1,58 @@
+package archive
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMergeManifests(t *testing.T) {
+	manifest := func(deleted []string, paths ...string) *Manifest {
+		m := &Manifest{Deleted: deleted}
+		for _, path := range paths {
+			m.Files = append(m.Files, ManifestEntry{Path: path, Type: EntryFile})
+		}
+		return m
+	}
+
+	tests := []struct {
+		name      string
+		manifests []*Manifest
+		want      []string
+	}{
+		{"full", []*Manifest{manifest(nil, "a", "dir/b")}, []string{"a", "dir/b"}},
+		{"names are cleaned", []*Manifest{manifest(nil, "./a", "dir//b", ".")}, []string{"", "a", "dir/b"}},
+		{"later layers add", []*Manifest{manifest(nil, "a"), manifest(nil, "b")}, []string{"a", "b"}},
+		{"deletions remove", []*Manifest{manifest(nil, "a", "b"), manifest([]string{"b"})}, []string{"a"}},
+		{"deleted directory contents", []*Manifest{manifest(nil, "dir", "dir/a", "dir/b", "c"), manifest([]string{"dir", "dir/a", "dir/b"})}, []string{"c"}},
+		{"deleted then recreated", []*Manifest{manifest(nil, "a"), manifest([]string{"a"}), manifest(nil, "a")}, []string{"a"}},
+		// A layer lists the paths deleted since its base, and stores the paths recreated since
+		{"replaced in the same layer", []*Manifest{manifest(nil, "a"), manifest([]string{"./a"}, "a")}, []string{"a"}},
+		{"deleting a missing path", []*Manifest{manifest(nil, "a"), manifest([]string{"missing"})}, []string{"a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := MergeManifests(tt.manifests)
+
+			var got []string
+			for path := range files {
+				got = append(got, path)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("MergeManifests() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeManifestsKeepsNewestEntry(t *testing.T) {
+	files := MergeManifests([]*Manifest{
+		{Files: []ManifestEntry{{Path: "a", Type: EntryFile, SHA256: "old"}}},
+		{Files: []ManifestEntry{{Path: "a", Type: EntryFile, SHA256: "new"}}},
+	})
+	if files["a"].SHA256 != "new" {
+		t.Errorf("MergeManifests() kept %q, want the newest entry", files["a"].SHA256)
+	}
+}
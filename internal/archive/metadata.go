@@ -0,0 +1,119 @@
+package archive
+
+import (
+	"archive/tar"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// modeBits are the permission bits restored on extracted files and directories
+const modeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// SetPreserveOwnership restores the owner and group of extracted files. Only takes effect
+// when running as root, files are owned by the restoring user otherwise.
+func (a *Archiver) SetPreserveOwnership(preserve bool) {
+	a.preserveOwnership = preserve
+}
+
+// ownerMapper resolves archived owners to local ids, preferring the user and group
+// names over the numeric ids so restores onto another host map to the right accounts
+type ownerMapper struct {
+	users  map[string]int
+	groups map[string]int
+}
+
+func newOwnerMapper() *ownerMapper {
+	return &ownerMapper{
+		users:  make(map[string]int),
+		groups: make(map[string]int),
+	}
+}
+
+func (m *ownerMapper) uid(header *tar.Header) int {
+	if header.Uname == "" {
+		return header.Uid
+	}
+
+	if uid, ok := m.users[header.Uname]; ok {
+		return uid
+	}
+
+	uid := header.Uid
+	if u, err := user.Lookup(header.Uname); err == nil {
+		if id, err := strconv.Atoi(u.Uid); err == nil {
+			uid = id
+		}
+	} else {
+		logrus.Debugf("User %s not found, using uid %d", header.Uname, header.Uid)
+	}
+
+	m.users[header.Uname] = uid
+	return uid
+}
+
+func (m *ownerMapper) gid(header *tar.Header) int {
+	if header.Gname == "" {
+		return header.Gid
+	}
+
+	if gid, ok := m.groups[header.Gname]; ok {
+		return gid
+	}
+
+	gid := header.Gid
+	if g, err := user.LookupGroup(header.Gname); err == nil {
+		if id, err := strconv.Atoi(g.Gid); err == nil {
+			gid = id
+		}
+	} else {
+		logrus.Debugf("Group %s not found, using gid %d", header.Gname, header.Gid)
+	}
+
+	m.groups[header.Gname] = gid
+	return gid
+}
+
+// restoreMetadata applies the owner, mode and times recorded in header to an extracted path.
+// Failures are logged and don't stop the extraction.
+func (a *Archiver) restoreMetadata(path string, header *tar.Header, owners *ownerMapper) {
+	// Chown first, it clears setuid/setgid bits
+	if owners != nil {
+		if err := os.Lchown(path, owners.uid(header), owners.gid(header)); err != nil {
+			logrus.Warnf("Failed to restore owner of %s: %v", path, err)
+		}
+	}
+
+	// Symlink permissions and times are not meaningful (and chmod would follow the link)
+	if header.Typeflag == tar.TypeSymlink {
+		return
+	}
+
+	if err := os.Chmod(path, header.FileInfo().Mode()&modeBits); err != nil {
+		logrus.Warnf("Failed to restore permissions of %s: %v", path, err)
+	}
+
+	accessTime := header.AccessTime
+	if accessTime.IsZero() {
+		accessTime = header.ModTime
+	}
+	if err := os.Chtimes(path, accessTime, header.ModTime); err != nil {
+		logrus.Warnf("Failed to restore times of %s: %v", path, err)
+	}
+}
+
+// newOwnerMapperIfRoot returns an owner mapper when ownership should be restored, or nil
+func (a *Archiver) newOwnerMapperIfRoot() *ownerMapper {
+	if !a.preserveOwnership {
+		return nil
+	}
+
+	if os.Geteuid() != 0 {
+		logrus.Debugf("Not running as root, extracted files keep the current user as owner")
+		return nil
+	}
+
+	return newOwnerMapper()
+}
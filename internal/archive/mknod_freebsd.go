@@ -0,0 +1,8 @@
+package archive
+
+import "golang.org/x/sys/unix"
+
+// mknod creates a device node, FreeBSD takes the device number unconverted
+func mknod(path string, mode uint32, dev uint64) error {
+	return unix.Mknod(path, mode, dev)
+}
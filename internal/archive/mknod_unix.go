@@ -0,0 +1,10 @@
+//go:build unix && !freebsd
+
+package archive
+
+import "golang.org/x/sys/unix"
+
+// mknod creates a device node
+func mknod(path string, mode uint32, dev uint64) error {
+	return unix.Mknod(path, mode, int(dev))
+}
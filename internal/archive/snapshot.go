@@ -0,0 +1,184 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// deletionsEntryName is the name of the archive entry listing paths deleted since the base
+// snapshot. Extraction recognizes it by its PAX record, not by name.
+const deletionsEntryName = ".stash-deleted"
+
+// deletionsRecord marks the deletions entry in an incremental archive
+const deletionsRecord = "STASH.deletions"
+
+// Snapshot records the state of every archived path, so the next backup can tell what changed
+type Snapshot struct {
+	Files map[string]SnapshotEntry `json:"files"`
+}
+
+// SnapshotEntry is the state of a single path. A path whose entry differs from the
+// base snapshot is archived again.
+type SnapshotEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"` // Unix nanoseconds
+	Inode   uint64 `json:"inode,omitempty"`
+	Mode    uint32 `json:"mode"`
+}
+
+func newSnapshot() *Snapshot {
+	return &Snapshot{Files: make(map[string]SnapshotEntry)}
+}
+
+func snapshotEntry(info os.FileInfo) SnapshotEntry {
+	return SnapshotEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Inode:   inode(info),
+		Mode:    uint32(info.Mode()),
+	}
+}
+
+// unchanged reports whether relPath is recorded in the snapshot with the same state
+func (s *Snapshot) unchanged(relPath string, info os.FileInfo) bool {
+	if s == nil {
+		return false
+	}
+	previous, ok := s.Files[relPath]
+	return ok && previous == snapshotEntry(info)
+}
+
+// SetRecordSnapshot makes CreateArchive record a snapshot of the archived paths in ArchiveStats
+func (a *Archiver) SetRecordSnapshot(record bool) {
+	a.recordSnapshot = record
+}
+
+// SetBaseSnapshot makes CreateArchive write an incremental archive on top of base: only paths
+// that changed since base are stored, along with the list of paths deleted since.
+// Directories are always stored so their metadata is restored.
+func (a *Archiver) SetBaseSnapshot(base *Snapshot) {
+	a.baseSnapshot = base
+	if base != nil {
+		a.recordSnapshot = true
+	}
+}
+
+// skipUnchanged reports whether a walked path can be left out of an incremental archive
+func (a *Archiver) skipUnchanged(relPath string, info os.FileInfo) bool {
+	return !info.IsDir() && a.baseSnapshot.unchanged(relPath, info)
+}
+
+// keepBaseEntry carries the base snapshot entry of a path left out of an incremental archive over
+// to current, so it isn't recorded as deleted while the next backup still archives it if changed
+func (a *Archiver) keepBaseEntry(current *Snapshot, relPath string) {
+	if current == nil || a.baseSnapshot == nil {
+		return
+	}
+	if previous, ok := a.baseSnapshot.Files[relPath]; ok {
+		current.Files[relPath] = previous
+	}
+}
+
+// writeDeletions appends the paths in the base snapshot that are gone from current
+func (a *Archiver) writeDeletions(tarWriter *tar.Writer, current *Snapshot) ([]string, error) {
+	var deleted []string
+	for relPath := range a.baseSnapshot.Files {
+		if _, exists := current.Files[relPath]; !exists {
+			deleted = append(deleted, relPath)
+		}
+	}
+	if len(deleted) == 0 {
+		return nil, nil
+	}
+	sort.Strings(deleted)
+
+	content := strings.Join(deleted, "\x00")
+	header := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       deletionsEntryName,
+		Mode:       0644,
+		Size:       int64(len(content)),
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{deletionsRecord: "1"},
+	}
+
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return nil, fmt.Errorf("failed to write deletions header: %w", err)
+	}
+	if _, err := io.WriteString(tarWriter, content); err != nil {
+		return nil, fmt.Errorf("failed to write deletions: %w", err)
+	}
+
+	logrus.Infof("Recorded %d deleted paths", len(deleted))
+	return deleted, nil
+}
+
+// isDeletions reports whether header is the deletions entry of an incremental archive
+func isDeletions(header *tar.Header) bool {
+	_, ok := header.PAXRecords[deletionsRecord]
+	return ok
+}
+
+// applyDeletions removes the paths listed in a deletions entry from destPath. Every deleted path
+// is listed, including the contents of deleted directories, so paths outside the include patterns
+// can simply be left alone.
+func (a *Archiver) applyDeletions(reader io.Reader, destPath string) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	scanner.Split(scanNul)
+
+	for scanner.Scan() {
+		if !a.includes.Match(scanner.Text(), false) {
+			continue
+		}
+
+		targetPath, err := safeJoin(destPath, scanner.Text())
+		if err != nil {
+			return err
+		}
+		if targetPath == filepath.Clean(destPath) {
+			continue
+		}
+
+		if err := checkNoSymlinks(destPath, filepath.Dir(targetPath)); err != nil {
+			return err
+		}
+
+		// Already gone, e.g. removed along with a deleted directory
+		if _, err := os.Lstat(targetPath); err != nil {
+			continue
+		}
+
+		if err := os.RemoveAll(targetPath); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", targetPath, err)
+		}
+		logrus.Debugf("Deleted: %s", scanner.Text())
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read deletions: %w", err)
+	}
+
+	return nil
+}
+
+// scanNul is a bufio.SplitFunc splitting on NUL bytes
+func scanNul(data []byte, atEOF bool) (int, []byte, error) {
+	for i, b := range data {
+		if b == 0 {
+			return i + 1, data[:i], nil
+		}
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
@@ -0,0 +1,152 @@
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/volcie/stash/internal/config"
+)
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateArchiveSnapshotSkipsUnreadableFiles(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read files without permissions")
+	}
+
+	source := t.TempDir()
+	writeTestFile(t, filepath.Join(source, "readable"), "content")
+	writeTestFile(t, filepath.Join(source, "unreadable"), "secret")
+	if err := os.Chmod(filepath.Join(source, "unreadable"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	archiver := NewArchiver(config.CompressionNone, false)
+	archiver.SetRecordSnapshot(true)
+
+	var buf bytes.Buffer
+	stats, err := archiver.CreateArchive(&buf, source, nil)
+	if err != nil {
+		t.Fatalf("CreateArchive() error = %v", err)
+	}
+
+	if _, ok := stats.Snapshot.Files["unreadable"]; ok {
+		t.Error("unreadable file was recorded in the snapshot, the next backup would skip it")
+	}
+	if _, ok := stats.Snapshot.Files["readable"]; !ok {
+		t.Error("readable file is missing from the snapshot")
+	}
+
+	// The archive must stay readable past the skipped file
+	manifest, err := NewArchiver(config.CompressionNone, false).ListArchive(&buf)
+	if err != nil {
+		t.Fatalf("ListArchive() error = %v", err)
+	}
+	for _, entry := range manifest.Files {
+		if entry.Path == "unreadable" {
+			t.Error("unreadable file has an entry in the archive")
+		}
+	}
+}
+
+func TestCreateArchiveIncrementalKeepsUnchangedAndSkippedEntries(t *testing.T) {
+	source := t.TempDir()
+	writeTestFile(t, filepath.Join(source, "unchanged"), "same")
+	writeTestFile(t, filepath.Join(source, "changed"), "old")
+	writeTestFile(t, filepath.Join(source, "deleted"), "gone")
+
+	full := NewArchiver(config.CompressionNone, false)
+	full.SetRecordSnapshot(true)
+	fullStats, err := full.CreateArchive(&bytes.Buffer{}, source, nil)
+	if err != nil {
+		t.Fatalf("CreateArchive() full error = %v", err)
+	}
+
+	writeTestFile(t, filepath.Join(source, "changed"), "new content")
+	if err := os.Remove(filepath.Join(source, "deleted")); err != nil {
+		t.Fatal(err)
+	}
+
+	incremental := NewArchiver(config.CompressionNone, false)
+	incremental.SetBaseSnapshot(fullStats.Snapshot)
+	stats, err := incremental.CreateArchive(&bytes.Buffer{}, source, nil)
+	if err != nil {
+		t.Fatalf("CreateArchive() incremental error = %v", err)
+	}
+
+	for _, name := range []string{"unchanged", "changed"} {
+		if _, ok := stats.Snapshot.Files[name]; !ok {
+			t.Errorf("%s is missing from the incremental snapshot", name)
+		}
+	}
+	if _, ok := stats.Snapshot.Files["deleted"]; ok {
+		t.Error("deleted file is still in the incremental snapshot")
+	}
+	if len(stats.Manifest.Deleted) != 1 || stats.Manifest.Deleted[0] != "deleted" {
+		t.Errorf("Deleted = %v, want [deleted]", stats.Manifest.Deleted)
+	}
+
+	var archived []string
+	for _, entry := range stats.Manifest.Files {
+		if entry.Type == EntryFile {
+			archived = append(archived, entry.Path)
+		}
+	}
+	if len(archived) != 1 || archived[0] != "changed" {
+		t.Errorf("incremental archived %v, want only the changed file", archived)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestCopyContent(t *testing.T) {
+	tests := []struct {
+		name         string
+		content      string
+		size         int64
+		want         string
+		wantComplete bool
+	}{
+		{"unchanged", "content", 7, "content", true},
+		{"empty", "", 0, "", true},
+		{"shrank", "cont", 7, "cont\x00\x00\x00", false},
+		{"emptied", "", 3, "\x00\x00\x00", false},
+		{"grew", "content and more", 7, "content", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			complete, err := copyContent(&buf, strings.NewReader(tt.content), "file", tt.size)
+			if err != nil {
+				t.Fatalf("copyContent() error = %v", err)
+			}
+			if complete != tt.wantComplete {
+				t.Errorf("copyContent() complete = %v, want %v", complete, tt.wantComplete)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("copyContent() wrote %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+
+	if _, err := copyContent(failingWriter{}, strings.NewReader("content"), "file", 7); err == nil {
+		t.Error("copyContent() ignored a failed write")
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !unix
+
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"runtime"
+)
+
+type fileID struct{}
+
+// hardlinkID is not supported on this platform, hardlinked files are stored as separate copies
+func hardlinkID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+// inode is not available on this platform, changes are detected by size, time and mode only
+func inode(info os.FileInfo) uint64 {
+	return 0
+}
+
+func makeSpecialFile(path string, header *tar.Header) error {
+	return fmt.Errorf("special files are not supported on %s", runtime.GOOS)
+}
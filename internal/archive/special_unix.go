@@ -0,0 +1,52 @@
+//go:build unix
+
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileID identifies a file by device and inode so hardlinks can be detected
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// hardlinkID returns the identity of a file that has more than one link
+func hardlinkID(info os.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
+
+// inode returns the inode number of a file, 0 if unknown
+func inode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
+
+// makeSpecialFile creates the FIFO or device node described by header
+func makeSpecialFile(path string, header *tar.Header) error {
+	mode := uint32(header.Mode & 07777)
+	dev := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+
+	switch header.Typeflag {
+	case tar.TypeFifo:
+		return unix.Mkfifo(path, mode)
+	case tar.TypeChar:
+		return mknod(path, mode|unix.S_IFCHR, dev)
+	case tar.TypeBlock:
+		return mknod(path, mode|unix.S_IFBLK, dev)
+	default:
+		return fmt.Errorf("not a special file type: %c", header.Typeflag)
+	}
+}
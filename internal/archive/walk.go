@@ -0,0 +1,142 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrStopWalk can be returned by a WalkFunc to stop reading the archive early
+var ErrStopWalk = errors.New("stop walking the archive")
+
+// WalkFunc is called for every entry of an archive. content reads the data of regular files.
+type WalkFunc func(header *tar.Header, content io.Reader) error
+
+// WalkArchive reads an archive without extracting anything, calling fn for every entry.
+// The deletions entry of incremental archives is skipped. When the archive is read to the end,
+// the stream after the tar footer is consumed as well, so truncated archives and compression
+// or encryption checksum failures are reported.
+func (a *Archiver) WalkArchive(reader io.Reader, fn WalkFunc) error {
+	return a.walkArchive(reader, fn, nil)
+}
+
+// WalkArchiveWithDeletions is WalkArchive, also calling deleted for every path listed by the
+// deletions entry of an incremental archive. deleted can return ErrStopWalk as well.
+func (a *Archiver) WalkArchiveWithDeletions(reader io.Reader, fn WalkFunc, deleted func(path string) error) error {
+	return a.walkArchive(reader, fn, func(content io.Reader) error {
+		return readDeletions(content, deleted)
+	})
+}
+
+// readDeletions calls fn for every path listed in the content of a deletions entry
+func readDeletions(content io.Reader, fn func(path string) error) error {
+	scanner := bufio.NewScanner(content)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	scanner.Split(scanNul)
+
+	for scanner.Scan() {
+		if err := fn(scanner.Text()); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read deletions: %w", err)
+	}
+	return nil
+}
+
+// walkArchive is WalkArchive, passing the deletions entry of incremental archives to deletions if not nil
+func (a *Archiver) walkArchive(reader io.Reader, fn WalkFunc, deletions func(io.Reader) error) error {
+	reader, err := a.decryptReader(reader)
+	if err != nil {
+		return err
+	}
+
+	finalReader, decompressCloser, err := decompressReader(reader)
+	if err != nil {
+		return err
+	}
+	if decompressCloser != nil {
+		defer decompressCloser.Close()
+	}
+
+	tarReader := tar.NewReader(finalReader)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar header: %w", err)
+		}
+
+		if isDeletions(header) {
+			if deletions != nil {
+				if err := deletions(tarReader); err != nil {
+					if errors.Is(err, ErrStopWalk) {
+						return nil
+					}
+					return err
+				}
+			}
+			continue
+		}
+
+		if err := fn(header, tarReader); err != nil {
+			if errors.Is(err, ErrStopWalk) {
+				return nil
+			}
+			return err
+		}
+	}
+
+	if _, err := io.Copy(io.Discard, finalReader); err != nil {
+		return fmt.Errorf("failed to read end of archive: %w", err)
+	}
+
+	return nil
+}
+
+// ListArchive reads the headers of every entry of an archive into a manifest, along with the paths
+// deleted by incremental archives. Used for backups that have no manifest, checksums are left empty
+// since file contents are skipped.
+func (a *Archiver) ListArchive(reader io.Reader) (*Manifest, error) {
+	return a.listArchive(reader, false)
+}
+
+// ChecksumArchive is ListArchive reading file contents as well, so regular files get their
+// checksum like in the manifest written by CreateArchive
+func (a *Archiver) ChecksumArchive(reader io.Reader) (*Manifest, error) {
+	return a.listArchive(reader, true)
+}
+
+func (a *Archiver) listArchive(reader io.Reader, checksums bool) (*Manifest, error) {
+	manifest := &Manifest{Version: manifestVersion, Files: []ManifestEntry{}}
+
+	err := a.walkArchive(reader, func(header *tar.Header, content io.Reader) error {
+		entry := newManifestEntry(header)
+		if checksums && header.Typeflag == tar.TypeReg {
+			hash := sha256.New()
+			if _, err := io.Copy(hash, content); err != nil {
+				return fmt.Errorf("failed to read %s: %w", header.Name, err)
+			}
+			entry.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		}
+		manifest.Files = append(manifest.Files, entry)
+		return nil
+	}, func(content io.Reader) error {
+		return readDeletions(content, func(path string) error {
+			manifest.Deleted = append(manifest.Deleted, path)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
@@ -0,0 +1,53 @@
+package archive
+
+import (
+	"archive/tar"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// xattrRecordPrefix is the PAX record prefix for extended attributes, as written by GNU tar and star
+const xattrRecordPrefix = "SCHILY.xattr."
+
+// addXattrs stores the extended attributes of path (including POSIX ACLs) in the header
+func (a *Archiver) addXattrs(path string, header *tar.Header) {
+	xattrs, err := readXattrs(path)
+	if err != nil {
+		logrus.Warnf("Failed to read extended attributes of %s: %v", path, err)
+		return
+	}
+
+	if len(xattrs) == 0 {
+		return
+	}
+
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+	for name, value := range xattrs {
+		header.PAXRecords[xattrRecordPrefix+name] = string(value)
+	}
+
+	logrus.Debugf("Stored %d extended attributes for %s", len(xattrs), header.Name)
+}
+
+// restoreXattrs applies the extended attributes recorded in the header to an extracted path.
+// Failures are logged and don't stop the extraction.
+func (a *Archiver) restoreXattrs(path string, header *tar.Header) {
+	for key, value := range header.PAXRecords {
+		name, ok := strings.CutPrefix(key, xattrRecordPrefix)
+		if !ok {
+			continue
+		}
+
+		if !nativeXattrs {
+			logrus.Debugf("Extended attributes not supported on this platform, skipping %s for %s", name, path)
+			continue
+		}
+
+		if err := writeXattr(path, name, []byte(value)); err != nil {
+			logrus.Warnf("Failed to restore extended attribute %s for %s: %v", name, path, err)
+		}
+	}
+}
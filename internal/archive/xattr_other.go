@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+
+package archive
+
+import "errors"
+
+// nativeXattrs is false where ACLs are captured with platform tools instead (see getFileACL)
+const nativeXattrs = false
+
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func writeXattr(path, name string, value []byte) error {
+	return errors.New("extended attributes are not supported on this platform")
+}
@@ -0,0 +1,106 @@
+//go:build linux || darwin
+
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// nativeXattrs reports whether extended attributes (and the POSIX ACLs stored in them)
+// are read and written directly on this platform
+const nativeXattrs = true
+
+// archivedXattr reports whether an extended attribute is kept in archives. On Linux that is
+// user attributes and POSIX ACLs; macOS has no namespaces, so everything is kept.
+func archivedXattr(name string) bool {
+	if runtime.GOOS != "linux" {
+		return true
+	}
+	return strings.HasPrefix(name, "user.") ||
+		name == "system.posix_acl_access" ||
+		name == "system.posix_acl_default"
+}
+
+// readXattrs returns the archived extended attributes of path, without following symlinks
+func readXattrs(path string) (map[string][]byte, error) {
+	names, err := listXattrNames(path)
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range names {
+		if !archivedXattr(name) {
+			continue
+		}
+
+		value, err := getXattr(path, name)
+		if err != nil {
+			// Usually removed since it was listed, the rest are still worth keeping
+			logrus.Debugf("Failed to read xattr %s of %s: %v", name, path, err)
+			continue
+		}
+		xattrs[name] = value
+	}
+
+	return xattrs, nil
+}
+
+// writeXattr sets an extended attribute on path, without following symlinks
+func writeXattr(path, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
+
+func listXattrNames(path string) ([]string, error) {
+	for {
+		size, err := unix.Llistxattr(path, nil)
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil // Filesystem without xattr support
+		}
+		if err != nil || size == 0 {
+			return nil, err
+		}
+
+		buf := make([]byte, size)
+		size, err = unix.Llistxattr(path, buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue // Grew between the two calls
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var names []string
+		for _, name := range bytes.Split(buf[:size], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size)
+		size, err = unix.Lgetxattr(path, name, buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	}
+}
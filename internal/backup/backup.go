@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"time"
 
+	"filippo.io/age"
 	"github.com/schollz/progressbar/v3"
 	"github.com/sirupsen/logrus"
 	"github.com/volcie/stash/internal/archive"
@@ -17,44 +19,69 @@ import (
 )
 
 type Service struct {
-	cfg      *config.Config
-	s3Client *storage.S3Client
-	notifier *notifications.DiscordNotifier
+	cfg          *config.Config
+	destinations []*storage.Destination
+	localStore   *storage.LocalClient
+	recipients   []age.Recipient
+	notifier     *notifications.DiscordNotifier
 }
 
 type BackupResult struct {
 	Service     string
 	Path        string
-	BackupInfo  *storage.BackupInfo
+	Kind        string              // full, incremental or differential
+	BackupInfo  *storage.BackupInfo // upload to the first successful destination
+	Uploads     []*UploadResult
+	LocalCopy   *storage.BackupInfo
 	ArchiveSize int64
 	Duration    time.Duration
 	Error       error
 }
 
-func NewService(cfg *config.Config, noNotify bool) (*Service, error) {
-	// Create S3 client with multipart upload settings from config
-	var s3Client *storage.S3Client
-	var err error
+// UploadResult is the outcome of uploading an archive to a single destination
+type UploadResult struct {
+	Destination string
+	BackupInfo  *storage.BackupInfo
+	Error       error
+}
 
-	// Use config values if set, otherwise use defaults (100MB threshold, 10MB part size, 10 concurrency)
-	threshold := cfg.S3.MultipartThreshold
-	if threshold == 0 {
-		threshold = 100 * 1024 * 1024 // 100MB default
+// FailedUploads returns the uploads that did not succeed
+func (r *BackupResult) FailedUploads() []*UploadResult {
+	var failed []*UploadResult
+	for _, upload := range r.Uploads {
+		if upload.Error != nil {
+			failed = append(failed, upload)
+		}
 	}
+	return failed
+}
 
-	partSize := cfg.S3.MultipartPartSize
-	if partSize == 0 {
-		partSize = 10 * 1024 * 1024 // 10MB default
+func NewService(cfg *config.Config, noNotify bool) (*Service, error) {
+	destinations, err := storage.NewDestinations(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage backend: %w", err)
 	}
 
-	concurrency := cfg.S3.MultipartConcurrency
-	if concurrency == 0 {
-		concurrency = 10 // default
+	var localStore *storage.LocalClient
+	if cfg.Backup.KeepLocal {
+		localDir := cfg.Backup.LocalArchiveDir()
+		if err := os.MkdirAll(localDir, 0755); err != nil {
+			storage.CloseDestinations(destinations)
+			return nil, fmt.Errorf("failed to create local archive directory: %w", err)
+		}
+
+		localStore, err = storage.NewLocalClient(localDir, "")
+		if err != nil {
+			storage.CloseDestinations(destinations)
+			return nil, fmt.Errorf("failed to open local archive directory: %w", err)
+		}
 	}
 
-	s3Client, err = storage.NewS3ClientWithMultipart(cfg.S3.Bucket, cfg.S3.Prefix, threshold, partSize, concurrency)
+	// Load encryption keys up front so a bad key fails before anything is archived
+	recipients, err := archive.LoadRecipients(cfg.Backup.Encryption)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+		storage.CloseDestinations(destinations)
+		return nil, fmt.Errorf("failed to load encryption settings: %w", err)
 	}
 
 	var notifier *notifications.DiscordNotifier
@@ -68,12 +95,19 @@ func NewService(cfg *config.Config, noNotify bool) (*Service, error) {
 	}
 
 	return &Service{
-		cfg:      cfg,
-		s3Client: s3Client,
-		notifier: notifier,
+		cfg:          cfg,
+		destinations: destinations,
+		localStore:   localStore,
+		recipients:   recipients,
+		notifier:     notifier,
 	}, nil
 }
 
+// Close releases the connections to the backup destinations
+func (s *Service) Close() {
+	storage.CloseDestinations(s.destinations)
+}
+
 func (s *Service) BackupService(ctx context.Context, serviceName string, specificPaths []string) ([]*BackupResult, error) {
 	serviceConfig, exists := s.cfg.Services[serviceName]
 	if !exists {
@@ -111,6 +145,8 @@ func (s *Service) BackupService(ctx context.Context, serviceName string, specifi
 		// Send individual notifications for each path
 		if result.Error != nil {
 			s.sendNotification(notifications.Error, serviceName, "backup", result, result.Error)
+		} else if failed := result.FailedUploads(); len(failed) > 0 {
+			s.sendNotification(notifications.Warning, serviceName, "backup", result, fmt.Errorf("upload failed for %d of %d destinations", len(failed), len(result.Uploads)))
 		} else {
 			s.sendNotification(notifications.Success, serviceName, "backup", result, nil)
 		}
@@ -162,27 +198,23 @@ func (s *Service) backupPathWithTimestamp(ctx context.Context, serviceName, path
 		return result
 	}
 
-	// Create temporary file for archive
-	tempDir := s.cfg.Backup.TempDir
-	if tempDir == "" {
-		tempDir = os.TempDir()
-	}
-
-	if err := os.MkdirAll(tempDir, 0755); err != nil {
-		result.Error = fmt.Errorf("failed to create temp directory: %w", err)
-		return result
+	// Create archive with progress bar. Deduplicated backups chunk the plain archive,
+	// chunks are compressed and encrypted on their own.
+	dedupEnabled := s.cfg.Backup.Dedup.Enabled
+	compression := s.cfg.Backup.CompressionFormat()
+	if dedupEnabled {
+		compression = config.CompressionNone
 	}
 
-	tempFile, err := os.CreateTemp(tempDir, fmt.Sprintf("stash-%s-%s-*.tar.gz", serviceName, pathName))
-	if err != nil {
-		result.Error = fmt.Errorf("failed to create temp file: %w", err)
-		return result
+	archiver := archive.NewArchiver(compression, s.cfg.Backup.PreserveACLs)
+	archiver.SetCompressionLevel(s.cfg.Backup.CompressionLevel)
+	archiver.SetExcludes(s.cfg.Services[serviceName].Exclude[pathName])
+	if !dedupEnabled {
+		archiver.SetRecipients(s.recipients)
 	}
-	defer os.Remove(tempFile.Name())
-	defer tempFile.Close()
 
-	// Create archive with progress bar
-	archiver := archive.NewArchiver(s.cfg.Backup.Compression, s.cfg.Backup.PreserveACLs)
+	// Incremental and differential backups only archive what changed since a previous snapshot
+	state := s.prepareSnapshot(archiver, result)
 
 	// Count files for progress tracking
 	fileCount, err := archiver.CountFiles(pathLocation, includeFolders)
@@ -207,6 +239,39 @@ func (s *Service) backupPathWithTimestamp(ctx context.Context, serviceName, path
 		}),
 	)
 
+	if dedupEnabled {
+		s.dedupPathWithTimestamp(ctx, result, archiver, progressBar, pathLocation, includeFolders, timestamp)
+		result.Duration = time.Since(startTime)
+		return result
+	}
+
+	// Streaming mode pipes the archive straight into the uploads without a temp file
+	if s.cfg.Backup.Streaming {
+		stats := s.streamPathWithTimestamp(ctx, result, archiver, progressBar, pathLocation, includeFolders, timestamp)
+		s.updateSnapshotState(result, state, stats)
+		result.Duration = time.Since(startTime)
+		return result
+	}
+
+	// Create temporary file for archive
+	tempDir := s.cfg.Backup.TempDir
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		result.Error = fmt.Errorf("failed to create temp directory: %w", err)
+		return result
+	}
+
+	tempFile, err := os.CreateTemp(tempDir, fmt.Sprintf("stash-%s-%s-*%s", serviceName, pathName, archiver.Extension()))
+	if err != nil {
+		result.Error = fmt.Errorf("failed to create temp file: %w", err)
+		return result
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
 	stats, err := archiver.CreateArchiveWithProgress(tempFile, pathLocation, includeFolders, progressBar)
 	if err != nil {
 		result.Error = fmt.Errorf("failed to create archive: %w", err)
@@ -226,22 +291,73 @@ func (s *Service) backupPathWithTimestamp(ctx context.Context, serviceName, path
 
 	result.ArchiveSize = fileInfo.Size()
 
-	// Validate minimum size
-	if s.cfg.Backup.MinSize > 0 && result.ArchiveSize < s.cfg.Backup.MinSize {
+	// Validate minimum size, incremental archives are legitimately small when little changed
+	if s.cfg.Backup.MinSize > 0 && result.Kind == config.BackupModeFull && result.ArchiveSize < s.cfg.Backup.MinSize {
 		result.Error = fmt.Errorf("archive size (%d bytes) is below minimum threshold (%d bytes)", result.ArchiveSize, s.cfg.Backup.MinSize)
 		return result
 	}
 
+	// Upload the same archive to every destination
+	for _, dest := range s.destinations {
+		upload := &UploadResult{Destination: dest.Name}
+		upload.BackupInfo, upload.Error = s.uploadArchive(storage.WithSHA256(ctx, stats.Manifest.ArchiveSHA256), dest, tempFile, result.ArchiveSize, serviceName, pathName, timestamp, s.archiveExtension(result.Kind))
+		if upload.Error == nil {
+			upload.Error = s.verifyUpload(ctx, dest, upload.BackupInfo, stats)
+		}
+		if upload.Error != nil {
+			logrus.Errorf("Upload of %s:%s to destination %s failed: %v", serviceName, pathName, dest.Name, upload.Error)
+		} else if result.BackupInfo == nil {
+			result.BackupInfo = upload.BackupInfo
+		}
+		result.Uploads = append(result.Uploads, upload)
+	}
+
+	if result.BackupInfo == nil {
+		result.Error = fmt.Errorf("failed to upload backup to any destination: %w", result.Uploads[0].Error)
+		return result
+	}
+
+	s.updateSnapshotState(result, state, stats)
+
+	// Keep a copy of the archive on disk for fast restores
+	if s.localStore != nil {
+		localCopy, err := s.keepLocalCopy(ctx, tempFile, serviceName, pathName, timestamp, s.archiveExtension(result.Kind))
+		if err != nil {
+			logrus.Warnf("Failed to keep local copy of %s:%s: %v", serviceName, pathName, err)
+		} else {
+			result.LocalCopy = localCopy
+		}
+	}
+
+	s.uploadManifest(ctx, result, stats, timestamp)
+	if result.LocalCopy != nil {
+		s.pruneLocalCopies(ctx, serviceName, pathName)
+	}
+
+	result.Duration = time.Since(startTime)
+
+	logrus.Infof("Backup completed for %s:%s - %d files, %s uploaded in %v",
+		serviceName, pathName, stats.FilesProcessed, formatBytes(result.ArchiveSize), result.Duration)
+
+	return result
+}
+
+// uploadArchive uploads the archive in tempFile to a single destination with a progress bar
+func (s *Service) uploadArchive(ctx context.Context, dest *storage.Destination, tempFile *os.File, archiveSize int64, serviceName, pathName, timestamp, ext string) (*storage.BackupInfo, error) {
 	// Seek back to beginning for upload
 	if _, err := tempFile.Seek(0, 0); err != nil {
-		result.Error = fmt.Errorf("failed to seek temp file: %w", err)
-		return result
+		return nil, fmt.Errorf("failed to seek temp file: %w", err)
+	}
+
+	description := fmt.Sprintf("Uploading %s/%s", serviceName, pathName)
+	if len(s.destinations) > 1 {
+		description = fmt.Sprintf("Uploading %s/%s to %s", serviceName, pathName, dest.Name)
 	}
 
-	// Upload to S3 with progress bar
+	// Upload to storage backend with progress bar
 	fmt.Println() // Add line break before progress bar
-	uploadProgressBar := progressbar.NewOptions(int(result.ArchiveSize),
-		progressbar.OptionSetDescription(fmt.Sprintf("Uploading %s/%s to S3", serviceName, pathName)),
+	uploadProgressBar := progressbar.NewOptions(int(archiveSize),
+		progressbar.OptionSetDescription(description),
 		progressbar.OptionSetWidth(40),
 		progressbar.OptionShowBytes(true),
 		progressbar.OptionSetTheme(progressbar.Theme{
@@ -259,7 +375,7 @@ func (s *Service) backupPathWithTimestamp(ctx context.Context, serviceName, path
 		progressBar: uploadProgressBar,
 	}
 
-	backupInfo, err := s.s3Client.UploadWithTimestamp(ctx, progressReader, serviceName, pathName, timestamp)
+	backupInfo, err := dest.Backend.UploadWithTimestamp(ctx, progressReader, serviceName, pathName, timestamp, ext)
 	if err != nil {
 		// If upload with progress tracking fails, try without it
 		logrus.Warnf("Upload with progress tracking failed, retrying without progress: %v", err)
@@ -267,32 +383,114 @@ func (s *Service) backupPathWithTimestamp(ctx context.Context, serviceName, path
 
 		// Reset file position
 		if _, seekErr := tempFile.Seek(0, 0); seekErr != nil {
-			result.Error = fmt.Errorf("failed to seek temp file for retry: %w", seekErr)
-			return result
+			return nil, fmt.Errorf("failed to seek temp file for retry: %w", seekErr)
 		}
 
 		// Try upload without progress wrapper
-		backupInfo, err = s.s3Client.UploadWithTimestamp(ctx, tempFile, serviceName, pathName, timestamp)
+		backupInfo, err = dest.Backend.UploadWithTimestamp(ctx, tempFile, serviceName, pathName, timestamp, ext)
 		if err != nil {
-			result.Error = fmt.Errorf("failed to upload to S3: %w", err)
-			return result
+			return nil, fmt.Errorf("failed to upload backup: %w", err)
 		}
 
 		// Complete progress bar manually since we couldn't track it
-		uploadProgressBar.Set(int(result.ArchiveSize))
+		uploadProgressBar.Set(int(archiveSize))
 	}
 
 	// Finish upload progress bar
 	uploadProgressBar.Finish()
 	fmt.Println() // Add newline after progress bar
 
-	result.BackupInfo = backupInfo
-	result.Duration = time.Since(startTime)
+	return backupInfo, nil
+}
 
-	logrus.Infof("Backup completed for %s:%s - %d files, %s uploaded in %v",
-		serviceName, pathName, stats.FilesProcessed, formatBytes(result.ArchiveSize), result.Duration)
+// verifyUpload confirms the stored backup matches the checksum computed while the archive was written
+func (s *Service) verifyUpload(ctx context.Context, dest *storage.Destination, backupInfo *storage.BackupInfo, stats *archive.ArchiveStats) error {
+	if !s.cfg.Backup.VerifyAfterUpload {
+		return nil
+	}
 
-	return result
+	if err := dest.Backend.VerifyUpload(ctx, backupInfo.Key, stats.Manifest.ArchiveSHA256); err != nil {
+		return fmt.Errorf("upload verification failed: %w", err)
+	}
+
+	logrus.Infof("Verified checksum of %s on %s", backupInfo.Key, dest.Name)
+	return nil
+}
+
+// archiveExtension returns the key extension for a backup of the given kind in the configured compression format
+func (s *Service) archiveExtension(kind string) string {
+	return storage.KeyExtension(kind, archive.Extension(s.cfg.Backup.CompressionFormat()))
+}
+
+// keepLocalCopy stores the uploaded archive in the local archive directory,
+// moving the temp file into place when possible instead of copying it
+func (s *Service) keepLocalCopy(ctx context.Context, tempFile *os.File, serviceName, pathName, timestamp, ext string) (*storage.BackupInfo, error) {
+	localCopy, err := s.localStore.MoveIntoPlace(tempFile.Name(), serviceName, pathName, timestamp, ext)
+	if err != nil {
+		logrus.Debugf("Could not move archive into local directory, copying instead: %v", err)
+
+		if _, err := tempFile.Seek(0, 0); err != nil {
+			return nil, fmt.Errorf("failed to seek temp file: %w", err)
+		}
+
+		localCopy, err = s.localStore.UploadWithTimestamp(ctx, tempFile, serviceName, pathName, timestamp, ext)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	logrus.Infof("Kept local copy of %s:%s at %s", serviceName, pathName, localCopy.Key)
+	return localCopy, nil
+}
+
+// pruneLocalCopies removes local archives for a path beyond the configured local retention count
+func (s *Service) pruneLocalCopies(ctx context.Context, serviceName, pathName string) {
+	keep := s.cfg.Backup.LocalRetention
+	if keep <= 0 {
+		keep = config.DefaultLocalRetention
+	}
+
+	backups, err := s.localStore.List(ctx, serviceName)
+	if err != nil {
+		logrus.Warnf("Failed to list local archives for %s: %v", serviceName, err)
+		return
+	}
+
+	var pathBackups []*storage.BackupInfo
+	for _, backup := range backups {
+		if backup.Path == pathName {
+			pathBackups = append(pathBackups, backup)
+		}
+	}
+
+	if len(pathBackups) <= keep {
+		return
+	}
+
+	// Sort by date (newest first)
+	sort.Slice(pathBackups, func(i, j int) bool {
+		return pathBackups[i].Date.After(pathBackups[j].Date)
+	})
+
+	// Incremental archives are useless without the archives they build on
+	required := storage.ChainDependencies(pathBackups, pathBackups[:keep])
+
+	var keys []string
+	for _, backup := range pathBackups[keep:] {
+		if !required[backup.Key] {
+			keys = append(keys, backup.Key)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	if err := s.localStore.DeleteMultiple(ctx, keys); err != nil {
+		logrus.Warnf("Failed to prune local archives for %s:%s: %v", serviceName, pathName, err)
+		return
+	}
+
+	logrus.Infof("Pruned %d old local archives for %s:%s (keeping %d)", len(keys), serviceName, pathName, keep)
 }
 
 func (s *Service) sendNotification(notifType notifications.NotificationType, serviceName, operation string, result *BackupResult, err error) {
@@ -313,10 +511,25 @@ func (s *Service) sendNotification(notifType notifications.NotificationType, ser
 	}
 
 	if result.BackupInfo != nil {
-		details["S3 Key"] = result.BackupInfo.Key
+		details["Backup Key"] = result.BackupInfo.Key
 		details["Backup Time"] = result.BackupInfo.Date.Format("2006-01-02 15:04:05")
 	}
 
+	if result.LocalCopy != nil {
+		details["Local Copy"] = result.LocalCopy.Key
+	}
+
+	// Per-destination status is only interesting when replicating to several destinations
+	if len(result.Uploads) > 1 {
+		for _, upload := range result.Uploads {
+			status := "OK"
+			if upload.Error != nil {
+				status = fmt.Sprintf("Failed: %v", upload.Error)
+			}
+			details[fmt.Sprintf("Destination %s", upload.Destination)] = status
+		}
+	}
+
 	s.notifier.SendBackupNotification(notifType, serviceName, operation, details, err)
 }
 
@@ -357,6 +570,7 @@ func (s *Service) performAutoCleanup(ctx context.Context, serviceName string, re
 		logrus.Warnf("Failed to initialize cleanup service for auto-cleanup: %v", err)
 		return
 	}
+	defer cleanupService.Close()
 
 	// Run cleanup for this specific service only
 	cleanupOpts := &cleanup.CleanupOptions{
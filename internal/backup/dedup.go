@@ -0,0 +1,120 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/volcie/stash/internal/archive"
+	"github.com/volcie/stash/internal/dedup"
+	"github.com/volcie/stash/internal/storage"
+)
+
+// idKeyPath returns the file the chunk ID key of encrypted repositories is cached in
+func (s *Service) idKeyPath() string {
+	return filepath.Join(s.cfg.Backup.SnapshotStateDir(), "chunk-id.key")
+}
+
+// dedupPathWithTimestamp archives pathLocation into the deduplicated repository of every destination:
+// the plain archive stream is split into chunks, only chunks a destination doesn't have yet are
+// uploaded (compressed and encrypted one by one), and a snapshot listing the chunks is stored last.
+func (s *Service) dedupPathWithTimestamp(ctx context.Context, result *BackupResult, archiver *archive.Archiver, progressBar *progressbar.ProgressBar, pathLocation string, includeFolders []string, timestamp string) {
+	serviceName, pathName := result.Service, result.Path
+
+	blobs := archive.NewArchiver(s.cfg.Backup.CompressionFormat(), false)
+	blobs.SetCompressionLevel(s.cfg.Backup.CompressionLevel)
+	blobs.SetRecipients(s.recipients)
+
+	// Recovering the chunk ID key from a repository when its cached copy is lost needs the identities
+	identities, err := archive.LoadIdentities(s.cfg.Backup.Encryption)
+	if err != nil {
+		logrus.Warnf("Chunk ID key can't be recovered from the repositories: %v", err)
+	}
+	blobs.SetIdentities(identities)
+
+	var repos []*dedup.Repository
+	var repoDestinations []*storage.Destination
+	for _, dest := range s.destinations {
+		repo := dedup.NewRepository(dest.Backend, blobs)
+
+		// Held until the snapshot is stored, so cleanup can't collect the chunks the index lists
+		lock, err := repo.LockBackup(ctx)
+		if err == nil {
+			defer lock.Release()
+			err = repo.LoadIndex(ctx)
+		}
+		if err != nil {
+			logrus.Errorf("Upload of %s:%s to destination %s failed: %v", serviceName, pathName, dest.Name, err)
+			result.Uploads = append(result.Uploads, &UploadResult{Destination: dest.Name, Error: err})
+			continue
+		}
+		repos = append(repos, repo)
+		repoDestinations = append(repoDestinations, dest)
+	}
+
+	if len(repos) == 0 {
+		result.Error = fmt.Errorf("failed to upload backup to any destination: %w", result.Uploads[0].Error)
+		return
+	}
+
+	// Unencrypted chunks are named by their plain SHA-256, their content is readable anyway
+	var idKey []byte
+	if len(s.recipients) > 0 {
+		idKey, err = dedup.LoadIDKey(ctx, repos, s.idKeyPath())
+		if err != nil {
+			result.Error = fmt.Errorf("failed to load chunk ID key: %w", err)
+			return
+		}
+	}
+
+	writer := dedup.NewWriter(ctx, repos, blobs, idKey, s.cfg.Backup.Dedup.AverageChunkSize())
+
+	stats, err := archiver.CreateArchiveWithProgress(writer, pathLocation, includeFolders, progressBar)
+	if err == nil {
+		err = writer.Close()
+	}
+
+	progressBar.Finish()
+	fmt.Print("\n") // Add newline after progress bar
+
+	if err != nil {
+		result.Error = fmt.Errorf("failed to create archive: %w", err)
+		return
+	}
+
+	result.ArchiveSize = writer.Size()
+
+	// Nothing references the chunks stored so far, cleanup collects them
+	if s.cfg.Backup.MinSize > 0 && result.ArchiveSize < s.cfg.Backup.MinSize {
+		result.Error = fmt.Errorf("archive size (%d bytes) is below minimum threshold (%d bytes)", result.ArchiveSize, s.cfg.Backup.MinSize)
+		return
+	}
+
+	manifest := writer.Manifest(serviceName, pathName, timestamp, stats.FilesProcessed)
+	for i, repo := range repos {
+		upload := &UploadResult{Destination: repoDestinations[i].Name, Error: writer.Err(i)}
+		if upload.Error == nil {
+			upload.BackupInfo, upload.Error = repo.SaveSnapshot(ctx, manifest)
+		}
+
+		if upload.Error != nil {
+			logrus.Errorf("Upload of %s:%s to destination %s failed: %v", serviceName, pathName, upload.Destination, upload.Error)
+		} else if result.BackupInfo == nil {
+			result.BackupInfo = upload.BackupInfo
+		}
+		result.Uploads = append(result.Uploads, upload)
+	}
+
+	if result.BackupInfo == nil {
+		result.Error = fmt.Errorf("failed to upload backup to any destination: %w", result.Uploads[0].Error)
+		return
+	}
+
+	s.uploadManifest(ctx, result, stats, timestamp)
+
+	newChunks, uploaded := writer.Stats()
+	logrus.Infof("Backup stored for %s:%s - %d files, %s in %d chunks, %d new (%s uploaded)",
+		serviceName, pathName, stats.FilesProcessed, formatBytes(result.ArchiveSize), len(manifest.Chunks), newChunks, formatBytes(uploaded))
+}
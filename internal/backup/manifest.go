@@ -0,0 +1,51 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"github.com/volcie/stash/internal/archive"
+	"github.com/volcie/stash/internal/storage"
+)
+
+// uploadManifest stores the manifest of a backup next to it on every destination it was uploaded to,
+// and next to the local copy. The backup itself is complete without it, so failures are only logged.
+func (s *Service) uploadManifest(ctx context.Context, result *BackupResult, stats *archive.ArchiveStats, timestamp string) {
+	manifest := stats.Manifest
+	manifest.Service = result.Service
+	manifest.Path = result.Path
+	manifest.Timestamp = timestamp
+	manifest.Kind = result.Kind
+
+	// Manifests list file names, so they are encrypted like the archives
+	writer := archive.NewArchiver(s.cfg.Backup.CompressionFormat(), false)
+	writer.SetRecipients(s.recipients)
+
+	var buffer bytes.Buffer
+	if err := writer.WriteManifest(&buffer, manifest); err != nil {
+		logrus.Warnf("Failed to create manifest for %s:%s: %v", result.Service, result.Path, err)
+		return
+	}
+
+	ext := storage.KeyExtension(result.Kind, storage.ManifestExtension)
+	store := func(name string, backend storage.Backend) {
+		if _, err := backend.UploadWithTimestamp(ctx, bytes.NewReader(buffer.Bytes()), result.Service, result.Path, timestamp, ext); err != nil {
+			logrus.Warnf("Failed to upload manifest of %s:%s to %s: %v", result.Service, result.Path, name, err)
+		}
+	}
+
+	for _, dest := range s.destinations {
+		for _, upload := range result.Uploads {
+			if upload.Destination == dest.Name && upload.Error == nil {
+				store(dest.Name, dest.Backend)
+			}
+		}
+	}
+
+	if result.LocalCopy != nil {
+		store("local copy", s.localStore)
+	}
+
+	logrus.Debugf("Stored manifest of %s:%s with %d entries", result.Service, result.Path, len(manifest.Files))
+}
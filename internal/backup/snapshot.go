@@ -0,0 +1,148 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/volcie/stash/internal/archive"
+	"github.com/volcie/stash/internal/config"
+)
+
+// snapshotState is kept between runs for every path backed up in incremental or differential mode
+type snapshotState struct {
+	LastFull     time.Time         `json:"last_full"`
+	FullSnapshot *archive.Snapshot `json:"full_snapshot"` // base of differential backups
+	LastSnapshot *archive.Snapshot `json:"last_snapshot"` // base of incremental backups
+}
+
+// statePath returns the snapshot state file of a service path
+func (s *Service) statePath(serviceName, pathName string) string {
+	return filepath.Join(s.cfg.Backup.SnapshotStateDir(), serviceName, pathName+".json")
+}
+
+func loadSnapshotState(path string) (*snapshotState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read snapshot state: %w", err)
+	}
+
+	var state snapshotState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot state %s: %w", path, err)
+	}
+
+	return &state, nil
+}
+
+func saveSnapshotState(path string, state *snapshotState) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create snapshot state directory: %w", err)
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot state: %w", err)
+	}
+
+	// Write to a temp file first so an interrupted write never leaves a truncated state behind
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write snapshot state: %w", err)
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to move snapshot state into place: %w", err)
+	}
+
+	return nil
+}
+
+// prepareSnapshot decides whether this backup is full, incremental or differential, sets
+// result.Kind and configures the archiver accordingly. Returns the previous snapshot state.
+func (s *Service) prepareSnapshot(archiver *archive.Archiver, result *BackupResult) *snapshotState {
+	result.Kind = config.BackupModeFull
+
+	mode := s.cfg.Backup.BackupMode()
+	if mode == config.BackupModeFull {
+		return nil
+	}
+
+	archiver.SetRecordSnapshot(true)
+
+	state, err := loadSnapshotState(s.statePath(result.Service, result.Path))
+	if err != nil {
+		logrus.Warnf("Ignoring snapshot state of %s:%s, taking a full backup: %v", result.Service, result.Path, err)
+		return nil
+	}
+	if state == nil || state.FullSnapshot == nil || state.LastSnapshot == nil {
+		logrus.Infof("No previous snapshot of %s:%s, taking a full backup", result.Service, result.Path)
+		return nil
+	}
+
+	interval := s.cfg.Backup.FullInterval
+	if interval == 0 {
+		interval = config.DefaultFullInterval
+	}
+	if time.Since(state.LastFull) >= time.Duration(interval)*24*time.Hour {
+		logrus.Infof("Last full backup of %s:%s is older than %d days, taking a full backup", result.Service, result.Path, interval)
+		return state
+	}
+
+	result.Kind = mode
+	if mode == config.BackupModeDifferential {
+		archiver.SetBaseSnapshot(state.FullSnapshot)
+	} else {
+		archiver.SetBaseSnapshot(state.LastSnapshot)
+	}
+
+	logrus.Infof("Taking %s backup of %s:%s", mode, result.Service, result.Path)
+	return state
+}
+
+// updateSnapshotState records the snapshot of a finished backup as the base of the next one.
+// If only some destinations received the backup, the state is dropped so the next backup is
+// full again instead of building on a backup that is missing from some destinations.
+func (s *Service) updateSnapshotState(result *BackupResult, state *snapshotState, stats *archive.ArchiveStats) {
+	statePath := s.statePath(result.Service, result.Path)
+
+	if s.cfg.Backup.BackupMode() == config.BackupModeFull {
+		// Switching back to incremental later must start from a new full backup
+		if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+			logrus.Warnf("Failed to remove snapshot state %s: %v", statePath, err)
+		}
+		return
+	}
+
+	if result.BackupInfo == nil || stats == nil || stats.Snapshot == nil {
+		return
+	}
+
+	if len(result.FailedUploads()) > 0 {
+		logrus.Warnf("Backup of %s:%s is missing from some destinations, the next backup will be full", result.Service, result.Path)
+		if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+			logrus.Warnf("Failed to remove snapshot state %s: %v", statePath, err)
+		}
+		return
+	}
+
+	if result.Kind == config.BackupModeFull || state == nil {
+		state = &snapshotState{
+			LastFull:     time.Now(),
+			FullSnapshot: stats.Snapshot,
+		}
+	}
+	state.LastSnapshot = stats.Snapshot
+
+	if err := saveSnapshotState(statePath, state); err != nil {
+		logrus.Warnf("Failed to save snapshot state of %s:%s, the next backup will be full: %v", result.Service, result.Path, err)
+		os.Remove(statePath)
+	}
+}
@@ -0,0 +1,186 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/volcie/stash/internal/archive"
+	"github.com/volcie/stash/internal/config"
+	"github.com/volcie/stash/internal/storage"
+)
+
+// streamSink is one consumer of a streamed archive: a destination upload or the local copy
+type streamSink struct {
+	name   string
+	dest   *storage.Destination // nil for the local copy
+	writer *io.PipeWriter
+	info   *storage.BackupInfo
+	err    error
+}
+
+// streamPathWithTimestamp archives pathLocation directly into every destination through pipes,
+// so the archive never touches the disk. Size and min_size checks happen as the archive is written;
+// an archive below min_size aborts the uploads before they are committed.
+// Returns the archive stats, nil if the archive could not be created.
+func (s *Service) streamPathWithTimestamp(ctx context.Context, result *BackupResult, archiver *archive.Archiver, progressBar *progressbar.ProgressBar, pathLocation string, includeFolders []string, timestamp string) *archive.ArchiveStats {
+	serviceName, pathName := result.Service, result.Path
+	ext := storage.KeyExtension(result.Kind, archiver.Extension())
+
+	var sinks []*streamSink
+	var wg sync.WaitGroup
+
+	startSink := func(name string, backend storage.Backend) *streamSink {
+		pipeReader, pipeWriter := io.Pipe()
+		sink := &streamSink{name: name, writer: pipeWriter}
+		sinks = append(sinks, sink)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sink.info, sink.err = backend.UploadWithTimestamp(ctx, pipeReader, serviceName, pathName, timestamp, ext)
+			if sink.err != nil {
+				// Unblock the archive writer, it will stop feeding this sink
+				pipeReader.CloseWithError(sink.err)
+			} else {
+				pipeReader.Close()
+			}
+		}()
+
+		return sink
+	}
+
+	for _, dest := range s.destinations {
+		startSink(dest.Name, dest.Backend).dest = dest
+	}
+
+	var localSink *streamSink
+	if s.localStore != nil {
+		localSink = startSink("local", s.localStore)
+	}
+
+	writer := newFanoutWriter(sinks)
+
+	logrus.Infof("Streaming %s:%s to %d destinations", serviceName, pathName, len(s.destinations))
+
+	stats, archiveErr := archiver.CreateArchiveWithProgress(writer, pathLocation, includeFolders, progressBar)
+
+	progressBar.Finish()
+	fmt.Print("\n") // Add newline after progress bar
+
+	result.ArchiveSize = writer.written
+
+	// Check the minimum size before letting the uploads complete. Only full archives are checked,
+	// incremental ones are legitimately small when little changed.
+	if archiveErr == nil && s.cfg.Backup.MinSize > 0 && result.Kind == config.BackupModeFull && result.ArchiveSize < s.cfg.Backup.MinSize {
+		archiveErr = fmt.Errorf("archive size (%d bytes) is below minimum threshold (%d bytes)", result.ArchiveSize, s.cfg.Backup.MinSize)
+	}
+
+	// Closing with an error aborts the uploads so nothing partial is stored
+	for _, sink := range sinks {
+		if archiveErr != nil {
+			sink.writer.CloseWithError(archiveErr)
+		} else {
+			sink.writer.Close()
+		}
+	}
+
+	wg.Wait()
+
+	if archiveErr != nil {
+		result.Error = archiveErr
+		if stats == nil {
+			result.Error = fmt.Errorf("failed to create archive: %w", archiveErr)
+		}
+		return nil
+	}
+
+	for _, sink := range sinks {
+		if sink.dest == nil {
+			continue
+		}
+
+		upload := &UploadResult{Destination: sink.name, BackupInfo: sink.info, Error: sink.err}
+		if upload.Error == nil {
+			upload.Error = s.verifyUpload(ctx, sink.dest, upload.BackupInfo, stats)
+		}
+		if upload.Error != nil {
+			logrus.Errorf("Upload of %s:%s to destination %s failed: %v", serviceName, pathName, sink.name, upload.Error)
+		} else if result.BackupInfo == nil {
+			result.BackupInfo = upload.BackupInfo
+		}
+		result.Uploads = append(result.Uploads, upload)
+	}
+
+	if result.BackupInfo == nil {
+		result.Error = fmt.Errorf("failed to upload backup to any destination: %w", result.Uploads[0].Error)
+		return stats
+	}
+
+	if localSink != nil {
+		if localSink.err != nil {
+			logrus.Warnf("Failed to keep local copy of %s:%s: %v", serviceName, pathName, localSink.err)
+		} else {
+			result.LocalCopy = localSink.info
+		}
+	}
+
+	s.uploadManifest(ctx, result, stats, timestamp)
+	if result.LocalCopy != nil {
+		s.pruneLocalCopies(ctx, serviceName, pathName)
+	}
+
+	logrus.Infof("Backup streamed for %s:%s - %d files, %s uploaded",
+		serviceName, pathName, stats.FilesProcessed, formatBytes(result.ArchiveSize))
+
+	return stats
+}
+
+// fanoutWriter copies the archive to every sink and counts the bytes written.
+// A sink whose upload failed is skipped from then on; writing only fails once every sink has failed.
+type fanoutWriter struct {
+	sinks   []*streamSink
+	failed  []error
+	written int64
+}
+
+func newFanoutWriter(sinks []*streamSink) *fanoutWriter {
+	return &fanoutWriter{
+		sinks:  sinks,
+		failed: make([]error, len(sinks)),
+	}
+}
+
+func (fw *fanoutWriter) Write(p []byte) (int, error) {
+	var firstErr error
+	alive := 0
+
+	for i, sink := range fw.sinks {
+		if fw.failed[i] != nil {
+			if firstErr == nil {
+				firstErr = fw.failed[i]
+			}
+			continue
+		}
+
+		if _, err := sink.writer.Write(p); err != nil {
+			logrus.Debugf("Stream to %s stopped: %v", sink.name, err)
+			fw.failed[i] = err
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		alive++
+	}
+
+	if alive == 0 {
+		return 0, fmt.Errorf("all uploads failed: %w", firstErr)
+	}
+
+	fw.written += int64(len(p))
+	return len(p), nil
+}
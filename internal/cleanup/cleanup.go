@@ -2,20 +2,24 @@ package cleanup
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sort"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/volcie/stash/internal/archive"
 	"github.com/volcie/stash/internal/config"
+	"github.com/volcie/stash/internal/dedup"
 	"github.com/volcie/stash/internal/notifications"
 	"github.com/volcie/stash/internal/storage"
 )
 
 type Service struct {
-	cfg      *config.Config
-	s3Client *storage.S3Client
-	notifier *notifications.DiscordNotifier
+	cfg          *config.Config
+	destinations []*storage.Destination
+	blobs        *archive.Archiver // decrypts the snapshots of deduplicated repositories
+	notifier     *notifications.DiscordNotifier
 }
 
 type CleanupOptions struct {
@@ -27,16 +31,27 @@ type CleanupOptions struct {
 
 type CleanupResult struct {
 	DeletedBackups []*storage.BackupInfo
+	DeletedChunks  int // unreferenced chunks of deduplicated backups
 	TotalSize      int64
 	Error          error
 }
 
 func NewService(cfg *config.Config, noNotify bool) (*Service, error) {
-	s3Client, err := storage.NewS3Client(cfg.S3.Bucket, cfg.S3.Prefix)
+	destinations, err := storage.NewDestinations(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+		return nil, fmt.Errorf("failed to create storage backend: %w", err)
 	}
 
+	// Snapshots are encrypted, collecting chunks needs to read which ones they reference
+	identities, err := archive.LoadIdentities(cfg.Backup.Encryption)
+	if err != nil {
+		storage.CloseDestinations(destinations)
+		return nil, fmt.Errorf("failed to load decryption keys: %w", err)
+	}
+
+	blobs := archive.NewArchiver(cfg.Backup.CompressionFormat(), false)
+	blobs.SetIdentities(identities)
+
 	var notifier *notifications.DiscordNotifier
 	if !noNotify && cfg.Notifications.DiscordWebhook != "" {
 		notifier = notifications.NewDiscordNotifier(
@@ -48,12 +63,18 @@ func NewService(cfg *config.Config, noNotify bool) (*Service, error) {
 	}
 
 	return &Service{
-		cfg:      cfg,
-		s3Client: s3Client,
-		notifier: notifier,
+		cfg:          cfg,
+		destinations: destinations,
+		blobs:        blobs,
+		notifier:     notifier,
 	}, nil
 }
 
+// Close releases the connections to the backup destinations
+func (s *Service) Close() {
+	storage.CloseDestinations(s.destinations)
+}
+
 func (s *Service) CleanupBackups(ctx context.Context, opts *CleanupOptions) (*CleanupResult, error) {
 	result := &CleanupResult{}
 
@@ -85,56 +106,42 @@ func (s *Service) CleanupBackups(ctx context.Context, opts *CleanupOptions) (*Cl
 
 	var allDeletedBackups []*storage.BackupInfo
 	var totalSize int64
+	deletedKeys := make(map[string]map[string]bool)
 
 	for _, serviceName := range servicesToClean {
-		logrus.Infof("Cleaning up service: %s", serviceName)
-
-		backups, err := s.s3Client.List(ctx, serviceName)
-		if err != nil {
-			logrus.Errorf("Failed to list backups for service %s: %v", serviceName, err)
-			continue
-		}
-
-		toDelete := s.selectBackupsForDeletion(backups, olderThan, opts.KeepLatest)
-		if len(toDelete) == 0 {
-			logrus.Infof("No backups to delete for service %s", serviceName)
-			continue
-		}
-
-		logrus.Infof("Found %d backups to delete for service %s", len(toDelete), serviceName)
-
-		if opts.DryRun {
-			logrus.Info("DRY RUN: Would delete the following backups:")
-			for _, backup := range toDelete {
-				logrus.Infof("  - %s (%s, %s)", backup.Key, backup.Date.Format("2006-01-02 15:04:05"), formatBytes(backup.Size))
-				totalSize += backup.Size
+		// Apply retention to every destination so replicas don't grow forever
+		for _, dest := range s.destinations {
+			deleted, size, err := s.cleanupDestination(ctx, dest, serviceName, olderThan, opts)
+			if err != nil {
+				result.Error = err
 			}
-			allDeletedBackups = append(allDeletedBackups, toDelete...)
-			continue
-		}
+			allDeletedBackups = append(allDeletedBackups, deleted...)
+			totalSize += size
 
-		// Delete backups
-		keys := make([]string, len(toDelete))
-		for i, backup := range toDelete {
-			keys[i] = backup.Key
-			totalSize += backup.Size
+			if deletedKeys[dest.Name] == nil {
+				deletedKeys[dest.Name] = make(map[string]bool)
+			}
+			for _, backup := range deleted {
+				deletedKeys[dest.Name][backup.Key] = true
+			}
 		}
+	}
 
-		if err := s.s3Client.DeleteMultiple(ctx, keys); err != nil {
-			logrus.Errorf("Failed to delete backups for service %s: %v", serviceName, err)
+	// Chunks are shared by the snapshots of every service, so they are collected once all are cleaned up
+	for _, dest := range s.destinations {
+		chunks, size, err := s.collectChunks(ctx, dest, deletedKeys[dest.Name], opts.DryRun)
+		if err != nil {
 			result.Error = err
-			continue
 		}
-
-		logrus.Infof("Deleted %d backups for service %s (%s freed)", len(toDelete), serviceName, formatBytes(totalSize))
-		allDeletedBackups = append(allDeletedBackups, toDelete...)
+		result.DeletedChunks += chunks
+		totalSize += size
 	}
 
 	result.DeletedBackups = allDeletedBackups
 	result.TotalSize = totalSize
 
 	// Send notification
-	if len(allDeletedBackups) > 0 {
+	if len(allDeletedBackups) > 0 || result.DeletedChunks > 0 {
 		if result.Error != nil {
 			s.sendNotification(notifications.Warning, len(allDeletedBackups), totalSize, result.Error)
 		} else {
@@ -145,6 +152,83 @@ func (s *Service) CleanupBackups(ctx context.Context, opts *CleanupOptions) (*Cl
 	return result, result.Error
 }
 
+func (s *Service) cleanupDestination(ctx context.Context, dest *storage.Destination, serviceName string, olderThan int, opts *CleanupOptions) ([]*storage.BackupInfo, int64, error) {
+	target := serviceName
+	if len(s.destinations) > 1 {
+		target = fmt.Sprintf("%s (destination %s)", serviceName, dest.Name)
+	}
+
+	logrus.Infof("Cleaning up service: %s", target)
+
+	backups, err := dest.Backend.List(ctx, serviceName)
+	if err != nil {
+		logrus.Errorf("Failed to list backups for service %s: %v", target, err)
+		return nil, 0, nil
+	}
+
+	toDelete := s.selectBackupsForDeletion(backups, olderThan, opts.KeepLatest)
+	if len(toDelete) == 0 {
+		logrus.Infof("No backups to delete for service %s", target)
+		return nil, 0, nil
+	}
+
+	logrus.Infof("Found %d backups to delete for service %s", len(toDelete), target)
+
+	var totalSize int64
+
+	if opts.DryRun {
+		logrus.Info("DRY RUN: Would delete the following backups:")
+		for _, backup := range toDelete {
+			logrus.Infof("  - %s (%s, %s)", backup.Key, backup.Date.Format("2006-01-02 15:04:05"), formatBytes(backup.Size))
+			totalSize += backup.Size
+		}
+		return toDelete, totalSize, nil
+	}
+
+	// Delete backups
+	keys := make([]string, len(toDelete))
+	for i, backup := range toDelete {
+		keys[i] = backup.Key
+		totalSize += backup.Size
+	}
+
+	if err := dest.Backend.DeleteMultiple(ctx, keys); err != nil {
+		logrus.Errorf("Failed to delete backups for service %s: %v", target, err)
+		return nil, 0, err
+	}
+
+	logrus.Infof("Deleted %d backups for service %s (%s freed)", len(toDelete), target, formatBytes(totalSize))
+	return toDelete, totalSize, nil
+}
+
+// collectChunks deletes the chunks of deduplicated backups that no snapshot references anymore
+func (s *Service) collectChunks(ctx context.Context, dest *storage.Destination, deleted map[string]bool, dryRun bool) (int, int64, error) {
+	repo := dedup.NewRepository(dest.Backend, s.blobs)
+
+	gc, err := repo.GarbageCollect(ctx, deleted, dryRun)
+	if errors.Is(err, dedup.ErrBackupRunning) {
+		logrus.Warnf("Not collecting chunks in destination %s, the next cleanup will: %v", dest.Name, err)
+		return 0, 0, nil
+	}
+	if err != nil {
+		logrus.Errorf("Failed to collect unreferenced chunks in destination %s: %v", dest.Name, err)
+		return 0, 0, err
+	}
+
+	if gc.Deleted == 0 {
+		return 0, 0, nil
+	}
+
+	if dryRun {
+		logrus.Infof("DRY RUN: Would delete %d unreferenced chunks (%s) from destination %s", gc.Deleted, formatBytes(gc.Size), dest.Name)
+	} else {
+		logrus.Infof("Deleted %d unreferenced chunks (%s) from destination %s, %d chunks still referenced by %d snapshots",
+			gc.Deleted, formatBytes(gc.Size), dest.Name, gc.Referenced, gc.Snapshots)
+	}
+
+	return gc.Deleted, gc.Size, nil
+}
+
 func (s *Service) selectBackupsForDeletion(backups []*storage.BackupInfo, olderThanDays, keepLatest int) []*storage.BackupInfo {
 	if len(backups) == 0 {
 		return nil
@@ -167,23 +251,28 @@ func (s *Service) selectBackupsForDeletion(backups []*storage.BackupInfo, olderT
 			return pathBackups[i].Date.After(pathBackups[j].Date)
 		})
 
-		// Keep the latest N backups regardless of age
-		var candidates []*storage.BackupInfo
-		if keepLatest > 0 && len(pathBackups) > keepLatest {
-			candidates = pathBackups[keepLatest:]
-		} else {
-			candidates = pathBackups
+		// Keep the latest N backups regardless of age, the others expire once older than cutoff date
+		var kept, expired []*storage.BackupInfo
+		for i, backup := range pathBackups {
+			if i >= keepLatest && backup.Date.Before(cutoffDate) {
+				expired = append(expired, backup)
+			} else {
+				kept = append(kept, backup)
+			}
 		}
 
-		// From the candidates, select those older than cutoff date
-		for _, backup := range candidates {
-			if backup.Date.Before(cutoffDate) {
-				toDelete = append(toDelete, backup)
-				logrus.Debugf("Marking for deletion: %s (age: %v)", backup.Key, time.Since(backup.Date))
+		// Backups that kept incremental or differential backups build on are kept as well
+		required := storage.ChainDependencies(pathBackups, kept)
+		for _, backup := range expired {
+			if required[backup.Key] {
+				logrus.Debugf("Keeping %s, newer backups depend on it", backup.Key)
+				continue
 			}
+			toDelete = append(toDelete, backup)
+			logrus.Debugf("Marking for deletion: %s (age: %v)", backup.Key, time.Since(backup.Date))
 		}
 
-		logrus.Debugf("Path %s: %d total, %d candidates, %d to delete", pathKey, len(pathBackups), len(candidates), len(toDelete))
+		logrus.Debugf("Path %s: %d total, %d expired, %d to delete", pathKey, len(pathBackups), len(expired), len(toDelete))
 	}
 
 	// Sort by date (oldest first for deletion)
@@ -2,13 +2,19 @@ package config
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/spf13/viper"
 )
 
 type Config struct {
+	Storage       StorageConfig      `mapstructure:"storage"`
 	S3            S3Config           `mapstructure:"s3"`
+	Local         LocalConfig        `mapstructure:"local"`
+	SFTP          SFTPConfig         `mapstructure:"sftp"`
+	Destinations  []Destination      `mapstructure:"destinations"`
 	Services      map[string]Service `mapstructure:"services"`
 	Retention     int                `mapstructure:"retention"`
 	AutoCleanup   bool               `mapstructure:"auto_cleanup"`
@@ -16,17 +22,53 @@ type Config struct {
 	Backup        BackupConfig       `mapstructure:"backup"`
 }
 
+const (
+	StorageTypeS3    = "s3"
+	StorageTypeLocal = "local"
+	StorageTypeSFTP  = "sftp"
+)
+
+type StorageConfig struct {
+	Type string `mapstructure:"type"` // default s3
+}
+
 type S3Config struct {
-	Bucket             string `mapstructure:"bucket"`
-	Prefix             string `mapstructure:"prefix"`
-	MultipartThreshold int64  `mapstructure:"multipart_threshold"` // in bytes, default 100MB
-	MultipartPartSize  int64  `mapstructure:"multipart_part_size"` // in bytes, default 10MB
-	MultipartConcurrency int  `mapstructure:"multipart_concurrency"` // default 10
+	Bucket               string `mapstructure:"bucket"`
+	Prefix               string `mapstructure:"prefix"`
+	Region               string `mapstructure:"region"`                // optional, overrides AWS_REGION
+	MultipartThreshold   int64  `mapstructure:"multipart_threshold"`   // in bytes, default 100MB
+	MultipartPartSize    int64  `mapstructure:"multipart_part_size"`   // in bytes, default 10MB
+	MultipartConcurrency int    `mapstructure:"multipart_concurrency"` // default 10
+}
+
+type LocalConfig struct {
+	Path   string `mapstructure:"path"`   // directory backups are stored in, must already exist
+	Prefix string `mapstructure:"prefix"` // optional subdirectory inside path
+}
+
+type SFTPConfig struct {
+	Host           string `mapstructure:"host"`
+	Port           int    `mapstructure:"port"` // default 22
+	User           string `mapstructure:"user"`
+	KeyFile        string `mapstructure:"key_file"`         // private key used for authentication
+	KnownHostsFile string `mapstructure:"known_hosts_file"` // default ~/.ssh/known_hosts
+	Path           string `mapstructure:"path"`             // remote directory backups are stored in, must already exist
+	Prefix         string `mapstructure:"prefix"`           // optional subdirectory inside path
+}
+
+// Destination is one storage target every backup is uploaded to
+type Destination struct {
+	Name  string      `mapstructure:"name"`
+	Type  string      `mapstructure:"type"` // default s3
+	S3    S3Config    `mapstructure:"s3"`
+	Local LocalConfig `mapstructure:"local"`
+	SFTP  SFTPConfig  `mapstructure:"sftp"`
 }
 
 type Service struct {
 	Paths          map[string]string   `mapstructure:"paths"`
 	IncludeFolders map[string][]string `mapstructure:"include_folders"`
+	Exclude        map[string][]string `mapstructure:"exclude"` // glob patterns per path, e.g. **/cache/**
 }
 
 type NotificationConfig struct {
@@ -37,10 +79,123 @@ type NotificationConfig struct {
 }
 
 type BackupConfig struct {
-	TempDir      string `mapstructure:"temp_dir"`
-	PreserveACLs bool   `mapstructure:"preserve_acls"`
-	Compression  bool   `mapstructure:"compression"`
-	MinSize      int64  `mapstructure:"min_size"`
+	TempDir           string `mapstructure:"temp_dir"`
+	LocalDir          string `mapstructure:"local_dir"`       // local archive directory, default temp_dir
+	KeepLocal         bool   `mapstructure:"keep_local"`      // keep a copy of each archive in local_dir
+	LocalRetention    int    `mapstructure:"local_retention"` // local archives kept per path, default 3
+	PreserveACLs      bool   `mapstructure:"preserve_acls"`
+	PreserveOwner     bool   `mapstructure:"preserve_owner"`    // restore file owners, only when restoring as root
+	Compression       string `mapstructure:"compression"`       // gzip, zstd, xz or none (true/false still accepted)
+	CompressionLevel  int    `mapstructure:"compression_level"` // 0 uses the format's default level
+	MinSize           int64  `mapstructure:"min_size"`
+	Streaming         bool   `mapstructure:"streaming"`           // pipe archives straight to storage without a temp file
+	Mode              string `mapstructure:"mode"`                // full (default), incremental or differential
+	FullInterval      int    `mapstructure:"full_interval"`       // days between full backups in incremental/differential mode, default 7
+	StateDir          string `mapstructure:"state_dir"`           // snapshot state of the last backups, default $XDG_STATE_HOME/stash
+	VerifyAfterUpload bool   `mapstructure:"verify_after_upload"` // check the stored checksum of every upload against the archive
+
+	Encryption EncryptionConfig `mapstructure:"encryption"`
+	Dedup      DedupConfig      `mapstructure:"dedup"`
+}
+
+// DedupConfig switches backups to a deduplicated repository: the archive is split into
+// content-defined chunks stored once by hash, and each backup is a snapshot listing its chunks.
+type DedupConfig struct {
+	Enabled   bool `mapstructure:"enabled"`
+	ChunkSize int  `mapstructure:"chunk_size"` // average chunk size in bytes, default 1 MiB
+}
+
+// EncryptionConfig controls client-side encryption of archives. Archives are encrypted to
+// the X25519 recipients if any are set, otherwise to the STASH_ENCRYPTION_PASSPHRASE passphrase.
+type EncryptionConfig struct {
+	Enabled      bool     `mapstructure:"enabled"`
+	Recipients   []string `mapstructure:"recipients"`    // age X25519 public keys (age1...)
+	IdentityFile string   `mapstructure:"identity_file"` // private keys used to decrypt on restore
+}
+
+const DefaultLocalRetention = 3
+
+const DefaultFullInterval = 7
+
+const DefaultChunkSize = 1 << 20
+
+// ChunksDir is the directory deduplicated chunks are stored in, below the storage prefix
+const ChunksDir = "chunks"
+
+// LocksDir is the directory of the locks keeping cleanup from collecting chunks a running backup reuses
+const LocksDir = "locks"
+
+// KeysDir is the directory the key naming the chunks of an encrypted repository is stored in
+const KeysDir = "keys"
+
+// AverageChunkSize returns the configured average chunk size of deduplicated backups
+func (d DedupConfig) AverageChunkSize() int {
+	if d.ChunkSize == 0 {
+		return DefaultChunkSize
+	}
+	return d.ChunkSize
+}
+
+const (
+	BackupModeFull         = "full"
+	BackupModeIncremental  = "incremental"
+	BackupModeDifferential = "differential"
+)
+
+// BackupMode returns the configured backup mode, full if not set
+func (b BackupConfig) BackupMode() string {
+	if b.Mode == "" {
+		return BackupModeFull
+	}
+	return strings.ToLower(b.Mode)
+}
+
+// SnapshotStateDir returns the directory the file snapshots used by incremental
+// and differential backups are kept in. The default must survive reboots and temp
+// directory cleanups: $XDG_STATE_HOME/stash, or stash/state in the user config directory.
+func (b BackupConfig) SnapshotStateDir() string {
+	if b.StateDir != "" {
+		return b.StateDir
+	}
+	if stateHome := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(stateHome) {
+		return filepath.Join(stateHome, "stash")
+	}
+	if configDir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(configDir, "stash", "state")
+	}
+	return filepath.Join(b.LocalArchiveDir(), ".state")
+}
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionXz   = "xz"
+)
+
+// CompressionFormat returns the configured compression format. Older configs set
+// compression to a boolean, which maps to gzip or none.
+func (b BackupConfig) CompressionFormat() string {
+	switch format := strings.ToLower(strings.TrimSpace(b.Compression)); format {
+	case "true", "1":
+		return CompressionGzip
+	case "", "false", "0":
+		return CompressionNone
+	default:
+		return format
+	}
+}
+
+// LocalArchiveDir returns the directory local archives are kept in,
+// laid out as service/path/timestamp.tar.gz (or the extension of the archive format)
+func (b BackupConfig) LocalArchiveDir() string {
+	if b.LocalDir != "" {
+		return b.LocalDir
+	}
+	if b.TempDir != "" {
+		return b.TempDir
+	}
+	return os.TempDir()
 }
 
 var globalConfig *Config
@@ -77,9 +232,46 @@ func Get() *Config {
 	return globalConfig
 }
 
+// GetDestinations returns the configured destinations, or a single destination built from
+// the top-level storage settings when no destinations list is configured.
+// The first destination is the primary one used for listing and restoring.
+func (c *Config) GetDestinations() []Destination {
+	if len(c.Destinations) > 0 {
+		return c.Destinations
+	}
+
+	storageType := c.Storage.Type
+	if storageType == "" {
+		storageType = StorageTypeS3
+	}
+
+	return []Destination{{
+		Name:  storageType,
+		Type:  storageType,
+		S3:    c.S3,
+		Local: c.Local,
+		SFTP:  c.SFTP,
+	}}
+}
+
 func validateConfig(cfg *Config) error {
-	if cfg.S3.Bucket == "" {
-		return fmt.Errorf("s3.bucket is required")
+	if len(cfg.Destinations) > 0 {
+		names := make(map[string]bool)
+		for _, dest := range cfg.Destinations {
+			if dest.Name == "" {
+				return fmt.Errorf("every destination must have a name")
+			}
+			if names[dest.Name] {
+				return fmt.Errorf("duplicate destination name: %s", dest.Name)
+			}
+			names[dest.Name] = true
+
+			if err := validateDestination(dest); err != nil {
+				return fmt.Errorf("destination %s: %w", dest.Name, err)
+			}
+		}
+	} else if err := validateDestination(cfg.GetDestinations()[0]); err != nil {
+		return err
 	}
 
 	if len(cfg.Services) == 0 {
@@ -96,15 +288,147 @@ func validateConfig(cfg *Config) error {
 				return fmt.Errorf("service %s path %s must be an absolute path", name, pathName)
 			}
 		}
+
+		for pathName, patterns := range service.Exclude {
+			for _, pattern := range patterns {
+				if _, err := filepath.Match(strings.TrimPrefix(pattern, "!"), ""); err != nil {
+					return fmt.Errorf("service %s exclude pattern %q for %s is invalid: %w", name, pattern, pathName, err)
+				}
+			}
+		}
 	}
 
 	if cfg.Retention <= 0 {
 		return fmt.Errorf("retention must be greater than 0")
 	}
 
+	if cfg.Backup.LocalDir != "" && !filepath.IsAbs(cfg.Backup.LocalDir) {
+		return fmt.Errorf("backup.local_dir must be an absolute path")
+	}
+
+	if cfg.Backup.LocalRetention < 0 {
+		return fmt.Errorf("backup.local_retention cannot be negative")
+	}
+
+	if cfg.Backup.Encryption.IdentityFile != "" && !filepath.IsAbs(cfg.Backup.Encryption.IdentityFile) {
+		return fmt.Errorf("backup.encryption.identity_file must be an absolute path")
+	}
+
+	switch cfg.Backup.BackupMode() {
+	case BackupModeFull, BackupModeIncremental, BackupModeDifferential:
+	default:
+		return fmt.Errorf("unsupported backup.mode: %s (must be full, incremental or differential)", cfg.Backup.Mode)
+	}
+
+	if cfg.Backup.FullInterval < 0 {
+		return fmt.Errorf("backup.full_interval cannot be negative")
+	}
+
+	if cfg.Backup.StateDir != "" && !filepath.IsAbs(cfg.Backup.StateDir) {
+		return fmt.Errorf("backup.state_dir must be an absolute path")
+	}
+
+	if err := validateCompression(cfg.Backup); err != nil {
+		return err
+	}
+
 	if cfg.Backup.MinSize < 0 {
 		return fmt.Errorf("backup.min_size cannot be negative")
 	}
 
+	if cfg.Backup.Dedup.Enabled {
+		if err := validateDedup(cfg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateDedup(cfg *Config) error {
+	for _, reserved := range []string{ChunksDir, LocksDir, KeysDir} {
+		if _, exists := cfg.Services[reserved]; exists {
+			return fmt.Errorf("service name %s is reserved for deduplicated repositories", reserved)
+		}
+	}
+
+	if cfg.Backup.BackupMode() != BackupModeFull {
+		return fmt.Errorf("backup.mode %s can't be combined with backup.dedup, deduplicated backups only store new chunks anyway", cfg.Backup.Mode)
+	}
+
+	if cfg.Backup.KeepLocal {
+		return fmt.Errorf("backup.keep_local is not supported with backup.dedup")
+	}
+
+	// Chunks are named by their hash and checked against it on restore
+	if cfg.Backup.VerifyAfterUpload {
+		return fmt.Errorf("backup.verify_after_upload is not supported with backup.dedup")
+	}
+
+	// Every chunk is encrypted on its own, a passphrase would run scrypt for each of them
+	if cfg.Backup.Encryption.Enabled && len(cfg.Backup.Encryption.Recipients) == 0 {
+		return fmt.Errorf("backup.dedup with encryption requires backup.encryption.recipients, passphrase encryption is not supported")
+	}
+
+	chunkSize := cfg.Backup.Dedup.ChunkSize
+	if chunkSize != 0 && (chunkSize < 64<<10 || chunkSize > 64<<20) {
+		return fmt.Errorf("backup.dedup.chunk_size must be between 64 KiB and 64 MiB")
+	}
+
+	return nil
+}
+
+func validateCompression(backup BackupConfig) error {
+	var maxLevel int
+	switch backup.CompressionFormat() {
+	case CompressionNone:
+		return nil
+	case CompressionGzip:
+		maxLevel = 9
+	case CompressionZstd:
+		maxLevel = 22
+	case CompressionXz:
+		maxLevel = 9
+	default:
+		return fmt.Errorf("unsupported backup.compression: %s (must be gzip, zstd, xz or none)", backup.Compression)
+	}
+
+	if backup.CompressionLevel < 0 || backup.CompressionLevel > maxLevel {
+		return fmt.Errorf("backup.compression_level for %s must be between 0 (default) and %d", backup.CompressionFormat(), maxLevel)
+	}
+
+	return nil
+}
+
+func validateDestination(dest Destination) error {
+	switch dest.Type {
+	case "", StorageTypeS3:
+		if dest.S3.Bucket == "" {
+			return fmt.Errorf("s3.bucket is required")
+		}
+	case StorageTypeLocal:
+		if dest.Local.Path == "" {
+			return fmt.Errorf("local.path is required when storage type is local")
+		}
+		if !filepath.IsAbs(dest.Local.Path) {
+			return fmt.Errorf("local.path must be an absolute path")
+		}
+	case StorageTypeSFTP:
+		if dest.SFTP.Host == "" {
+			return fmt.Errorf("sftp.host is required when storage type is sftp")
+		}
+		if dest.SFTP.User == "" {
+			return fmt.Errorf("sftp.user is required when storage type is sftp")
+		}
+		if dest.SFTP.KeyFile == "" {
+			return fmt.Errorf("sftp.key_file is required when storage type is sftp")
+		}
+		if !strings.HasPrefix(dest.SFTP.Path, "/") {
+			return fmt.Errorf("sftp.path must be an absolute path")
+		}
+	default:
+		return fmt.Errorf("unsupported storage type: %s", dest.Type)
+	}
+
 	return nil
 }
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompressionFormat(t *testing.T) {
+	tests := []struct {
+		compression string
+		want        string
+	}{
+		{"", CompressionNone},
+		{"none", CompressionNone},
+		{"false", CompressionNone},
+		{"0", CompressionNone},
+		{"true", CompressionGzip},
+		{"1", CompressionGzip},
+		{"gzip", CompressionGzip},
+		{" ZSTD ", CompressionZstd},
+		{"xz", CompressionXz},
+		{"bzip2", "bzip2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.compression, func(t *testing.T) {
+			backup := BackupConfig{Compression: tt.compression}
+			if got := backup.CompressionFormat(); got != tt.want {
+				t.Errorf("CompressionFormat() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateCompression(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression string
+		level       int
+		wantErr     string
+	}{
+		{"none ignores the level", "none", 50, ""},
+		{"gzip default", "gzip", 0, ""},
+		{"gzip maximum", "gzip", 9, ""},
+		{"gzip above maximum", "gzip", 10, "between 0 (default) and 9"},
+		{"gzip negative", "gzip", -1, "between 0 (default) and 9"},
+		{"legacy true", "true", 9, ""},
+		{"zstd maximum", "zstd", 22, ""},
+		{"zstd above maximum", "zstd", 23, "between 0 (default) and 22"},
+		{"xz minimum", "xz", 1, ""},
+		{"xz above maximum", "xz", 10, "between 0 (default) and 9"},
+		{"unsupported format", "bzip2", 0, "unsupported backup.compression: bzip2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCompression(BackupConfig{Compression: tt.compression, CompressionLevel: tt.level})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateCompression() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateCompression() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package dedup
+
+import "math/bits"
+
+// gear is the table of random values of the gear rolling hash, generated from a fixed seed
+// so chunk boundaries are stable between runs and versions
+var gear = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x5354415348434443) // "STASHCDC"
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker splits a stream into content-defined chunks: a boundary is placed wherever the
+// rolling hash of the last bytes matches a mask, so an insertion only changes the chunks
+// around it and the rest of the stream still deduplicates against earlier backups.
+type chunker struct {
+	minSize int
+	maxSize int
+	mask    uint64
+	emit    func(chunk []byte) error
+
+	buf  []byte
+	pos  int
+	hash uint64
+}
+
+// newChunker creates a chunker producing chunks of averageSize bytes on average (rounded
+// down to a power of two), between a quarter and four times that size
+func newChunker(averageSize int, emit func(chunk []byte) error) *chunker {
+	maskBits := bits.Len(uint(averageSize)) - 1
+
+	return &chunker{
+		minSize: averageSize / 4,
+		maxSize: averageSize * 4,
+		// The high bits of the gear hash depend on the most bytes
+		mask: (uint64(1)<<maskBits - 1) << (64 - maskBits),
+		emit: emit,
+	}
+}
+
+// Write adds data to the stream, emitting every chunk that is complete
+func (c *chunker) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+
+	for c.pos < len(c.buf) {
+		c.hash = (c.hash << 1) + gear[c.buf[c.pos]]
+		c.pos++
+
+		if (c.pos >= c.minSize && c.hash&c.mask == 0) || c.pos >= c.maxSize {
+			if err := c.emit(c.buf[:c.pos]); err != nil {
+				return 0, err
+			}
+
+			// Move the remainder to the front so the buffer doesn't grow with the stream
+			c.buf = append(c.buf[:0], c.buf[c.pos:]...)
+			c.pos = 0
+			c.hash = 0
+		}
+	}
+
+	return len(p), nil
+}
+
+// Close emits the last, possibly short, chunk
+func (c *chunker) Close() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+
+	err := c.emit(c.buf)
+	c.buf = nil
+	c.pos = 0
+	c.hash = 0
+	return err
+}
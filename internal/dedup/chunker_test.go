@@ -0,0 +1,130 @@
+package dedup
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+const testAverageSize = 4096
+
+// randomData returns size bytes that are the same on every run
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// chunkData splits data into chunks, writing it in pieces of writeSize bytes
+func chunkData(t *testing.T, data []byte, writeSize int) [][]byte {
+	t.Helper()
+
+	var chunks [][]byte
+	c := newChunker(testAverageSize, func(chunk []byte) error {
+		chunks = append(chunks, append([]byte(nil), chunk...))
+		return nil
+	})
+
+	for start := 0; start < len(data); start += writeSize {
+		end := min(start+writeSize, len(data))
+		if _, err := c.Write(data[start:end]); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	return chunks
+}
+
+func TestChunkerBoundaries(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		maxChunks bool // every chunk but the last is cut at the maximum size
+	}{
+		{"random", randomData(1, 1<<20), false},
+		// The hash of a constant stream never matches the mask
+		{"zeros", make([]byte, 100000), true},
+		{"shorter than the minimum", randomData(2, testAverageSize/8), false},
+		{"empty", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := chunkData(t, tt.data, 65536)
+
+			if got := bytes.Join(chunks, nil); !bytes.Equal(got, tt.data) {
+				t.Fatalf("chunks don't add up to the input: %d bytes, want %d", len(got), len(tt.data))
+			}
+
+			for i, chunk := range chunks {
+				if len(chunk) > testAverageSize*4 {
+					t.Errorf("chunk %d is %d bytes, above the maximum %d", i, len(chunk), testAverageSize*4)
+				}
+				// Only the last chunk may be short
+				if i < len(chunks)-1 && len(chunk) < testAverageSize/4 {
+					t.Errorf("chunk %d is %d bytes, below the minimum %d", i, len(chunk), testAverageSize/4)
+				}
+				if tt.maxChunks && i < len(chunks)-1 && len(chunk) != testAverageSize*4 {
+					t.Errorf("chunk %d is %d bytes, want the maximum %d", i, len(chunk), testAverageSize*4)
+				}
+			}
+		})
+	}
+}
+
+func TestChunkerAverageSize(t *testing.T) {
+	data := randomData(3, 4<<20)
+	chunks := chunkData(t, data, 65536)
+
+	average := len(data) / len(chunks)
+	if average < testAverageSize/2 || average > testAverageSize*2 {
+		t.Errorf("average chunk size = %d, want about %d", average, testAverageSize)
+	}
+}
+
+func TestChunkerIgnoresWriteSizes(t *testing.T) {
+	data := randomData(4, 256*1024)
+	want := chunkData(t, data, len(data))
+
+	for _, writeSize := range []int{1, 7, 4096, 100000} {
+		got := chunkData(t, data, writeSize)
+		if len(got) != len(want) {
+			t.Fatalf("writes of %d bytes produced %d chunks, want %d", writeSize, len(got), len(want))
+		}
+		for i := range got {
+			if !bytes.Equal(got[i], want[i]) {
+				t.Fatalf("writes of %d bytes: chunk %d differs", writeSize, i)
+			}
+		}
+	}
+}
+
+func TestChunkerInsertionOnlyChangesNearbyChunks(t *testing.T) {
+	original := randomData(5, 1<<20)
+
+	// Insert a few bytes in the middle of the stream
+	modified := append([]byte(nil), original[:len(original)/2]...)
+	modified = append(modified, []byte("inserted")...)
+	modified = append(modified, original[len(original)/2:]...)
+
+	before := make(map[string]bool)
+	for _, chunk := range chunkData(t, original, 65536) {
+		before[string(chunk)] = true
+	}
+
+	after := chunkData(t, modified, 65536)
+	var changed int
+	for _, chunk := range after {
+		if !before[string(chunk)] {
+			changed++
+		}
+	}
+
+	// The boundaries resynchronize after the insertion, usually within a chunk or two
+	if changed == 0 || changed > 3 {
+		t.Errorf("%d of %d chunks changed after a small insertion, want 1 to 3", changed, len(after))
+	}
+}
@@ -0,0 +1,162 @@
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	"github.com/volcie/stash/internal/config"
+)
+
+// idKeySize is the size of the random key encrypted chunks are named with
+const idKeySize = 32
+
+// idKeyName is the object the chunk ID key of a repository is stored in, sealed like the chunks
+var idKeyName = path.Join(config.KeysDir, "chunk-id")
+
+// LoadIDKey returns the secret key encrypted chunks are named with, so someone with access to the
+// storage but not the key can't tell whether a known piece of data is stored. The key is random,
+// generated by the first backup and cached in cachePath. Every repository stores a copy sealed like
+// the chunks, from which a backup with the identities recovers it if the cache is lost. Snapshots
+// carry the key they were written with, so restoring never needs either copy.
+func LoadIDKey(ctx context.Context, repos []*Repository, cachePath string) ([]byte, error) {
+	key, err := readIDKeyCache(cachePath)
+	if err != nil {
+		return nil, err
+	}
+	cached := key != nil
+
+	stored := make([][]byte, len(repos)) // key stored in each repository, nil if none or unreadable
+	exists := make([]bool, len(repos))
+	for i, repo := range repos {
+		stored[i], exists[i], err = repo.loadIDKey(ctx)
+		if err != nil {
+			if !exists[i] {
+				return nil, err
+			}
+			logrus.Warnf("Chunk ID key stored in %s is unusable, chunks stored with it won't be reused: %v", repo.backend.Location(), err)
+		}
+
+		if key == nil && stored[i] != nil {
+			key = stored[i]
+			logrus.Infof("Recovered chunk ID key from %s", repo.backend.Location())
+		}
+	}
+
+	if key == nil {
+		key = make([]byte, idKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate chunk ID key: %w", err)
+		}
+		logrus.Infof("Generated a new chunk ID key, cached in %s", cachePath)
+	}
+
+	if !cached {
+		if err := writeIDKeyCache(cachePath, key); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, repo := range repos {
+		switch {
+		case !exists[i]:
+			if err := repo.storeIDKey(ctx, key); err != nil {
+				return nil, err
+			}
+		case stored[i] != nil && !bytes.Equal(stored[i], key):
+			logrus.Warnf("%s stores a different chunk ID key than %s, chunks stored with it won't be reused", repo.backend.Location(), cachePath)
+		}
+	}
+
+	return key, nil
+}
+
+// loadIDKey returns the chunk ID key stored in the repository and whether there is one. The
+// key is nil along with an error if it is stored but can't be decrypted with the identities.
+func (r *Repository) loadIDKey(ctx context.Context) ([]byte, bool, error) {
+	objects, err := r.backend.ListObjects(ctx, config.KeysDir)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to list keys: %w", err)
+	}
+
+	exists := false
+	for _, object := range objects {
+		if object.Name == idKeyName {
+			exists = true
+		}
+	}
+	if !exists {
+		return nil, false, nil
+	}
+
+	reader, err := r.backend.GetObject(ctx, idKeyName)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to download chunk ID key: %w", err)
+	}
+	defer reader.Close()
+
+	key, err := r.blobs.OpenBlob(reader)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to open chunk ID key: %w", err)
+	}
+	if len(key) != idKeySize {
+		return nil, true, fmt.Errorf("chunk ID key is %d bytes, want %d", len(key), idKeySize)
+	}
+
+	return key, true, nil
+}
+
+// storeIDKey stores the chunk ID key in the repository, encrypted to the recipients
+func (r *Repository) storeIDKey(ctx context.Context, key []byte) error {
+	sealed, err := r.blobs.SealBlob(key)
+	if err != nil {
+		return fmt.Errorf("failed to seal chunk ID key: %w", err)
+	}
+
+	if err := r.backend.PutObject(ctx, idKeyName, sealed); err != nil {
+		return fmt.Errorf("failed to store chunk ID key in %s: %w", r.backend.Location(), err)
+	}
+
+	return nil
+}
+
+// readIDKeyCache returns the cached chunk ID key, nil if there is none
+func readIDKeyCache(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read chunk ID key: %w", err)
+	}
+
+	if len(key) != idKeySize {
+		return nil, fmt.Errorf("chunk ID key %s is %d bytes, want %d", path, len(key), idKeySize)
+	}
+
+	return key, nil
+}
+
+func writeIDKeyCache(path string, key []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create chunk ID key directory: %w", err)
+	}
+
+	// Write to a temp file first so an interrupted write never leaves a truncated key behind
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, key, 0600); err != nil {
+		return fmt.Errorf("failed to write chunk ID key: %w", err)
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to move chunk ID key into place: %w", err)
+	}
+
+	return nil
+}
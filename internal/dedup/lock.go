@@ -0,0 +1,147 @@
+package dedup
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/volcie/stash/internal/config"
+)
+
+// Locks keep garbage collection from deleting chunks a running backup reuses. A backup holds a
+// shared lock from loading the chunk index until its snapshot is stored, garbage collection an
+// exclusive one. Each run writes its lock before looking for conflicting ones, so of two runs
+// starting together at least one sees the other.
+const (
+	lockBackup = "backup"
+	lockGC     = "gc"
+)
+
+// lockStaleAfter is the age after which a lock left behind by a crashed run is ignored
+const lockStaleAfter = 24 * time.Hour
+
+// Backups wait for a running garbage collection rather than fail, it only lists and deletes objects
+const (
+	lockWaitTimeout  = 10 * time.Minute
+	lockPollInterval = 5 * time.Second
+)
+
+// ErrBackupRunning is returned by GarbageCollect while a backup is writing to the repository
+var ErrBackupRunning = errors.New("a backup is writing to the repository")
+
+// Lock is a lock object held in a repository
+type Lock struct {
+	repo *Repository
+	name string
+}
+
+// createLock stores a lock object of the given kind, named so locks of one kind list together
+func (r *Repository) createLock(ctx context.Context, kind string) (*Lock, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return nil, fmt.Errorf("failed to generate lock name: %w", err)
+	}
+
+	name := path.Join(config.LocksDir, fmt.Sprintf("%s-%d-%s", kind, time.Now().Unix(), hex.EncodeToString(random)))
+
+	// Only the name and modification time matter, the content helps finding who left a stale lock
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s pid %d\n", hostname, os.Getpid())
+
+	if err := r.backend.PutObject(ctx, name, []byte(owner)); err != nil {
+		return nil, fmt.Errorf("failed to lock repository %s: %w", r.backend.Location(), err)
+	}
+
+	return &Lock{repo: r, name: name}, nil
+}
+
+// Release deletes the lock. It isn't tied to the context of the run, so a cancelled
+// backup doesn't leave its lock behind.
+func (l *Lock) Release() {
+	if err := l.repo.backend.DeleteObjects(context.Background(), []string{l.name}); err != nil {
+		logrus.Warnf("Failed to release lock %s in %s, it is ignored after %s: %v", l.name, l.repo.backend.Location(), lockStaleAfter, err)
+	}
+}
+
+// findLocks returns the names of the live locks of kind other than own
+func (r *Repository) findLocks(ctx context.Context, kind string, own *Lock) ([]string, error) {
+	objects, err := r.backend.ListObjects(ctx, config.LocksDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list locks: %w", err)
+	}
+
+	var names []string
+	for _, object := range objects {
+		if object.Name == own.name || !strings.HasPrefix(path.Base(object.Name), kind+"-") {
+			continue
+		}
+		if time.Since(object.ModTime) > lockStaleAfter {
+			logrus.Warnf("Ignoring stale lock %s in %s", object.Name, r.backend.Location())
+			continue
+		}
+		names = append(names, object.Name)
+	}
+
+	return names, nil
+}
+
+// LockBackup takes the shared lock of a backup, waiting for a running garbage collection to finish.
+// Must be held before loading the chunk index, until the snapshot is stored.
+func (r *Repository) LockBackup(ctx context.Context) (*Lock, error) {
+	lock, err := r.createLock(ctx, lockBackup)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(lockWaitTimeout)
+	for {
+		gcLocks, err := r.findLocks(ctx, lockGC, lock)
+		if err != nil {
+			lock.Release()
+			return nil, err
+		}
+		if len(gcLocks) == 0 {
+			return lock, nil
+		}
+
+		if time.Now().After(deadline) {
+			lock.Release()
+			return nil, fmt.Errorf("repository %s is still locked by garbage collection after %s (%s)", r.backend.Location(), lockWaitTimeout, gcLocks[0])
+		}
+
+		logrus.Infof("Waiting for garbage collection in %s to finish", r.backend.Location())
+		select {
+		case <-ctx.Done():
+			lock.Release()
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// lockGC takes the exclusive lock of garbage collection, failing while a backup is running
+func (r *Repository) lockGC(ctx context.Context) (*Lock, error) {
+	lock, err := r.createLock(ctx, lockGC)
+	if err != nil {
+		return nil, err
+	}
+
+	backupLocks, err := r.findLocks(ctx, lockBackup, lock)
+	if err != nil {
+		lock.Release()
+		return nil, err
+	}
+	if len(backupLocks) > 0 {
+		lock.Release()
+		return nil, fmt.Errorf("%w (%d locks in %s)", ErrBackupRunning, len(backupLocks), r.backend.Location())
+	}
+
+	return lock, nil
+}
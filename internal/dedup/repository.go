@@ -0,0 +1,294 @@
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/volcie/stash/internal/archive"
+	"github.com/volcie/stash/internal/config"
+	"github.com/volcie/stash/internal/storage"
+)
+
+// manifestVersion 2 snapshots are sealed like chunks and name chunks by their keyed hash,
+// version 1 snapshots are plain JSON naming chunks by their SHA-256
+const manifestVersion = 2
+
+// gcGracePeriod protects chunks uploaded by a backup that is still running, and so not referenced
+// by any snapshot yet, from being collected. Backups made by versions without locks rely on it.
+const gcGracePeriod = time.Hour
+
+// Manifest is a deduplicated backup: the chunks its archive was split into, in order
+type Manifest struct {
+	Version   int        `json:"version"`
+	Service   string     `json:"service"`
+	Path      string     `json:"path"`
+	Timestamp string     `json:"timestamp"`
+	Size      int64      `json:"size"` // size of the archive the chunks make up
+	Files     int        `json:"files"`
+	IDKey     []byte     `json:"id_key,omitempty"` // key of the chunk IDs, see LoadIDKey
+	Chunks    []ChunkRef `json:"chunks"`
+}
+
+// ChunkRef references a chunk by the hash of its content
+type ChunkRef struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
+}
+
+// Repository stores deduplicated chunks and the snapshots referencing them in a storage backend
+type Repository struct {
+	backend storage.Backend
+	blobs   *archive.Archiver // compresses and encrypts chunks, or decrypts them on restore
+	known   map[string]bool
+}
+
+func NewRepository(backend storage.Backend, blobs *archive.Archiver) *Repository {
+	return &Repository{
+		backend: backend,
+		blobs:   blobs,
+		known:   make(map[string]bool),
+	}
+}
+
+// chunkName returns the object name of a chunk, sharded by the first two digits of its hash
+func chunkName(id string) string {
+	return path.Join(config.ChunksDir, id[:2], id)
+}
+
+// chunkID returns the ID of a chunk, its HMAC-SHA256 with key or its SHA-256 without one
+func chunkID(key, data []byte) string {
+	if key == nil {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// LoadIndex lists the chunks already stored so they aren't uploaded again
+func (r *Repository) LoadIndex(ctx context.Context) error {
+	objects, err := r.backend.ListObjects(ctx, config.ChunksDir)
+	if err != nil {
+		return fmt.Errorf("failed to list chunks: %w", err)
+	}
+
+	for _, object := range objects {
+		r.known[path.Base(object.Name)] = true
+	}
+
+	logrus.Debugf("Repository %s has %d chunks", r.backend.Location(), len(r.known))
+	return nil
+}
+
+func (r *Repository) hasChunk(id string) bool {
+	return r.known[id]
+}
+
+func (r *Repository) storeChunk(ctx context.Context, id string, sealed []byte) error {
+	if err := r.backend.PutObject(ctx, chunkName(id), sealed); err != nil {
+		return err
+	}
+	r.known[id] = true
+	return nil
+}
+
+// readChunk downloads a chunk and checks its content against its id, computed with key
+func (r *Repository) readChunk(ctx context.Context, key []byte, id string) ([]byte, error) {
+	reader, err := r.backend.GetObject(ctx, chunkName(id))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := r.blobs.OpenBlob(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk %s: %w", id, err)
+	}
+
+	if chunkID(key, data) != id {
+		return nil, fmt.Errorf("chunk %s is corrupt: content does not match its hash", id)
+	}
+
+	return data, nil
+}
+
+// SaveSnapshot stores the manifest of a backup, making it visible to list, restore and cleanup.
+// It is compressed and encrypted like the chunks.
+func (r *Repository) SaveSnapshot(ctx context.Context, manifest *Manifest) (*storage.BackupInfo, error) {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	sealed, err := r.blobs.SealBlob(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal snapshot: %w", err)
+	}
+
+	return r.backend.UploadWithTimestamp(ctx, bytes.NewReader(sealed), manifest.Service, manifest.Path, manifest.Timestamp, storage.SnapshotExtension)
+}
+
+// LoadManifest downloads the manifest of the snapshot stored under key
+func (r *Repository) LoadManifest(ctx context.Context, key string) (*Manifest, error) {
+	reader, err := r.backend.Download(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download snapshot %s: %w", key, err)
+	}
+
+	// Version 1 snapshots are plain JSON, a sealed blob starts with its format or the age header
+	if !bytes.HasPrefix(data, []byte("{")) {
+		if r.blobs == nil {
+			return nil, fmt.Errorf("snapshot %s is sealed and no decryption settings are available", key)
+		}
+		if data, err = r.blobs.OpenBlob(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("failed to open snapshot %s: %w", key, err)
+		}
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot %s: %w", key, err)
+	}
+
+	if manifest.Version != 1 && manifest.Version != manifestVersion {
+		return nil, fmt.Errorf("snapshot %s has unsupported version %d", key, manifest.Version)
+	}
+
+	return &manifest, nil
+}
+
+// NewReader returns the archive of a snapshot, reassembled from its chunks as it is read
+func (r *Repository) NewReader(ctx context.Context, manifest *Manifest) io.ReadCloser {
+	pipeReader, pipeWriter := io.Pipe()
+
+	go func() {
+		for _, chunk := range manifest.Chunks {
+			data, err := r.readChunk(ctx, manifest.IDKey, chunk.ID)
+			if err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+
+			// Fails once the reader is closed
+			if _, err := pipeWriter.Write(data); err != nil {
+				return
+			}
+		}
+		pipeWriter.Close()
+	}()
+
+	return pipeReader
+}
+
+// OpenBackup returns the archive of a backup and its size, reassembling deduplicated snapshots from their chunks
+func OpenBackup(ctx context.Context, source storage.Backend, blobs *archive.Archiver, backup *storage.BackupInfo) (io.ReadCloser, int64, error) {
+	if backup.Kind != storage.KindSnapshot {
+		reader, err := source.Download(ctx, backup.Key)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to download backup: %w", err)
+		}
+		return reader, backup.Size, nil
+	}
+
+	repo := NewRepository(source, blobs)
+	manifest, err := repo.LoadManifest(ctx, backup.Key)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to download snapshot: %w", err)
+	}
+
+	logrus.Infof("Reassembling %s from %d chunks", backup.Key, len(manifest.Chunks))
+	return repo.NewReader(ctx, manifest), manifest.Size, nil
+}
+
+// GCResult summarizes a garbage collection run
+type GCResult struct {
+	Snapshots  int
+	Referenced int
+	Deleted    int
+	Size       int64
+}
+
+// GarbageCollect deletes the chunks no snapshot references anymore. Chunks are reference counted
+// across every snapshot in the repository, whatever service they belong to. Snapshots in deleted
+// are counted as gone, so a dry run reports the chunks its deletions would free. Nothing is
+// collected while a backup holds a lock on the repository, it may reuse unreferenced chunks.
+func (r *Repository) GarbageCollect(ctx context.Context, deleted map[string]bool, dryRun bool) (*GCResult, error) {
+	result := &GCResult{}
+
+	if !dryRun {
+		lock, err := r.lockGC(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer lock.Release()
+	}
+
+	objects, err := r.backend.ListObjects(ctx, config.ChunksDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks: %w", err)
+	}
+	if len(objects) == 0 {
+		return result, nil
+	}
+
+	backups, err := r.backend.List(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	references := make(map[string]int)
+	for _, backup := range backups {
+		if backup.Kind != storage.KindSnapshot || deleted[backup.Key] {
+			continue
+		}
+
+		// A snapshot that can't be read might reference any chunk, so nothing is safe to delete
+		manifest, err := r.LoadManifest(ctx, backup.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read snapshot %s, not collecting chunks: %w", backup.Key, err)
+		}
+
+		result.Snapshots++
+		for _, chunk := range manifest.Chunks {
+			references[chunk.ID]++
+		}
+	}
+	result.Referenced = len(references)
+
+	var unreferenced []string
+	for _, object := range objects {
+		if references[path.Base(object.Name)] > 0 || time.Since(object.ModTime) < gcGracePeriod {
+			continue
+		}
+		unreferenced = append(unreferenced, object.Name)
+		result.Deleted++
+		result.Size += object.Size
+	}
+
+	if len(unreferenced) == 0 || dryRun {
+		return result, nil
+	}
+
+	if err := r.backend.DeleteObjects(ctx, unreferenced); err != nil {
+		return nil, fmt.Errorf("failed to delete unreferenced chunks: %w", err)
+	}
+
+	return result, nil
+}
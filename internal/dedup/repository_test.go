@@ -0,0 +1,474 @@
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/volcie/stash/internal/archive"
+	"github.com/volcie/stash/internal/config"
+	"github.com/volcie/stash/internal/storage"
+)
+
+type testRepo struct {
+	root    string
+	backend *storage.LocalClient
+	repo    *Repository
+	blobs   *archive.Archiver
+	idKey   []byte
+}
+
+// newTestRepo creates a repository in a temporary directory, encrypted to a new key if encrypted
+func newTestRepo(t *testing.T, encrypted bool) *testRepo {
+	t.Helper()
+
+	root := t.TempDir()
+	backend, err := storage.NewLocalClient(root, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := archive.NewArchiver(config.CompressionZstd, false)
+	repo := NewRepository(backend, blobs)
+	var idKey []byte
+	if encrypted {
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		blobs.SetRecipients([]age.Recipient{identity.Recipient()})
+		blobs.SetIdentities([]age.Identity{identity})
+
+		idKey, err = LoadIDKey(context.Background(), []*Repository{repo}, filepath.Join(t.TempDir(), "chunk-id.key"))
+		if err != nil {
+			t.Fatalf("LoadIDKey() error = %v", err)
+		}
+	}
+
+	return &testRepo{
+		root:    root,
+		backend: backend,
+		repo:    repo,
+		blobs:   blobs,
+		idKey:   idKey,
+	}
+}
+
+// backup stores data as a snapshot of service taken at timestamp
+func (r *testRepo) backup(t *testing.T, service, timestamp string, data []byte) (*storage.BackupInfo, *Manifest) {
+	t.Helper()
+	ctx := context.Background()
+
+	lock, err := r.repo.LockBackup(ctx)
+	if err != nil {
+		t.Fatalf("LockBackup() error = %v", err)
+	}
+	defer lock.Release()
+
+	if err := r.repo.LoadIndex(ctx); err != nil {
+		t.Fatalf("LoadIndex() error = %v", err)
+	}
+
+	writer := NewWriter(ctx, []*Repository{r.repo}, r.blobs, r.idKey, testAverageSize)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	manifest := writer.Manifest(service, "data", timestamp, 1)
+	info, err := r.repo.SaveSnapshot(ctx, manifest)
+	if err != nil {
+		t.Fatalf("SaveSnapshot() error = %v", err)
+	}
+	return info, manifest
+}
+
+// restore reassembles the archive of a snapshot
+func (r *testRepo) restore(t *testing.T, info *storage.BackupInfo) []byte {
+	t.Helper()
+
+	reader, size, err := OpenBackup(context.Background(), r.backend, r.blobs, info)
+	if err != nil {
+		t.Fatalf("OpenBackup() error = %v", err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to reassemble %s: %v", info.Key, err)
+	}
+	if int64(len(data)) != size {
+		t.Errorf("reassembled %d bytes, snapshot size is %d", len(data), size)
+	}
+	return data
+}
+
+// ageObjects makes every object below dir look older than the garbage collection grace period
+func (r *testRepo) ageObjects(t *testing.T, dir string) {
+	t.Helper()
+
+	old := time.Now().Add(-2 * gcGracePeriod)
+	err := filepath.WalkDir(filepath.Join(r.root, dir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		return os.Chtimes(path, old, old)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (r *testRepo) chunkExists(id string) bool {
+	_, err := os.Stat(filepath.Join(r.root, filepath.FromSlash(chunkName(id))))
+	return err == nil
+}
+
+func chunkIDs(manifest *Manifest) map[string]bool {
+	ids := make(map[string]bool)
+	for _, chunk := range manifest.Chunks {
+		ids[chunk.ID] = true
+	}
+	return ids
+}
+
+func TestRepositoryRoundTrip(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		name := "plain"
+		if encrypted {
+			name = "encrypted"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			r := newTestRepo(t, encrypted)
+			data := randomData(10, 200000)
+
+			info, manifest := r.backup(t, "app", "20240101-000000", data)
+			if info.Kind != storage.KindSnapshot {
+				t.Errorf("Kind = %q, want %q", info.Kind, storage.KindSnapshot)
+			}
+			if got := r.restore(t, info); !bytes.Equal(got, data) {
+				t.Fatal("reassembled archive differs from the backed up data")
+			}
+
+			// Chunks are only named by their plain hash without encryption
+			first := data[:manifest.Chunks[0].Size]
+			sum := sha256.Sum256(first)
+			plainID := hex.EncodeToString(sum[:])
+			if (manifest.Chunks[0].ID == plainID) == encrypted {
+				t.Errorf("chunk ID %s, plain SHA-256 %s, encrypted %v", manifest.Chunks[0].ID, plainID, encrypted)
+			}
+
+			stored, err := os.ReadFile(filepath.Join(r.root, filepath.FromSlash(info.Key)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encrypted && bytes.Contains(stored, []byte(manifest.Chunks[0].ID)) {
+				t.Error("encrypted snapshot stores chunk IDs in the clear")
+			}
+
+			// A second backup of the same data stores no new chunk
+			before, err := r.backend.ListObjects(context.Background(), config.ChunksDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.backup(t, "app", "20240102-000000", data)
+			after, err := r.backend.ListObjects(context.Background(), config.ChunksDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(after) != len(before) {
+				t.Errorf("second backup stored %d new chunks, want none", len(after)-len(before))
+			}
+		})
+	}
+}
+
+func TestLoadIDKey(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t, true)
+	cachePath := filepath.Join(t.TempDir(), "state", "chunk-id.key")
+
+	key, err := LoadIDKey(ctx, []*Repository{r.repo}, cachePath)
+	if err != nil {
+		t.Fatalf("LoadIDKey() error = %v", err)
+	}
+	if len(key) != idKeySize {
+		t.Fatalf("LoadIDKey() returned %d bytes, want %d", len(key), idKeySize)
+	}
+	if !bytes.Equal(key, r.idKey) {
+		t.Error("LoadIDKey() didn't reuse the key stored in the repository")
+	}
+
+	stored, err := os.ReadFile(filepath.Join(r.root, filepath.FromSlash(idKeyName)))
+	if err != nil {
+		t.Fatalf("chunk ID key not stored in the repository: %v", err)
+	}
+	if bytes.Contains(stored, key) {
+		t.Error("repository stores the chunk ID key in the clear")
+	}
+
+	// The cached key is used as is, even once the identities are gone
+	blobs := archive.NewArchiver(config.CompressionZstd, false)
+	if again, err := LoadIDKey(ctx, []*Repository{NewRepository(r.backend, blobs)}, cachePath); err != nil || !bytes.Equal(again, key) {
+		t.Errorf("LoadIDKey() with a cache = %x, %v, want %x", again, err, key)
+	}
+
+	// A new repository gets a copy of the key
+	other := newTestRepo(t, false)
+	other.blobs.SetRecipients([]age.Recipient{mustIdentity(t).Recipient()})
+	if _, err := LoadIDKey(ctx, []*Repository{r.repo, other.repo}, cachePath); err != nil {
+		t.Fatalf("LoadIDKey() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(other.root, filepath.FromSlash(idKeyName))); err != nil {
+		t.Errorf("chunk ID key not stored in the new repository: %v", err)
+	}
+
+	// Without the identities a lost cache means a new key, leaving the stored one alone
+	lostCache := filepath.Join(t.TempDir(), "chunk-id.key")
+	fresh, err := LoadIDKey(ctx, []*Repository{NewRepository(r.backend, blobs)}, lostCache)
+	if err != nil {
+		t.Fatalf("LoadIDKey() without identities error = %v", err)
+	}
+	if bytes.Equal(fresh, key) {
+		t.Error("LoadIDKey() recovered a key it can't decrypt")
+	}
+	if after, _ := os.ReadFile(filepath.Join(r.root, filepath.FromSlash(idKeyName))); !bytes.Equal(after, stored) {
+		t.Error("LoadIDKey() replaced the key stored in the repository")
+	}
+}
+
+func mustIdentity(t *testing.T) *age.X25519Identity {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+func TestLoadManifestVersion1(t *testing.T) {
+	r := newTestRepo(t, false)
+	ctx := context.Background()
+	data := []byte("archive written by an older version")
+
+	// Version 1 snapshots are plain JSON naming chunks by their SHA-256
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:])
+	sealed, err := r.blobs.SealBlob(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.backend.PutObject(ctx, chunkName(id), sealed); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := json.Marshal(&Manifest{
+		Version:   1,
+		Service:   "app",
+		Path:      "data",
+		Timestamp: "20240101-000000",
+		Size:      int64(len(data)),
+		Chunks:    []ChunkRef{{ID: id, Size: int64(len(data))}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := r.backend.UploadWithTimestamp(ctx, bytes.NewReader(snapshot), "app", "data", "20240101-000000", storage.SnapshotExtension)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := r.restore(t, info); !bytes.Equal(got, data) {
+		t.Errorf("restored %q, want %q", got, data)
+	}
+}
+
+func TestGarbageCollectReferenceCounts(t *testing.T) {
+	r := newTestRepo(t, true)
+	ctx := context.Background()
+
+	common := randomData(20, 100000)
+	first := append(append([]byte(nil), common...), randomData(21, 100000)...)
+	second := append(append([]byte(nil), common...), randomData(22, 100000)...)
+
+	// Different services share the chunks of the common data
+	firstInfo, firstManifest := r.backup(t, "app", "20240101-000000", first)
+	secondInfo, secondManifest := r.backup(t, "other", "20240102-000000", second)
+	r.ageObjects(t, config.ChunksDir)
+
+	firstIDs, secondIDs := chunkIDs(firstManifest), chunkIDs(secondManifest)
+	var shared, onlyFirst int
+	for id := range firstIDs {
+		if secondIDs[id] {
+			shared++
+		} else {
+			onlyFirst++
+		}
+	}
+	if shared == 0 || onlyFirst == 0 {
+		t.Fatalf("test data should share some chunks: %d shared, %d only in the first snapshot", shared, onlyFirst)
+	}
+
+	// Nothing is unreferenced while both snapshots exist
+	result, err := r.repo.GarbageCollect(ctx, nil, false)
+	if err != nil {
+		t.Fatalf("GarbageCollect() error = %v", err)
+	}
+	if result.Deleted != 0 || result.Snapshots != 2 {
+		t.Errorf("GarbageCollect() = %+v, want 2 snapshots and nothing deleted", result)
+	}
+
+	// A dry run counts the snapshots about to be deleted as gone, without deleting anything
+	deleted := map[string]bool{firstInfo.Key: true}
+	result, err = r.repo.GarbageCollect(ctx, deleted, true)
+	if err != nil {
+		t.Fatalf("GarbageCollect() dry run error = %v", err)
+	}
+	if result.Deleted != onlyFirst {
+		t.Errorf("dry run would delete %d chunks, want %d", result.Deleted, onlyFirst)
+	}
+	for id := range firstIDs {
+		if !r.chunkExists(id) {
+			t.Fatalf("dry run deleted chunk %s", id)
+		}
+	}
+
+	if err := r.backend.Delete(ctx, firstInfo.Key); err != nil {
+		t.Fatal(err)
+	}
+	result, err = r.repo.GarbageCollect(ctx, deleted, false)
+	if err != nil {
+		t.Fatalf("GarbageCollect() error = %v", err)
+	}
+	if result.Deleted != onlyFirst || result.Snapshots != 1 {
+		t.Errorf("GarbageCollect() = %+v, want %d deleted chunks and 1 snapshot", result, onlyFirst)
+	}
+
+	for id := range firstIDs {
+		if r.chunkExists(id) != secondIDs[id] {
+			t.Errorf("chunk %s exists = %v, referenced by the remaining snapshot = %v", id, r.chunkExists(id), secondIDs[id])
+		}
+	}
+
+	if got := r.restore(t, secondInfo); !bytes.Equal(got, second) {
+		t.Error("remaining snapshot no longer restores")
+	}
+}
+
+func TestGarbageCollectKeepsRecentChunks(t *testing.T) {
+	r := newTestRepo(t, false)
+	ctx := context.Background()
+
+	// Chunks of a backup that hasn't stored its snapshot yet
+	writer := NewWriter(ctx, []*Repository{r.repo}, r.blobs, nil, testAverageSize)
+	if _, err := writer.Write(randomData(30, 50000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := r.repo.GarbageCollect(ctx, nil, false)
+	if err != nil {
+		t.Fatalf("GarbageCollect() error = %v", err)
+	}
+	if result.Deleted != 0 {
+		t.Errorf("GarbageCollect() deleted %d chunks uploaded within the grace period", result.Deleted)
+	}
+}
+
+func TestGarbageCollectWaitsForBackups(t *testing.T) {
+	r := newTestRepo(t, false)
+	ctx := context.Background()
+
+	// An unreferenced chunk, as left by a backup whose snapshot was deleted
+	writer := NewWriter(ctx, []*Repository{r.repo}, r.blobs, nil, testAverageSize)
+	if _, err := writer.Write([]byte("unreferenced")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r.ageObjects(t, config.ChunksDir)
+
+	// A running backup may reuse it
+	lock, err := r.repo.LockBackup(ctx)
+	if err != nil {
+		t.Fatalf("LockBackup() error = %v", err)
+	}
+
+	if _, err := r.repo.GarbageCollect(ctx, nil, false); !errors.Is(err, ErrBackupRunning) {
+		t.Fatalf("GarbageCollect() error = %v, want ErrBackupRunning", err)
+	}
+	if !r.chunkExists(writer.Manifest("app", "data", "", 0).Chunks[0].ID) {
+		t.Fatal("chunk collected while a backup was running")
+	}
+
+	// The garbage collection lock is released when it gives up
+	objects, err := r.backend.ListObjects(ctx, config.LocksDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 {
+		t.Errorf("%d locks left, want only the backup lock", len(objects))
+	}
+
+	// A lock left behind by a crashed backup is eventually ignored
+	r.ageObjects(t, config.LocksDir)
+	stale := time.Now().Add(-2 * lockStaleAfter)
+	if err := os.Chtimes(filepath.Join(r.root, filepath.FromSlash(lock.name)), stale, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := r.repo.GarbageCollect(ctx, nil, false)
+	if err != nil {
+		t.Fatalf("GarbageCollect() with a stale lock error = %v", err)
+	}
+	if result.Deleted != 1 {
+		t.Errorf("GarbageCollect() deleted %d chunks, want 1", result.Deleted)
+	}
+
+	lock.Release()
+	objects, err = r.backend.ListObjects(ctx, config.LocksDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("%d locks left after releasing, want none", len(objects))
+	}
+}
+
+func TestGarbageCollectUnreadableSnapshot(t *testing.T) {
+	r := newTestRepo(t, true)
+	ctx := context.Background()
+
+	info, manifest := r.backup(t, "app", "20240101-000000", randomData(40, 50000))
+	r.ageObjects(t, config.ChunksDir)
+
+	// Without the key, the snapshot can't tell which chunks are still referenced
+	locked := NewRepository(r.backend, archive.NewArchiver(config.CompressionZstd, false))
+	_, err := locked.GarbageCollect(ctx, nil, false)
+	if err == nil || !strings.Contains(err.Error(), info.Key) {
+		t.Fatalf("GarbageCollect() error = %v, want a failure to read %s", err, info.Key)
+	}
+
+	for id := range chunkIDs(manifest) {
+		if !r.chunkExists(id) {
+			t.Fatalf("chunk %s deleted although a snapshot couldn't be read", id)
+		}
+	}
+}
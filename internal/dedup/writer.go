@@ -0,0 +1,119 @@
+package dedup
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/volcie/stash/internal/archive"
+)
+
+// Writer splits an archive stream into chunks and stores the new ones in every repository.
+// A repository that fails is skipped from then on; writing only fails once every repository has failed.
+type Writer struct {
+	ctx     context.Context
+	repos   []*Repository
+	failed  []error
+	blobs   *archive.Archiver
+	idKey   []byte
+	chunker *chunker
+
+	chunks    []ChunkRef
+	size      int64
+	newChunks int
+	uploaded  int64
+}
+
+// NewWriter creates a writer storing chunks of averageSize bytes on average, sealed with blobs
+// and named by their hash keyed with idKey (see LoadIDKey)
+func NewWriter(ctx context.Context, repos []*Repository, blobs *archive.Archiver, idKey []byte, averageSize int) *Writer {
+	w := &Writer{
+		ctx:    ctx,
+		repos:  repos,
+		failed: make([]error, len(repos)),
+		blobs:  blobs,
+		idKey:  idKey,
+	}
+	w.chunker = newChunker(averageSize, w.storeChunk)
+	return w
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.chunker.Write(p)
+}
+
+// Close stores the last chunk. Must be called before building the manifest.
+func (w *Writer) Close() error {
+	return w.chunker.Close()
+}
+
+func (w *Writer) storeChunk(chunk []byte) error {
+	id := chunkID(w.idKey, chunk)
+	w.chunks = append(w.chunks, ChunkRef{ID: id, Size: int64(len(chunk))})
+	w.size += int64(len(chunk))
+
+	var sealed []byte
+	var stored bool
+	for i, repo := range w.repos {
+		if w.failed[i] != nil || repo.hasChunk(id) {
+			continue
+		}
+
+		// Compress and encrypt once, only for chunks some repository doesn't have yet
+		if sealed == nil {
+			var err error
+			if sealed, err = w.blobs.SealBlob(chunk); err != nil {
+				return err
+			}
+		}
+
+		if err := repo.storeChunk(w.ctx, id, sealed); err != nil {
+			logrus.Errorf("Failed to store chunk in %s: %v", repo.backend.Location(), err)
+			w.failed[i] = err
+			continue
+		}
+
+		stored = true
+		w.uploaded += int64(len(sealed))
+	}
+
+	if stored {
+		w.newChunks++
+	}
+
+	for _, err := range w.failed {
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to store chunk in any repository: %w", w.failed[0])
+}
+
+// Err returns the error that made the i-th repository fail, nil if it received every chunk
+func (w *Writer) Err(i int) error {
+	return w.failed[i]
+}
+
+// Size returns the number of archive bytes written
+func (w *Writer) Size() int64 {
+	return w.size
+}
+
+// Stats returns the number of chunks that were new to at least one repository and the bytes uploaded for them
+func (w *Writer) Stats() (newChunks int, uploaded int64) {
+	return w.newChunks, w.uploaded
+}
+
+// Manifest returns the manifest of the written archive
+func (w *Writer) Manifest(service, pathName, timestamp string, files int) *Manifest {
+	return &Manifest{
+		Version:   manifestVersion,
+		Service:   service,
+		Path:      pathName,
+		Timestamp: timestamp,
+		Size:      w.size,
+		Files:     files,
+		IDKey:     w.idKey,
+		Chunks:    w.chunks,
+	}
+}
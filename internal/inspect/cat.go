@@ -0,0 +1,145 @@
+package inspect
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/sirupsen/logrus"
+	"github.com/volcie/stash/internal/archive"
+	"github.com/volcie/stash/internal/dedup"
+	"github.com/volcie/stash/internal/storage"
+)
+
+type CatOptions struct {
+	ServiceName string
+	Path        string
+	Timestamp   string // YYYYMMDD-HHMMSS, the latest backup if empty
+	File        string // path of the file inside the backup
+}
+
+// Cat writes the content of a single file in a backup to writer. The archive is streamed and the
+// download stops as soon as the file has been written. Incremental and differential backups are
+// searched along with the backups they build on, skipping those whose manifest doesn't list the file.
+func (s *Service) Cat(ctx context.Context, opts *CatOptions, writer io.Writer) error {
+	backup, backups, err := s.FindBackup(ctx, opts.ServiceName, opts.Path, opts.Timestamp)
+	if err != nil {
+		return err
+	}
+
+	chain, err := storage.BackupChain(backups, backup)
+	if err != nil {
+		return err
+	}
+
+	name := archive.CleanEntryName(opts.File)
+
+	// The chain is oldest first, the newest layer holding the file has its content at this backup
+	for i := len(chain) - 1; i >= 0; i-- {
+		layer := chain[i]
+
+		manifest, err := s.archiver.LoadManifest(ctx, s.backend, layer)
+		if err == nil {
+			if !manifestLists(manifest, name) {
+				if isDeleted(manifest, name) {
+					return fmt.Errorf("%s was deleted as of %s", name, layer.Key)
+				}
+				logrus.Debugf("%s is not in %s", name, layer.Key)
+				continue
+			}
+		}
+
+		found, err := s.catFromBackup(ctx, layer, name, writer)
+		if err != nil {
+			return err
+		}
+		if found {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s not found in %s", name, backup.Key)
+}
+
+// catFromBackup streams a single backup and writes the content of the named file, reporting
+// whether the backup contains it
+func (s *Service) catFromBackup(ctx context.Context, backup *storage.BackupInfo, name string, writer io.Writer) (bool, error) {
+	reader, _, err := dedup.OpenBackup(ctx, s.backend, s.archiver, backup)
+	if err != nil {
+		return false, err
+	}
+	// Closing the download before its end aborts it
+	defer reader.Close()
+
+	found, deleted := false, false
+	var linkTarget string
+	err = s.archiver.WalkArchiveWithDeletions(reader, func(header *tar.Header, content io.Reader) error {
+		if archive.CleanEntryName(header.Name) != name {
+			return nil
+		}
+		found = true
+
+		switch header.Typeflag {
+		case tar.TypeReg:
+			if _, err := io.Copy(writer, content); err != nil {
+				return fmt.Errorf("failed to write %s: %w", name, err)
+			}
+			return archive.ErrStopWalk
+		case tar.TypeLink:
+			linkTarget = archive.CleanEntryName(header.Linkname)
+			return archive.ErrStopWalk
+		case tar.TypeSymlink:
+			return fmt.Errorf("%s is a symbolic link to %s", name, header.Linkname)
+		default:
+			return fmt.Errorf("%s is not a regular file", name)
+		}
+	}, func(path string) error {
+		// Without a manifest, the deletions at the end of the archive are the only record of a deleted file
+		if archive.CleanEntryName(path) != name {
+			return nil
+		}
+		deleted = true
+		return archive.ErrStopWalk
+	})
+	if err != nil {
+		return found, fmt.Errorf("failed to read archive %s: %w", backup.Key, err)
+	}
+	if deleted {
+		return true, fmt.Errorf("%s was deleted as of %s", name, backup.Key)
+	}
+
+	// The content of a hard link is stored with the first entry linking to it, earlier in the archive
+	if linkTarget != "" {
+		logrus.Debugf("%s is a hard link to %s", name, linkTarget)
+		targetFound, err := s.catFromBackup(ctx, backup, linkTarget, writer)
+		if err != nil {
+			return true, err
+		}
+		if !targetFound {
+			return true, fmt.Errorf("%s is a hard link to %s, which is missing from %s", name, linkTarget, backup.Key)
+		}
+	}
+
+	return found, nil
+}
+
+// manifestLists reports whether a manifest has an entry for name
+func manifestLists(manifest *archive.Manifest, name string) bool {
+	for _, entry := range manifest.Files {
+		if archive.CleanEntryName(entry.Path) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isDeleted reports whether an incremental manifest records name as deleted since its base
+func isDeleted(manifest *archive.Manifest, name string) bool {
+	for _, deleted := range manifest.Deleted {
+		if archive.CleanEntryName(deleted) == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package inspect
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/volcie/stash/internal/config"
+)
+
+func TestCat(t *testing.T) {
+	for _, withManifest := range []bool{true, false} {
+		name := "without manifests"
+		if withManifest {
+			name = "with manifests"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			tb := newTestBackups(t)
+			tb.write("unchanged", "from the full backup")
+			tb.write("changed", "old")
+			tb.write("gone", "stale content")
+			tb.backup("20250101-030000", config.BackupModeFull, withManifest)
+
+			tb.write("changed", "new")
+			tb.remove("gone")
+			tb.backup("20250102-030000", config.BackupModeIncremental, withManifest)
+
+			tb.write("gone", "recreated")
+			tb.backup("20250103-030000", config.BackupModeIncremental, withManifest)
+
+			tests := []struct {
+				file      string
+				timestamp string
+				want      string
+				wantErr   string
+			}{
+				{"unchanged", "", "from the full backup", ""},
+				{"changed", "", "new", ""},
+				{"./changed", "20250101-030000", "old", ""},
+				{"gone", "20250102-030000", "", "gone was deleted as of web/data/20250102-030000.incr.tar.zst"},
+				{"gone", "", "recreated", ""},
+				{"missing", "", "", "missing not found"},
+			}
+
+			service := tb.service()
+			for _, tt := range tests {
+				var out bytes.Buffer
+				err := service.Cat(context.Background(), &CatOptions{
+					ServiceName: "web",
+					Path:        "data",
+					Timestamp:   tt.timestamp,
+					File:        tt.file,
+				}, &out)
+
+				if tt.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+						t.Errorf("Cat(%s at %q) error = %v, want %q", tt.file, tt.timestamp, err, tt.wantErr)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("Cat(%s at %q) error = %v", tt.file, tt.timestamp, err)
+					continue
+				}
+				if out.String() != tt.want {
+					t.Errorf("Cat(%s at %q) = %q, want %q", tt.file, tt.timestamp, out.String(), tt.want)
+				}
+			}
+		})
+	}
+}
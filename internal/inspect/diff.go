@@ -0,0 +1,211 @@
+package inspect
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"github.com/volcie/stash/internal/archive"
+	"github.com/volcie/stash/internal/config"
+	"github.com/volcie/stash/internal/storage"
+)
+
+// Changes reported by Diff
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// Differences found in modified entries
+const (
+	FieldType    = "type"
+	FieldSize    = "size"
+	FieldContent = "content"
+	FieldModTime = "mtime" // only reported when content can't be compared by checksum
+	FieldMode    = "mode"
+	FieldLink    = "link"
+)
+
+type DiffOptions struct {
+	ServiceName string
+	Path        string
+	From        string // timestamp of the backup to compare, the latest if empty
+	To          string // timestamp of the backup to compare with, the latest if empty
+	Live        bool   // compare with the live source path instead of a backup
+}
+
+// DiffSide describes one side of a comparison, a backup or the live source path
+type DiffSide struct {
+	Key       string `json:"key,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"`
+	Source    string `json:"source,omitempty"` // set when comparing with the live tree
+	Checksums bool   `json:"checksums"`        // false when some entries were read without a manifest
+}
+
+// Change is an entry that differs between both sides
+type Change struct {
+	Path   string                 `json:"path"`
+	Change string                 `json:"change"`           // see Change*
+	Fields []string               `json:"fields,omitempty"` // what differs in modified entries, see Field*
+	Old    *archive.ManifestEntry `json:"old,omitempty"`
+	New    *archive.ManifestEntry `json:"new,omitempty"`
+}
+
+type DiffResult struct {
+	From     DiffSide `json:"from"`
+	To       DiffSide `json:"to"`
+	Changes  []Change `json:"changes"`
+	Added    int      `json:"added"`
+	Removed  int      `json:"removed"`
+	Modified int      `json:"modified"`
+}
+
+// Diff compares the contents of a backup with another backup of the same path, or with the live
+// source path. Incremental and differential backups are compared as they would be restored.
+// Manifests are used when available, so usually no archive needs to be downloaded.
+func (s *Service) Diff(ctx context.Context, opts *DiffOptions) (*DiffResult, error) {
+	from, backups, err := s.FindBackup(ctx, opts.ServiceName, opts.Path, opts.From)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DiffResult{Changes: []Change{}}
+
+	oldFiles, checksums, err := s.loadState(ctx, backups, from)
+	if err != nil {
+		return nil, err
+	}
+	result.From = DiffSide{Key: from.Key, Timestamp: from.Date.Format(timestampLayout), Checksums: checksums}
+
+	var newFiles map[string]archive.ManifestEntry
+	if opts.Live {
+		sourcePath, exists := s.cfg.Services[opts.ServiceName].Paths[opts.Path]
+		if !exists {
+			return nil, fmt.Errorf("path %s of service %s not found in configuration", opts.Path, opts.ServiceName)
+		}
+
+		newFiles, err = s.scanSource(opts.ServiceName, opts.Path, sourcePath)
+		if err != nil {
+			return nil, err
+		}
+		result.To = DiffSide{Source: sourcePath, Checksums: true}
+	} else {
+		to, err := findBackup(backups, opts.ServiceName, opts.Path, opts.To)
+		if err != nil {
+			return nil, err
+		}
+
+		newFiles, checksums, err = s.loadState(ctx, backups, to)
+		if err != nil {
+			return nil, err
+		}
+		result.To = DiffSide{Key: to.Key, Timestamp: to.Date.Format(timestampLayout), Checksums: checksums}
+	}
+
+	for name, oldEntry := range oldFiles {
+		newEntry, exists := newFiles[name]
+		if !exists {
+			result.Changes = append(result.Changes, Change{Path: name, Change: ChangeRemoved, Old: &oldEntry})
+			result.Removed++
+			continue
+		}
+
+		if fields := compareEntries(oldEntry, newEntry); len(fields) > 0 {
+			result.Changes = append(result.Changes, Change{Path: name, Change: ChangeModified, Fields: fields, Old: &oldEntry, New: &newEntry})
+			result.Modified++
+		}
+	}
+
+	for name, newEntry := range newFiles {
+		if _, exists := oldFiles[name]; !exists {
+			result.Changes = append(result.Changes, Change{Path: name, Change: ChangeAdded, New: &newEntry})
+			result.Added++
+		}
+	}
+
+	sort.Slice(result.Changes, func(i, j int) bool {
+		return result.Changes[i].Path < result.Changes[j].Path
+	})
+
+	return result, nil
+}
+
+// loadState returns the entries a restore of backup would produce by path, replaying the backups it
+// builds on. Reports whether every layer had a manifest, i.e. whether files have checksums.
+func (s *Service) loadState(ctx context.Context, backups []*storage.BackupInfo, backup *storage.BackupInfo) (map[string]archive.ManifestEntry, bool, error) {
+	chain, err := storage.BackupChain(backups, backup)
+	if err != nil {
+		return nil, false, err
+	}
+
+	manifests := make([]*archive.Manifest, 0, len(chain))
+	checksums := true
+	for _, layer := range chain {
+		manifest, fromManifest, err := s.loadContents(ctx, layer)
+		if err != nil {
+			return nil, false, err
+		}
+		manifests = append(manifests, manifest)
+		checksums = checksums && fromManifest
+	}
+
+	return archive.MergeManifests(manifests), checksums, nil
+}
+
+// scanSource lists the live source path by entry path, with the same excludes as backups
+func (s *Service) scanSource(serviceName, pathName, sourcePath string) (map[string]archive.ManifestEntry, error) {
+	serviceConfig := s.cfg.Services[serviceName]
+
+	logrus.Infof("Scanning %s", sourcePath)
+
+	scanner := archive.NewArchiver(config.CompressionNone, false)
+	scanner.SetExcludes(serviceConfig.Exclude[pathName])
+
+	manifest, err := scanner.ScanTree(sourcePath, serviceConfig.IncludeFolders[pathName])
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", sourcePath, err)
+	}
+
+	files := make(map[string]archive.ManifestEntry, len(manifest.Files))
+	for _, entry := range manifest.Files {
+		files[archive.CleanEntryName(entry.Path)] = entry
+	}
+	return files, nil
+}
+
+// compareEntries returns what differs between two entries of the same path. Directory sizes and
+// modification times change with their contents, so only their type and mode are compared.
+func compareEntries(oldEntry, newEntry archive.ManifestEntry) []string {
+	var fields []string
+
+	if oldEntry.Type != newEntry.Type {
+		return []string{FieldType}
+	}
+
+	if oldEntry.Type == archive.EntryFile {
+		if oldEntry.Size != newEntry.Size {
+			fields = append(fields, FieldSize)
+		}
+
+		// Without both checksums, a new modification time is the only hint the content changed
+		if oldEntry.SHA256 != "" && newEntry.SHA256 != "" {
+			if oldEntry.SHA256 != newEntry.SHA256 {
+				fields = append(fields, FieldContent)
+			}
+		} else if !oldEntry.ModTime.Equal(newEntry.ModTime) {
+			fields = append(fields, FieldModTime)
+		}
+	}
+
+	if oldEntry.Mode != newEntry.Mode {
+		fields = append(fields, FieldMode)
+	}
+
+	if oldEntry.Link != newEntry.Link {
+		fields = append(fields, FieldLink)
+	}
+
+	return fields
+}
@@ -0,0 +1,114 @@
+package inspect
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/volcie/stash/internal/archive"
+	"github.com/volcie/stash/internal/config"
+)
+
+func TestCompareEntries(t *testing.T) {
+	mtime := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	file := archive.ManifestEntry{Path: "file", Type: archive.EntryFile, Size: 7, Mode: 0644, ModTime: mtime, SHA256: "aaaa"}
+	dir := archive.ManifestEntry{Path: "dir", Type: archive.EntryDir, Size: 0, Mode: 0755, ModTime: mtime}
+	link := archive.ManifestEntry{Path: "link", Type: archive.EntrySymlink, Mode: 0777, ModTime: mtime, Link: "file"}
+
+	with := func(entry archive.ManifestEntry, change func(*archive.ManifestEntry)) archive.ManifestEntry {
+		change(&entry)
+		return entry
+	}
+
+	tests := []struct {
+		name     string
+		old, new archive.ManifestEntry
+		want     []string
+	}{
+		{"unchanged", file, file, nil},
+		{"content", file, with(file, func(e *archive.ManifestEntry) { e.SHA256 = "bbbb" }), []string{FieldContent}},
+		{"size and content", file, with(file, func(e *archive.ManifestEntry) { e.Size, e.SHA256 = 8, "bbbb" }), []string{FieldSize, FieldContent}},
+		{"touched with the same content", file, with(file, func(e *archive.ManifestEntry) { e.ModTime = mtime.Add(time.Hour) }), nil},
+		{"mtime without checksums", with(file, func(e *archive.ManifestEntry) { e.SHA256 = "" }), with(file, func(e *archive.ManifestEntry) { e.ModTime = mtime.Add(time.Hour) }), []string{FieldModTime}},
+		{"mode", file, with(file, func(e *archive.ManifestEntry) { e.Mode = 0600 }), []string{FieldMode}},
+		{"file became a directory", file, with(dir, func(e *archive.ManifestEntry) { e.Path = "file" }), []string{FieldType}},
+		{"directory became a symlink", dir, with(link, func(e *archive.ManifestEntry) { e.Path = "dir" }), []string{FieldType}},
+		{"directory contents changed", dir, with(dir, func(e *archive.ManifestEntry) { e.Size, e.ModTime = 4096, mtime.Add(time.Hour) }), nil},
+		{"symlink target", link, with(link, func(e *archive.ManifestEntry) { e.Link = "other" }), []string{FieldLink}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := compareEntries(tt.old, tt.new)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("compareEntries() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffBackupChains(t *testing.T) {
+	for _, withManifest := range []bool{true, false} {
+		name := "without manifests"
+		if withManifest {
+			name = "with manifests"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			tb := newTestBackups(t)
+			tb.write("unchanged", "same")
+			tb.write("modified", "old")
+			tb.write("removed", "gone soon")
+			tb.write("removed-dir/file", "gone soon")
+			tb.write("became-dir", "a file")
+			tb.backup("20250101-030000", config.BackupModeFull, withManifest)
+
+			tb.write("modified", "new content")
+			tb.remove("removed")
+			tb.remove("removed-dir")
+			tb.remove("became-dir")
+			tb.write("became-dir/file", "now a directory")
+			tb.backup("20250102-030000", config.BackupModeIncremental, withManifest)
+
+			tb.write("added", "new")
+			tb.write("removed", "back again")
+			tb.backup("20250103-030000", config.BackupModeIncremental, withManifest)
+
+			tests := []struct {
+				from, to string
+				want     []string // path:change
+			}{
+				{
+					"20250101-030000", "20250102-030000",
+					[]string{"became-dir:modified", "became-dir/file:added", "modified:modified", "removed:removed", "removed-dir:removed", "removed-dir/file:removed"},
+				},
+				{
+					// The file deleted by the middle layer is back, only its content differs
+					"20250101-030000", "20250103-030000",
+					[]string{"added:added", "became-dir:modified", "became-dir/file:added", "modified:modified", "removed:modified", "removed-dir:removed", "removed-dir/file:removed"},
+				},
+				{"20250103-030000", "20250103-030000", nil},
+			}
+
+			service := tb.service()
+			for _, tt := range tests {
+				result, err := service.Diff(context.Background(), &DiffOptions{ServiceName: "web", Path: "data", From: tt.from, To: tt.to})
+				if err != nil {
+					t.Fatalf("Diff(%s, %s) error = %v", tt.from, tt.to, err)
+				}
+				if result.From.Checksums != withManifest || result.To.Checksums != withManifest {
+					t.Errorf("Diff(%s, %s) checksums = %v/%v, want %v", tt.from, tt.to, result.From.Checksums, result.To.Checksums, withManifest)
+				}
+
+				var got []string
+				for _, change := range result.Changes {
+					got = append(got, change.Path+":"+change.Change)
+				}
+				if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+					t.Errorf("Diff(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+				}
+			}
+		})
+	}
+}
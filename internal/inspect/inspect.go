@@ -0,0 +1,153 @@
+package inspect
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/volcie/stash/internal/archive"
+	"github.com/volcie/stash/internal/config"
+	"github.com/volcie/stash/internal/dedup"
+	"github.com/volcie/stash/internal/storage"
+)
+
+// timestampLayout is the timestamp format of backup keys
+const timestampLayout = "20060102-150405"
+
+// Service reads the contents of stored backups without restoring them
+type Service struct {
+	cfg      *config.Config
+	backend  storage.Backend
+	archiver *archive.Archiver
+}
+
+type ListOptions struct {
+	ServiceName string
+	Path        string
+	Timestamp   string   // YYYYMMDD-HHMMSS, the latest backup if empty
+	Patterns    []string // glob patterns of the entries to list, everything if empty
+}
+
+// Listing is the contents of a single backup
+type Listing struct {
+	Backup       *storage.BackupInfo
+	FromManifest bool // false when the entries were read from the archive headers, without checksums
+	Entries      []archive.ManifestEntry
+}
+
+// NewService creates a service reading backups from the named destination, the first if empty
+func NewService(cfg *config.Config, destination string) (*Service, error) {
+	backend, err := storage.NewBackendByName(cfg, destination)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage backend: %w", err)
+	}
+
+	identities, err := archive.LoadIdentities(cfg.Backup.Encryption)
+	if err != nil {
+		backend.Close()
+		return nil, fmt.Errorf("failed to load decryption keys: %w", err)
+	}
+
+	archiver := archive.NewArchiver(cfg.Backup.CompressionFormat(), false)
+	archiver.SetIdentities(identities)
+
+	return &Service{
+		cfg:      cfg,
+		backend:  backend,
+		archiver: archiver,
+	}, nil
+}
+
+// Close releases the connection to the storage backend
+func (s *Service) Close() {
+	if err := s.backend.Close(); err != nil {
+		logrus.Warnf("Failed to close connection to %s: %v", s.backend.Location(), err)
+	}
+}
+
+// FindBackup returns the backup of a service path taken at timestamp, or the latest one if
+// timestamp is empty, along with every backup of the service
+func (s *Service) FindBackup(ctx context.Context, serviceName, pathName, timestamp string) (*storage.BackupInfo, []*storage.BackupInfo, error) {
+	backups, err := s.backend.List(ctx, serviceName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	backup, err := findBackup(backups, serviceName, pathName, timestamp)
+	if err != nil {
+		return nil, nil, err
+	}
+	return backup, backups, nil
+}
+
+// findBackup returns the backup of a service path taken at timestamp, or the latest one if timestamp is empty
+func findBackup(backups []*storage.BackupInfo, serviceName, pathName, timestamp string) (*storage.BackupInfo, error) {
+	var found *storage.BackupInfo
+	for _, backup := range backups {
+		if backup.Path != pathName {
+			continue
+		}
+		if timestamp != "" && backup.Date.Format(timestampLayout) == timestamp {
+			return backup, nil
+		}
+		if timestamp == "" && (found == nil || backup.Date.After(found.Date)) {
+			found = backup
+		}
+	}
+
+	if found == nil {
+		if timestamp != "" {
+			return nil, fmt.Errorf("no backup of %s:%s found at %s", serviceName, pathName, timestamp)
+		}
+		return nil, fmt.Errorf("no backups found for %s:%s", serviceName, pathName)
+	}
+	return found, nil
+}
+
+// ListFiles lists the entries of a backup matching the patterns. The manifest is used when there
+// is one, otherwise the archive is streamed and only its headers are read.
+func (s *Service) ListFiles(ctx context.Context, opts *ListOptions) (*Listing, error) {
+	backup, _, err := s.FindBackup(ctx, opts.ServiceName, opts.Path, opts.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	listing := &Listing{Backup: backup}
+
+	manifest, fromManifest, err := s.loadContents(ctx, backup)
+	if err != nil {
+		return nil, err
+	}
+	listing.FromManifest = fromManifest
+
+	filter := archive.NewPathFilter(opts.Patterns)
+	for _, entry := range manifest.Files {
+		if filter.Match(entry.Path, entry.Type == archive.EntryDir) {
+			listing.Entries = append(listing.Entries, entry)
+		}
+	}
+
+	return listing, nil
+}
+
+// loadContents returns the manifest of a backup, or one read from the archive headers (without
+// checksums) when it has none, reporting which one it is
+func (s *Service) loadContents(ctx context.Context, backup *storage.BackupInfo) (*archive.Manifest, bool, error) {
+	manifest, err := s.archiver.LoadManifest(ctx, s.backend, backup)
+	if err == nil {
+		return manifest, true, nil
+	}
+	logrus.Infof("No usable manifest for %s, reading the archive: %v", backup.Key, err)
+
+	reader, _, err := dedup.OpenBackup(ctx, s.backend, s.archiver, backup)
+	if err != nil {
+		return nil, false, err
+	}
+	defer reader.Close()
+
+	manifest, err = s.archiver.ListArchive(reader)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read archive %s: %w", backup.Key, err)
+	}
+	return manifest, false, nil
+}
@@ -0,0 +1,154 @@
+package inspect
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/volcie/stash/internal/archive"
+	"github.com/volcie/stash/internal/config"
+	"github.com/volcie/stash/internal/storage"
+)
+
+// testBackups takes backups of a source directory into a local store, the way backup does
+type testBackups struct {
+	t        *testing.T
+	source   string
+	root     string // of the local store
+	backend  *storage.LocalClient
+	snapshot *archive.Snapshot // of the last backup, the base of the next incremental
+}
+
+func newTestBackups(t *testing.T) *testBackups {
+	t.Helper()
+
+	root := t.TempDir()
+	backend, err := storage.NewLocalClient(root, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testBackups{t: t, source: t.TempDir(), root: root, backend: backend}
+}
+
+func (tb *testBackups) write(name, content string) {
+	tb.t.Helper()
+	path := filepath.Join(tb.source, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		tb.t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		tb.t.Fatal(err)
+	}
+}
+
+func (tb *testBackups) remove(name string) {
+	tb.t.Helper()
+	if err := os.RemoveAll(filepath.Join(tb.source, name)); err != nil {
+		tb.t.Fatal(err)
+	}
+}
+
+// backup archives the source as a backup of web/data, uploading its manifest if withManifest
+func (tb *testBackups) backup(timestamp, kind string, withManifest bool) {
+	tb.t.Helper()
+	ctx := context.Background()
+
+	archiver := archive.NewArchiver(config.CompressionZstd, false)
+	archiver.SetRecordSnapshot(true)
+	if kind != config.BackupModeFull {
+		archiver.SetBaseSnapshot(tb.snapshot)
+	}
+
+	var buf bytes.Buffer
+	stats, err := archiver.CreateArchive(&buf, tb.source, nil)
+	if err != nil {
+		tb.t.Fatalf("CreateArchive() error = %v", err)
+	}
+	tb.snapshot = stats.Snapshot
+
+	ext := storage.KeyExtension(kind, archiver.Extension())
+	if _, err := tb.backend.UploadWithTimestamp(ctx, &buf, "web", "data", timestamp, ext); err != nil {
+		tb.t.Fatalf("UploadWithTimestamp() error = %v", err)
+	}
+
+	if !withManifest {
+		return
+	}
+	var manifest bytes.Buffer
+	if err := archiver.WriteManifest(&manifest, stats.Manifest); err != nil {
+		tb.t.Fatal(err)
+	}
+	ext = storage.KeyExtension(kind, storage.ManifestExtension)
+	if _, err := tb.backend.UploadWithTimestamp(ctx, &manifest, "web", "data", timestamp, ext); err != nil {
+		tb.t.Fatalf("UploadWithTimestamp() manifest error = %v", err)
+	}
+}
+
+func (tb *testBackups) service() *Service {
+	return &Service{
+		cfg:      &config.Config{},
+		backend:  tb.backend,
+		archiver: archive.NewArchiver(config.CompressionZstd, false),
+	}
+}
+
+func TestListFilesWithoutManifest(t *testing.T) {
+	tb := newTestBackups(t)
+	tb.write("index.html", "<html>")
+	tb.write("uploads/2025/photo.jpg", "jpeg")
+	tb.write("uploads/2025/notes.txt", "text")
+	if err := os.Symlink("index.html", filepath.Join(tb.source, "home.html")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(tb.source, "index.html"), filepath.Join(tb.source, "copy.html")); err != nil {
+		t.Fatal(err)
+	}
+	tb.backup("20250101-030000", config.BackupModeFull, true)
+
+	for _, patterns := range [][]string{nil, {"/uploads", "!*.txt"}} {
+		service := tb.service()
+		opts := &ListOptions{ServiceName: "web", Path: "data", Patterns: patterns}
+
+		withManifest, err := service.ListFiles(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("ListFiles() error = %v", err)
+		}
+		if !withManifest.FromManifest {
+			t.Fatal("listing wasn't read from the manifest")
+		}
+
+		manifestPath := filepath.Join(tb.root, filepath.FromSlash(storage.ManifestKey(withManifest.Backup.Key)))
+		data, err := os.ReadFile(manifestPath)
+		if err != nil {
+			t.Fatalf("manifest not stored at %s: %v", manifestPath, err)
+		}
+		if err := os.Remove(manifestPath); err != nil {
+			t.Fatal(err)
+		}
+
+		withoutManifest, err := service.ListFiles(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("ListFiles() without manifest error = %v", err)
+		}
+		if withoutManifest.FromManifest {
+			t.Error("listing claims to come from a deleted manifest")
+		}
+
+		if len(withManifest.Entries) != len(withoutManifest.Entries) {
+			t.Fatalf("patterns %v: %d entries with the manifest, %d without", patterns, len(withManifest.Entries), len(withoutManifest.Entries))
+		}
+		for i, want := range withManifest.Entries {
+			got := withoutManifest.Entries[i]
+			if got.Path != want.Path || got.Type != want.Type || got.Size != want.Size ||
+				got.Mode != want.Mode || got.Link != want.Link || !got.ModTime.Equal(want.ModTime) {
+				t.Errorf("patterns %v: entry %d is %+v without the manifest, %+v with it", patterns, i, got, want)
+			}
+		}
+
+		if err := os.WriteFile(manifestPath, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
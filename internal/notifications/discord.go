@@ -82,6 +82,9 @@ func (d *DiscordNotifier) SendBackupNotification(notifType NotificationType, ser
 	case Warning:
 		title = "Backup Warning"
 		description = fmt.Sprintf("Warning during %s for service: **%s**", operation, service)
+		if err != nil {
+			description += fmt.Sprintf("\n\n**Warning:** ```%s```", err.Error())
+		}
 		color = 0xffff00 // Yellow
 	}
 
@@ -0,0 +1,23 @@
+//go:build linux
+
+package restore
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// exchangePaths atomically swaps two existing paths with renameat2(RENAME_EXCHANGE), so neither
+// is ever missing. Returns errExchangeUnsupported when the kernel or filesystem can't do it.
+func exchangePaths(oldPath, newPath string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, oldPath, unix.AT_FDCWD, newPath, unix.RENAME_EXCHANGE)
+	if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EOPNOTSUPP) {
+		return errExchangeUnsupported
+	}
+	if err != nil {
+		return &os.LinkError{Op: "exchange", Old: oldPath, New: newPath, Err: err}
+	}
+	return nil
+}
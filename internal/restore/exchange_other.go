@@ -0,0 +1,8 @@
+//go:build !linux
+
+package restore
+
+// exchangePaths has no atomic implementation on this platform, swaps go through renames
+func exchangePaths(oldPath, newPath string) error {
+	return errExchangeUnsupported
+}
@@ -13,24 +13,32 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/volcie/stash/internal/archive"
 	"github.com/volcie/stash/internal/config"
+	"github.com/volcie/stash/internal/dedup"
 	"github.com/volcie/stash/internal/notifications"
 	"github.com/volcie/stash/internal/storage"
 )
 
 type Service struct {
 	cfg      *config.Config
-	s3Client *storage.S3Client
+	backend  storage.Backend
 	notifier *notifications.DiscordNotifier
 }
 
 type RestoreOptions struct {
 	ServiceName string
 	FromS3      bool
-	FromLocal   string
+	FromLocal   string // raw archive file to restore from
+	LocalStore  bool   // restore from archives kept in backup.local_dir
+	Paths       []string
+	Include     []string // glob patterns of the entries to restore, everything if empty
+	Files       []string // names of single files to restore, along with Include
+	Destination string   // named destination to restore from, default is the first
 	Date        string
 	Latest      bool
 	DryRun      bool
 	Force       bool
+	Staged      bool // extract next to the destination and swap it into place once verified
+	Rollback    bool // undo the last staged restore instead of restoring
 	DestPath    string
 }
 
@@ -43,12 +51,16 @@ type RestoreResult struct {
 	Error       error
 }
 
-func NewService(cfg *config.Config, noNotify bool) (*Service, error) {
-	s3Client, err := storage.NewS3Client(cfg.S3.Bucket, cfg.S3.Prefix)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+// includePatterns returns the patterns selecting the entries to restore, nil to restore everything
+func (o *RestoreOptions) includePatterns() []string {
+	patterns := append([]string(nil), o.Include...)
+	for _, file := range o.Files {
+		patterns = append(patterns, archive.LiteralPattern(file))
 	}
+	return patterns
+}
 
+func NewService(cfg *config.Config, noNotify bool) (*Service, error) {
 	var notifier *notifications.DiscordNotifier
 	if !noNotify && cfg.Notifications.DiscordWebhook != "" {
 		notifier = notifications.NewDiscordNotifier(
@@ -59,13 +71,49 @@ func NewService(cfg *config.Config, noNotify bool) (*Service, error) {
 		)
 	}
 
+	// The storage backend is connected lazily so local restores work while remote storage is unreachable
 	return &Service{
 		cfg:      cfg,
-		s3Client: s3Client,
 		notifier: notifier,
 	}, nil
 }
 
+// Close releases the connection to the remote storage, if one was made
+func (s *Service) Close() {
+	if s.backend == nil {
+		return
+	}
+	if err := s.backend.Close(); err != nil {
+		logrus.Warnf("Failed to close connection to %s: %v", s.backend.Location(), err)
+	}
+	s.backend = nil
+}
+
+// getBackend returns the remote storage backend for a destination, connecting on first use
+func (s *Service) getBackend(destination string) (storage.Backend, error) {
+	if s.backend == nil {
+		backend, err := storage.NewBackendByName(s.cfg, destination)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create storage backend: %w", err)
+		}
+		s.backend = backend
+	}
+	return s.backend, nil
+}
+
+// getSource returns the storage backups are restored from
+func (s *Service) getSource(opts *RestoreOptions) (storage.Backend, error) {
+	if !opts.LocalStore {
+		return s.getBackend(opts.Destination)
+	}
+
+	localStore, err := storage.NewLocalClient(s.cfg.Backup.LocalArchiveDir(), "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open local archive directory: %w", err)
+	}
+	return localStore, nil
+}
+
 func (s *Service) RestoreService(ctx context.Context, opts *RestoreOptions) ([]*RestoreResult, error) {
 	serviceConfig, exists := s.cfg.Services[opts.ServiceName]
 	if !exists {
@@ -78,8 +126,17 @@ func (s *Service) RestoreService(ctx context.Context, opts *RestoreOptions) ([]*
 		return s.restoreFromLocal(opts)
 	}
 
-	// Get available backups from S3
-	backups, err := s.s3Client.List(ctx, opts.ServiceName)
+	if opts.Rollback {
+		return s.rollbackService(serviceConfig, opts)
+	}
+
+	source, err := s.getSource(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get available backups from storage
+	backups, err := source.List(ctx, opts.ServiceName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list backups: %w", err)
 	}
@@ -108,7 +165,14 @@ func (s *Service) RestoreService(ctx context.Context, opts *RestoreOptions) ([]*
 			destPath = filepath.Join(opts.DestPath, backup.Path)
 		}
 
-		result := s.restoreBackup(ctx, backup, destPath, opts)
+		// Incremental and differential backups are restored on top of the backups they build on
+		chain, err := storage.BackupChain(backups, backup)
+		var result *RestoreResult
+		if err != nil {
+			result = &RestoreResult{Service: backup.Service, Path: backup.Path, BackupInfo: backup, RestorePath: destPath, Error: err}
+		} else {
+			result = s.restoreBackup(ctx, source, chain, destPath, opts)
+		}
 		results = append(results, result)
 
 		// Send notifications (skip during dry run)
@@ -125,6 +189,20 @@ func (s *Service) RestoreService(ctx context.Context, opts *RestoreOptions) ([]*
 }
 
 func (s *Service) selectBackups(backups []*storage.BackupInfo, opts *RestoreOptions) []*storage.BackupInfo {
+	// Filter by path if specified
+	if len(opts.Paths) > 0 {
+		var pathFiltered []*storage.BackupInfo
+		for _, backup := range backups {
+			for _, pathName := range opts.Paths {
+				if backup.Path == pathName {
+					pathFiltered = append(pathFiltered, backup)
+					break
+				}
+			}
+		}
+		backups = pathFiltered
+	}
+
 	var filtered []*storage.BackupInfo
 
 	// Filter by date if specified
@@ -180,8 +258,10 @@ func (s *Service) selectBackups(backups []*storage.BackupInfo, opts *RestoreOpti
 	return selected
 }
 
-func (s *Service) restoreBackup(ctx context.Context, backup *storage.BackupInfo, destPath string, opts *RestoreOptions) *RestoreResult {
+// restoreBackup restores the last backup of chain, extracting every backup of the chain in order
+func (s *Service) restoreBackup(ctx context.Context, source storage.Backend, chain []*storage.BackupInfo, destPath string, opts *RestoreOptions) *RestoreResult {
 	startTime := time.Now()
+	backup := chain[len(chain)-1]
 
 	result := &RestoreResult{
 		Service:     backup.Service,
@@ -192,8 +272,18 @@ func (s *Service) restoreBackup(ctx context.Context, backup *storage.BackupInfo,
 
 	logrus.Infof("Restoring %s:%s to %s", backup.Service, backup.Path, destPath)
 
+	includes := opts.includePatterns()
+	if len(includes) > 0 {
+		logrus.Infof("Restoring only entries matching %v", includes)
+	}
+
 	if opts.DryRun {
 		logrus.Infof("[DRY RUN] Would restore backup %s to %s", backup.Key, destPath)
+		if len(chain) > 1 {
+			for _, layer := range chain[:len(chain)-1] {
+				logrus.Infof("[DRY RUN]   on top of %s backup %s", layer.Kind, layer.Key)
+			}
+		}
 		result.Duration = time.Since(startTime)
 		return result
 	}
@@ -206,15 +296,72 @@ func (s *Service) restoreBackup(ctx context.Context, backup *storage.BackupInfo,
 		}
 	}
 
-	// Create destination directory
-	if err := os.MkdirAll(destPath, 0755); err != nil {
-		result.Error = fmt.Errorf("failed to create destination directory: %w", err)
-		return result
+	if opts.Staged {
+		if err := s.restoreStaged(ctx, source, chain, destPath); err != nil {
+			result.Error = err
+			return result
+		}
+	} else {
+		// Create destination directory
+		if err := os.MkdirAll(destPath, 0755); err != nil {
+			result.Error = fmt.Errorf("failed to create destination directory: %w", err)
+			return result
+		}
+
+		extracted, err := s.extractChain(ctx, source, chain, destPath, includes)
+		if err != nil {
+			result.Error = err
+			return result
+		}
+
+		if len(includes) > 0 && extracted == 0 {
+			result.Error = fmt.Errorf("no entries in the backup match %v", includes)
+			return result
+		}
 	}
 
-	// Download from S3 with progress bar
+	result.Duration = time.Since(startTime)
+
+	logrus.Infof("Restore completed for %s:%s in %v", backup.Service, backup.Path, result.Duration)
+	return result
+}
+
+// extractChain extracts every backup of chain into destPath in order, returning the number of entries extracted
+func (s *Service) extractChain(ctx context.Context, source storage.Backend, chain []*storage.BackupInfo, destPath string, includes []string) (int, error) {
+	if len(chain) > 1 {
+		logrus.Infof("Restoring %d backups: %s backup %s and %d later backups", len(chain), chain[0].Kind, chain[0].Key, len(chain)-1)
+	}
+
+	var extracted int
+	for _, layer := range chain {
+		stats, err := s.extractBackup(ctx, source, layer, destPath, includes)
+		if err != nil {
+			return extracted, err
+		}
+		extracted += stats.Entries
+	}
+
+	return extracted, nil
+}
+
+// extractBackup downloads a single backup and extracts the entries matching includes into destPath,
+// skipping the others as the archive streams by
+func (s *Service) extractBackup(ctx context.Context, source storage.Backend, backup *storage.BackupInfo, destPath string, includes []string) (*archive.ExtractStats, error) {
+	archiver, err := s.newArchiver()
+	if err != nil {
+		return nil, err
+	}
+	archiver.SetIncludes(includes)
+
+	reader, size, err := dedup.OpenBackup(ctx, source, archiver, backup)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// Download from storage with progress bar
 	fmt.Println() // Add line break before progress bar
-	downloadProgressBar := progressbar.NewOptions(int(backup.Size),
+	downloadProgressBar := progressbar.NewOptions(int(size),
 		progressbar.OptionSetDescription(fmt.Sprintf("Downloading %s/%s", backup.Service, backup.Path)),
 		progressbar.OptionSetWidth(40),
 		progressbar.OptionShowBytes(true),
@@ -227,13 +374,6 @@ func (s *Service) restoreBackup(ctx context.Context, backup *storage.BackupInfo,
 		}),
 	)
 
-	reader, err := s.s3Client.Download(ctx, backup.Key)
-	if err != nil {
-		result.Error = fmt.Errorf("failed to download backup: %w", err)
-		return result
-	}
-	defer reader.Close()
-
 	// Wrap reader with progress tracking
 	progressReader := &progressReadCloser{
 		ReadCloser:  reader,
@@ -263,20 +403,16 @@ func (s *Service) restoreBackup(ctx context.Context, backup *storage.BackupInfo,
 		}),
 	)
 
-	archiver := archive.NewArchiver(s.cfg.Backup.Compression, s.cfg.Backup.PreserveACLs)
-	if err := archiver.ExtractArchiveWithProgress(extractionReader, destPath, extractProgressBar); err != nil {
-		result.Error = fmt.Errorf("failed to extract archive: %w", err)
-		return result
+	stats, err := archiver.ExtractArchiveWithProgress(extractionReader, destPath, extractProgressBar)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract archive %s: %w", backup.Key, err)
 	}
 
 	// Finish extraction progress bar
 	extractProgressBar.Finish()
 	fmt.Println() // Add newline after progress bar
 
-	result.Duration = time.Since(startTime)
-
-	logrus.Infof("Restore completed for %s:%s in %v", backup.Service, backup.Path, result.Duration)
-	return result
+	return stats, nil
 }
 
 func (s *Service) restoreFromLocal(opts *RestoreOptions) ([]*RestoreResult, error) {
@@ -333,12 +469,25 @@ func (s *Service) restoreFromLocal(opts *RestoreOptions) ([]*RestoreResult, erro
 		}),
 	)
 
-	archiver := archive.NewArchiver(s.cfg.Backup.Compression, s.cfg.Backup.PreserveACLs)
-	if err := archiver.ExtractArchiveWithProgress(file, destPath, extractProgressBar); err != nil {
+	archiver, err := s.newArchiver()
+	if err != nil {
+		result.Error = err
+		return []*RestoreResult{result}, nil
+	}
+	includes := opts.includePatterns()
+	archiver.SetIncludes(includes)
+
+	stats, err := archiver.ExtractArchiveWithProgress(file, destPath, extractProgressBar)
+	if err != nil {
 		result.Error = fmt.Errorf("failed to extract archive: %w", err)
 		return []*RestoreResult{result}, nil
 	}
 
+	if len(includes) > 0 && stats.Entries == 0 {
+		result.Error = fmt.Errorf("no entries in the archive match %v", includes)
+		return []*RestoreResult{result}, nil
+	}
+
 	// Finish extraction progress bar
 	extractProgressBar.Finish()
 	fmt.Println() // Add newline after progress bar
@@ -349,6 +498,19 @@ func (s *Service) restoreFromLocal(opts *RestoreOptions) ([]*RestoreResult, erro
 	return []*RestoreResult{result}, nil
 }
 
+// newArchiver creates an archiver able to decrypt archives with the configured keys
+func (s *Service) newArchiver() (*archive.Archiver, error) {
+	identities, err := archive.LoadIdentities(s.cfg.Backup.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load decryption keys: %w", err)
+	}
+
+	archiver := archive.NewArchiver(s.cfg.Backup.CompressionFormat(), s.cfg.Backup.PreserveACLs)
+	archiver.SetIdentities(identities)
+	archiver.SetPreserveOwnership(s.cfg.Backup.PreserveOwner)
+	return archiver, nil
+}
+
 func (s *Service) sendNotification(notifType notifications.NotificationType, serviceName, operation string, result *RestoreResult, err error) {
 	if s.notifier == nil {
 		return
@@ -365,7 +527,7 @@ func (s *Service) sendNotification(notifType notifications.NotificationType, ser
 
 	if result.BackupInfo != nil {
 		details["Backup Date"] = result.BackupInfo.Date.Format("2006-01-02 15:04:05")
-		details["S3 Key"] = result.BackupInfo.Key
+		details["Backup Key"] = result.BackupInfo.Key
 	}
 
 	s.notifier.SendBackupNotification(notifType, serviceName, operation, details, err)
@@ -0,0 +1,130 @@
+package restore
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/volcie/stash/internal/archive"
+	"github.com/volcie/stash/internal/config"
+	"github.com/volcie/stash/internal/storage"
+)
+
+// uploadArchive archives source and stores it in backend as a backup of web/data
+func uploadArchive(t *testing.T, backend storage.Backend, archiver *archive.Archiver, source, timestamp, kind string) *archive.ArchiveStats {
+	t.Helper()
+
+	var buf bytes.Buffer
+	stats, err := archiver.CreateArchive(&buf, source, nil)
+	if err != nil {
+		t.Fatalf("CreateArchive() error = %v", err)
+	}
+
+	ext := storage.KeyExtension(kind, archiver.Extension())
+	if _, err := backend.UploadWithTimestamp(context.Background(), &buf, "web", "data", timestamp, ext); err != nil {
+		t.Fatalf("UploadWithTimestamp() error = %v", err)
+	}
+	return stats
+}
+
+func TestExtractChainAppliesDeletions(t *testing.T) {
+	ctx := context.Background()
+	source := t.TempDir()
+	for name, content := range map[string]string{
+		"kept":             "kept",
+		"changed":          "old",
+		"deleted":          "deleted",
+		"dir/nested":       "nested",
+		"removed/a":        "a",
+		"removed/deeper/b": "b",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(source, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(source, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backend, err := storage.NewLocalClient(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full := archive.NewArchiver(config.CompressionZstd, false)
+	full.SetRecordSnapshot(true)
+	fullStats := uploadArchive(t, backend, full, source, "20250101-030000", config.BackupModeFull)
+
+	// The first incremental deletes a file and a directory, the second one recreates a deleted file
+	if err := os.WriteFile(filepath.Join(source, "changed"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"deleted", "removed"} {
+		if err := os.RemoveAll(filepath.Join(source, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := archive.NewArchiver(config.CompressionZstd, false)
+	first.SetBaseSnapshot(fullStats.Snapshot)
+	firstStats := uploadArchive(t, backend, first, source, "20250102-030000", config.BackupModeIncremental)
+
+	if err := os.WriteFile(filepath.Join(source, "removed"), []byte("now a file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	second := archive.NewArchiver(config.CompressionZstd, false)
+	second.SetBaseSnapshot(firstStats.Snapshot)
+	uploadArchive(t, backend, second, source, "20250103-030000", config.BackupModeIncremental)
+
+	backups, err := backend.List(ctx, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var target *storage.BackupInfo
+	for _, backup := range backups {
+		if backup.Date.Day() == 3 {
+			target = backup
+		}
+	}
+	if target == nil {
+		t.Fatalf("latest backup missing from %d listed backups", len(backups))
+	}
+
+	chain, err := storage.BackupChain(backups, target)
+	if err != nil {
+		t.Fatalf("BackupChain() error = %v", err)
+	}
+	if len(chain) != 3 {
+		t.Fatalf("BackupChain() returned %d backups, want 3", len(chain))
+	}
+
+	// A file that only exists in the restore target, deletions leave it alone
+	destPath := filepath.Join(t.TempDir(), "data")
+	writeMarker(t, destPath, "local")
+
+	service := &Service{cfg: &config.Config{}}
+	if _, err := service.extractChain(ctx, backend, chain, destPath, nil); err != nil {
+		t.Fatalf("extractChain() error = %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"kept":       "kept",
+		"changed":    "new",
+		"dir/nested": "nested",
+		"removed":    "now a file",
+		"marker":     "local",
+	} {
+		data, err := os.ReadFile(filepath.Join(destPath, name))
+		if err != nil {
+			t.Errorf("%s not restored: %v", name, err)
+			continue
+		}
+		if string(data) != want {
+			t.Errorf("%s holds %q, want %q", name, data, want)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(destPath, "deleted")); !os.IsNotExist(err) {
+		t.Errorf("deleted file was restored: %v", err)
+	}
+}
@@ -0,0 +1,333 @@
+package restore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/volcie/stash/internal/archive"
+	"github.com/volcie/stash/internal/config"
+	"github.com/volcie/stash/internal/dedup"
+	"github.com/volcie/stash/internal/notifications"
+	"github.com/volcie/stash/internal/storage"
+)
+
+// Staged restores extract into a sibling of the destination, so it can be renamed into place,
+// and keep the tree they replace next to it until the next staged restore
+const (
+	stagingSuffix  = ".stash-staging"
+	rollbackSuffix = ".stash-rollback"
+)
+
+// errExchangeUnsupported is returned by exchangePaths when two paths can't be swapped atomically
+var errExchangeUnsupported = errors.New("atomic exchange not supported")
+
+func stagingPath(destPath string) string {
+	return filepath.Clean(destPath) + stagingSuffix
+}
+
+func rollbackPath(destPath string) string {
+	return filepath.Clean(destPath) + rollbackSuffix
+}
+
+// restoreStaged extracts chain into a staging directory next to destPath, verifies it against the
+// manifests of the chain and swaps it into place, moving the current tree aside as a rollback.
+// Until the swap, a failed restore leaves destPath untouched.
+func (s *Service) restoreStaged(ctx context.Context, source storage.Backend, chain []*storage.BackupInfo, destPath string) error {
+	staging := stagingPath(destPath)
+
+	// Left over by an interrupted restore
+	if err := os.RemoveAll(staging); err != nil {
+		return fmt.Errorf("failed to remove previous staging directory %s: %w", staging, err)
+	}
+
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+
+	logrus.Infof("Staging restore in %s", staging)
+
+	if _, err := s.extractChain(ctx, source, chain, staging, nil); err != nil {
+		removeStaging(staging)
+		return err
+	}
+
+	if err := s.verifyStaging(ctx, source, chain, staging); err != nil {
+		removeStaging(staging)
+		return fmt.Errorf("%w, %s was left untouched", err, destPath)
+	}
+
+	if err := swapIntoPlace(staging, destPath); err != nil {
+		removeStaging(staging)
+		return err
+	}
+
+	return nil
+}
+
+// verifyStaging checks that every entry of the restored backup exists in the staging directory and
+// that regular files match their checksum. Backups without a manifest are read again to compute one.
+func (s *Service) verifyStaging(ctx context.Context, source storage.Backend, chain []*storage.BackupInfo, staging string) error {
+	archiver, err := s.newArchiver()
+	if err != nil {
+		return err
+	}
+
+	manifests := make([]*archive.Manifest, 0, len(chain))
+	for _, layer := range chain {
+		manifest, err := archiver.LoadManifest(ctx, source, layer)
+		if err != nil {
+			logrus.Infof("No usable manifest for %s, reading the archive again to verify the staged restore: %v", layer.Key, err)
+			if manifest, err = checksumBackup(ctx, source, archiver, layer); err != nil {
+				return err
+			}
+		}
+		manifests = append(manifests, manifest)
+	}
+
+	expected := archive.MergeManifests(manifests)
+
+	var problems int
+	for name, entry := range expected {
+		// Device nodes and fifos may be skipped on extraction, e.g. when not running as root
+		switch entry.Type {
+		case archive.EntryFile, archive.EntryDir, archive.EntrySymlink, archive.EntryHardlink:
+		default:
+			continue
+		}
+
+		target := filepath.Join(staging, filepath.FromSlash(name))
+		info, err := os.Lstat(target)
+		if err != nil {
+			logrus.Errorf("Staged restore is missing %s", name)
+			problems++
+			continue
+		}
+
+		if entry.Type != archive.EntryFile || entry.SHA256 == "" || !info.Mode().IsRegular() {
+			continue
+		}
+
+		sum, err := fileSHA256(target)
+		if err != nil || sum != entry.SHA256 {
+			logrus.Errorf("Staged %s does not match its checksum", name)
+			problems++
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("staged restore failed verification with %d problems", problems)
+	}
+
+	logrus.Infof("Verified %d staged entries against the backup manifests", len(expected))
+	return nil
+}
+
+// checksumBackup reads a backup to build the manifest it is missing, with file checksums
+func checksumBackup(ctx context.Context, source storage.Backend, archiver *archive.Archiver, backup *storage.BackupInfo) (*archive.Manifest, error) {
+	reader, _, err := dedup.OpenBackup(ctx, source, archiver, backup)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	manifest, err := archiver.ChecksumArchive(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s for verification: %w", backup.Key, err)
+	}
+	return manifest, nil
+}
+
+// swapIntoPlace moves staging to destPath, keeping the current destPath as its rollback.
+// Only the tree replaced by the latest staged restore is kept.
+func swapIntoPlace(staging, destPath string) error {
+	if _, err := os.Lstat(destPath); os.IsNotExist(err) {
+		if err := os.Rename(staging, destPath); err != nil {
+			return fmt.Errorf("failed to move restored tree into place: %w", err)
+		}
+		return nil
+	}
+
+	rollback := rollbackPath(destPath)
+	if err := os.RemoveAll(rollback); err != nil {
+		return fmt.Errorf("failed to remove previous rollback %s: %w", rollback, err)
+	}
+
+	err := exchangePaths(staging, destPath)
+	switch {
+	case err == nil:
+		// destPath is already restored, staging now holds the previous tree
+		if err := os.Rename(staging, rollback); err != nil {
+			return fmt.Errorf("restored %s but failed to keep its previous contents in %s, they are left in %s: %w", destPath, rollback, staging, err)
+		}
+	case errors.Is(err, errExchangeUnsupported):
+		if err := renameIntoPlace(staging, destPath, rollback); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("failed to swap restored tree into place: %w", err)
+	}
+
+	logrus.Infof("Previous contents of %s kept in %s, undo with restore --rollback", destPath, rollback)
+	return nil
+}
+
+// renameIntoPlace is the fallback of swapIntoPlace where paths can't be exchanged atomically:
+// destPath is moved to rollback, then staging to destPath. destPath is briefly missing in between.
+func renameIntoPlace(staging, destPath, rollback string) error {
+	if err := os.Rename(destPath, rollback); err != nil {
+		return fmt.Errorf("failed to move %s aside: %w", destPath, err)
+	}
+
+	if err := os.Rename(staging, destPath); err != nil {
+		// Put the previous tree back rather than leaving the destination missing
+		if restoreErr := os.Rename(rollback, destPath); restoreErr != nil {
+			logrus.Errorf("Failed to move %s back to %s: %v", rollback, destPath, restoreErr)
+		}
+		return fmt.Errorf("failed to move restored tree into place: %w", err)
+	}
+
+	return nil
+}
+
+// rollbackService swaps each path of a service with the tree its last staged restore moved aside.
+// Rolling back twice redoes the restore.
+func (s *Service) rollbackService(serviceConfig config.Service, opts *RestoreOptions) ([]*RestoreResult, error) {
+	var pathNames []string
+	for pathName := range serviceConfig.Paths {
+		if len(opts.Paths) == 0 || containsString(opts.Paths, pathName) {
+			pathNames = append(pathNames, pathName)
+		}
+	}
+	sort.Strings(pathNames)
+
+	var results []*RestoreResult
+	for _, pathName := range pathNames {
+		destPath := serviceConfig.Paths[pathName]
+		if opts.DestPath != "" {
+			destPath = filepath.Join(opts.DestPath, pathName)
+		}
+
+		rollback := rollbackPath(destPath)
+		if _, err := os.Lstat(rollback); err != nil {
+			logrus.Infof("No rollback found for %s:%s (%s)", opts.ServiceName, pathName, rollback)
+			continue
+		}
+
+		result := &RestoreResult{
+			Service:     opts.ServiceName,
+			Path:        pathName,
+			RestorePath: destPath,
+		}
+		results = append(results, result)
+
+		if opts.DryRun {
+			logrus.Infof("[DRY RUN] Would swap %s with %s", destPath, rollback)
+			continue
+		}
+
+		startTime := time.Now()
+		result.Error = swapRollback(destPath)
+		result.Duration = time.Since(startTime)
+
+		if result.Error != nil {
+			s.sendNotification(notifications.Error, opts.ServiceName, "rollback", result, result.Error)
+		} else {
+			logrus.Infof("Rolled back %s, the undone restore is kept in %s", destPath, rollback)
+			s.sendNotification(notifications.Success, opts.ServiceName, "rollback", result, nil)
+		}
+	}
+
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no rollback found for service %s, only staged restores keep one", opts.ServiceName)
+	}
+
+	return results, nil
+}
+
+// swapRollback exchanges destPath with its rollback
+func swapRollback(destPath string) error {
+	rollback := rollbackPath(destPath)
+
+	if _, err := os.Lstat(destPath); os.IsNotExist(err) {
+		if err := os.Rename(rollback, destPath); err != nil {
+			return fmt.Errorf("failed to move %s into place: %w", rollback, err)
+		}
+		return nil
+	}
+
+	err := exchangePaths(rollback, destPath)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, errExchangeUnsupported) {
+		return fmt.Errorf("failed to swap %s with %s: %w", destPath, rollback, err)
+	}
+
+	return renameRollback(destPath, rollback)
+}
+
+// renameRollback is the fallback of swapRollback where paths can't be exchanged atomically,
+// going through the staging path. destPath is briefly missing in between.
+func renameRollback(destPath, rollback string) error {
+	staging := stagingPath(destPath)
+	if err := os.RemoveAll(staging); err != nil {
+		return fmt.Errorf("failed to remove previous staging directory %s: %w", staging, err)
+	}
+
+	if err := os.Rename(destPath, staging); err != nil {
+		return fmt.Errorf("failed to move %s aside: %w", destPath, err)
+	}
+
+	if err := os.Rename(rollback, destPath); err != nil {
+		if restoreErr := os.Rename(staging, destPath); restoreErr != nil {
+			logrus.Errorf("Failed to move %s back to %s: %v", staging, destPath, restoreErr)
+		}
+		return fmt.Errorf("failed to move %s into place: %w", rollback, err)
+	}
+
+	if err := os.Rename(staging, rollback); err != nil {
+		return fmt.Errorf("failed to keep the undone restore in %s: %w", rollback, err)
+	}
+
+	return nil
+}
+
+// removeStaging deletes a staging directory after a failed restore
+func removeStaging(staging string) {
+	if err := os.RemoveAll(staging); err != nil {
+		logrus.Warnf("Failed to remove staging directory %s: %v", staging, err)
+	}
+}
+
+// fileSHA256 returns the hex encoded SHA-256 of a file's content
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func containsString(items []string, item string) bool {
+	for _, candidate := range items {
+		if candidate == item {
+			return true
+		}
+	}
+	return false
+}
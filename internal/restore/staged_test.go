@@ -0,0 +1,102 @@
+package restore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeMarker(t *testing.T, dir, content string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "marker"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readMarker(t *testing.T, dir string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, "marker"))
+	if err != nil {
+		t.Fatalf("failed to read marker in %s: %v", dir, err)
+	}
+	return string(data)
+}
+
+func TestSwapIntoPlaceAndRollback(t *testing.T) {
+	destPath := filepath.Join(t.TempDir(), "data")
+	writeMarker(t, destPath, "current")
+	writeMarker(t, rollbackPath(destPath), "stale rollback")
+	writeMarker(t, stagingPath(destPath), "restored")
+
+	if err := swapIntoPlace(stagingPath(destPath), destPath); err != nil {
+		t.Fatalf("swapIntoPlace() error = %v", err)
+	}
+	if got := readMarker(t, destPath); got != "restored" {
+		t.Errorf("destination holds %q, want the restored tree", got)
+	}
+	if got := readMarker(t, rollbackPath(destPath)); got != "current" {
+		t.Errorf("rollback holds %q, want the replaced tree", got)
+	}
+	if _, err := os.Lstat(stagingPath(destPath)); !os.IsNotExist(err) {
+		t.Errorf("staging directory left behind: %v", err)
+	}
+
+	if err := swapRollback(destPath); err != nil {
+		t.Fatalf("swapRollback() error = %v", err)
+	}
+	if got := readMarker(t, destPath); got != "current" {
+		t.Errorf("destination holds %q after rollback, want the replaced tree", got)
+	}
+	if got := readMarker(t, rollbackPath(destPath)); got != "restored" {
+		t.Errorf("rollback holds %q after rollback, want the undone restore", got)
+	}
+
+	// Rolling back twice redoes the restore
+	if err := swapRollback(destPath); err != nil {
+		t.Fatalf("second swapRollback() error = %v", err)
+	}
+	if got := readMarker(t, destPath); got != "restored" {
+		t.Errorf("destination holds %q after rolling back twice, want the restored tree", got)
+	}
+}
+
+func TestSwapIntoPlaceMissingDestination(t *testing.T) {
+	destPath := filepath.Join(t.TempDir(), "data")
+	writeMarker(t, stagingPath(destPath), "restored")
+
+	if err := swapIntoPlace(stagingPath(destPath), destPath); err != nil {
+		t.Fatalf("swapIntoPlace() error = %v", err)
+	}
+	if got := readMarker(t, destPath); got != "restored" {
+		t.Errorf("destination holds %q, want the restored tree", got)
+	}
+	if _, err := os.Lstat(rollbackPath(destPath)); !os.IsNotExist(err) {
+		t.Errorf("rollback created without a previous tree: %v", err)
+	}
+}
+
+func TestRenameFallbacks(t *testing.T) {
+	destPath := filepath.Join(t.TempDir(), "data")
+	writeMarker(t, destPath, "current")
+	writeMarker(t, stagingPath(destPath), "restored")
+
+	if err := renameIntoPlace(stagingPath(destPath), destPath, rollbackPath(destPath)); err != nil {
+		t.Fatalf("renameIntoPlace() error = %v", err)
+	}
+	if got := readMarker(t, destPath); got != "restored" {
+		t.Errorf("destination holds %q, want the restored tree", got)
+	}
+
+	if err := renameRollback(destPath, rollbackPath(destPath)); err != nil {
+		t.Fatalf("renameRollback() error = %v", err)
+	}
+	if got := readMarker(t, destPath); got != "current" {
+		t.Errorf("destination holds %q after rollback, want the replaced tree", got)
+	}
+	if got := readMarker(t, rollbackPath(destPath)); got != "restored" {
+		t.Errorf("rollback holds %q, want the undone restore", got)
+	}
+}
@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/volcie/stash/internal/config"
+)
+
+// Backend is implemented by every storage target backups can be shipped to
+type Backend interface {
+	Upload(ctx context.Context, reader io.Reader, service, pathName, ext string) (*BackupInfo, error)
+	UploadWithTimestamp(ctx context.Context, reader io.Reader, service, pathName, timestamp, ext string) (*BackupInfo, error)
+	Download(ctx context.Context, key string) (io.ReadCloser, error)
+	List(ctx context.Context, service string) ([]*BackupInfo, error)
+	Delete(ctx context.Context, key string) error
+	DeleteMultiple(ctx context.Context, keys []string) error
+	Stat(ctx context.Context, key string) (*BackupInfo, error)
+	// Location returns a human readable description of where backups are stored
+	Location() string
+	// VerifyUpload checks that the backup stored under key has the given hex SHA-256
+	VerifyUpload(ctx context.Context, key, sha256 string) error
+	// Close releases the connection to the storage, the backend can't be used afterwards
+	Close() error
+
+	ObjectStore
+}
+
+// ObjectStore stores arbitrary objects by name, relative to the backend's prefix.
+// Used for the chunks of deduplicated backups.
+type ObjectStore interface {
+	PutObject(ctx context.Context, name string, data []byte) error
+	GetObject(ctx context.Context, name string) (io.ReadCloser, error)
+	// ListObjects returns every object below dir, an empty list if dir doesn't exist
+	ListObjects(ctx context.Context, dir string) ([]*ObjectInfo, error)
+	DeleteObjects(ctx context.Context, names []string) error
+}
+
+// ObjectInfo describes an object in an ObjectStore
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// sha256Key is the context key of the checksum attached by WithSHA256
+type sha256Key struct{}
+
+// WithSHA256 attaches the hex SHA-256 of an upload's content to ctx, so backends sending a
+// checksum with the upload don't hash the content again
+func WithSHA256(ctx context.Context, sha256Hex string) context.Context {
+	return context.WithValue(ctx, sha256Key{}, sha256Hex)
+}
+
+// uploadSHA256 returns the base64 SHA-256 attached by WithSHA256, empty if there is none
+func uploadSHA256(ctx context.Context) string {
+	sha256Hex, _ := ctx.Value(sha256Key{}).(string)
+	digest, err := hex.DecodeString(sha256Hex)
+	if err != nil || len(digest) != sha256.Size {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(digest)
+}
+
+// Destination is a named storage backend backups are uploaded to
+type Destination struct {
+	Name    string
+	Backend Backend
+}
+
+// NewBackend creates the primary storage backend, used for listing, restoring and cleanup
+func NewBackend(cfg *config.Config) (Backend, error) {
+	return newDestinationBackend(cfg.GetDestinations()[0])
+}
+
+// NewBackendByName creates the backend for a named destination, or the primary one if name is empty
+func NewBackendByName(cfg *config.Config, name string) (Backend, error) {
+	if name == "" {
+		return NewBackend(cfg)
+	}
+
+	for _, dest := range cfg.GetDestinations() {
+		if dest.Name == name {
+			return newDestinationBackend(dest)
+		}
+	}
+
+	return nil, fmt.Errorf("destination %s not found in configuration", name)
+}
+
+// NewDestinations creates a backend for every configured destination
+func NewDestinations(cfg *config.Config) ([]*Destination, error) {
+	var destinations []*Destination
+	for _, dest := range cfg.GetDestinations() {
+		backend, err := newDestinationBackend(dest)
+		if err != nil {
+			CloseDestinations(destinations)
+			return nil, fmt.Errorf("destination %s: %w", dest.Name, err)
+		}
+
+		// S3 can only check checksums it was sent along with the upload
+		if s3Client, ok := backend.(*S3Client); ok && cfg.Backup.VerifyAfterUpload {
+			s3Client.verifyUploads = true
+		}
+
+		destinations = append(destinations, &Destination{
+			Name:    dest.Name,
+			Backend: backend,
+		})
+	}
+	return destinations, nil
+}
+
+// CloseDestinations closes the backend of every destination, logging failures
+func CloseDestinations(destinations []*Destination) {
+	for _, dest := range destinations {
+		if err := dest.Backend.Close(); err != nil {
+			logrus.Warnf("Failed to close destination %s: %v", dest.Name, err)
+		}
+	}
+}
+
+func newDestinationBackend(dest config.Destination) (Backend, error) {
+	switch dest.Type {
+	case "", config.StorageTypeS3:
+		return newS3BackendFromConfig(dest.S3)
+	case config.StorageTypeLocal:
+		client, err := NewLocalClient(dest.Local.Path, dest.Local.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create local storage: %w", err)
+		}
+		return client, nil
+	case config.StorageTypeSFTP:
+		client, err := NewSFTPClient(dest.SFTP)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create SFTP storage: %w", err)
+		}
+		return client, nil
+	default:
+		return nil, fmt.Errorf("unsupported storage type: %s", dest.Type)
+	}
+}
+
+func newS3BackendFromConfig(s3Cfg config.S3Config) (Backend, error) {
+	// Use config values if set, otherwise use defaults (100MB threshold, 10MB part size, 10 concurrency)
+	threshold := s3Cfg.MultipartThreshold
+	if threshold == 0 {
+		threshold = 100 * 1024 * 1024 // 100MB default
+	}
+
+	partSize := s3Cfg.MultipartPartSize
+	if partSize == 0 {
+		partSize = 10 * 1024 * 1024 // 10MB default
+	}
+
+	concurrency := s3Cfg.MultipartConcurrency
+	if concurrency == 0 {
+		concurrency = 10 // default
+	}
+
+	client, err := NewS3ClientWithMultipart(s3Cfg.Bucket, s3Cfg.Prefix, s3Cfg.Region, threshold, partSize, concurrency)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	return client, nil
+}
+
+// checkSHA256 reads a stored backup back and compares its SHA-256 with the expected hex digest
+func checkSHA256(reader io.Reader, expected string) error {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return fmt.Errorf("failed to read back backup: %w", err)
+	}
+
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != expected {
+		return fmt.Errorf("stored backup has SHA-256 %s, expected %s", actual, expected)
+	}
+	return nil
+}
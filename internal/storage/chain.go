@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/volcie/stash/internal/config"
+)
+
+// IsFull reports whether the backup is self-contained, a full backup or a deduplicated snapshot
+func (b *BackupInfo) IsFull() bool {
+	return b.Kind != config.BackupModeIncremental && b.Kind != config.BackupModeDifferential
+}
+
+// BackupChain returns the backups needed to restore target, oldest first: the full backup it
+// builds on, followed by every incremental or differential layer up to and including target.
+// An incremental depends on the backup right before it, a differential on the last full backup.
+func BackupChain(backups []*BackupInfo, target *BackupInfo) ([]*BackupInfo, error) {
+	if target.IsFull() {
+		return []*BackupInfo{target}, nil
+	}
+
+	// Earlier backups of the same path, newest first
+	var earlier []*BackupInfo
+	for _, backup := range backups {
+		if backup.Service == target.Service && backup.Path == target.Path && backup.Date.Before(target.Date) {
+			earlier = append(earlier, backup)
+		}
+	}
+	sort.Slice(earlier, func(i, j int) bool {
+		return earlier[i].Date.After(earlier[j].Date)
+	})
+
+	chain := []*BackupInfo{target}
+	current := target
+	for _, backup := range earlier {
+		if current.IsFull() {
+			break
+		}
+		if current.Kind == config.BackupModeDifferential && !backup.IsFull() {
+			continue
+		}
+		chain = append(chain, backup)
+		current = backup
+	}
+
+	if !current.IsFull() {
+		return nil, fmt.Errorf("no full backup found that %s builds on", target.Key)
+	}
+
+	// Oldest first
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+
+	return chain, nil
+}
+
+// ChainDependencies returns the keys of every backup that one of kept depends on, so retention
+// never deletes the full or incremental backups a kept backup needs to be restored
+func ChainDependencies(backups, kept []*BackupInfo) map[string]bool {
+	required := make(map[string]bool)
+	for _, backup := range kept {
+		if backup.IsFull() {
+			continue
+		}
+
+		chain, err := BackupChain(backups, backup)
+		if err != nil {
+			continue
+		}
+		for _, dependency := range chain[:len(chain)-1] {
+			required[dependency.Key] = true
+		}
+	}
+	return required
+}
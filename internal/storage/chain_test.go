@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/volcie/stash/internal/config"
+)
+
+// testBackup returns a backup of web/data taken day days after the first of the month
+func testBackup(day int, kind string) *BackupInfo {
+	date := time.Date(2025, 1, day, 3, 0, 0, 0, time.UTC)
+	ext := KeyExtension(kind, ".tar.gz")
+	if kind == KindSnapshot {
+		ext = SnapshotExtension
+	}
+	return &BackupInfo{
+		Service: "web",
+		Path:    "data",
+		Date:    date,
+		Key:     buildBackupKey("", "web", "data", date.Format("20060102-150405"), ext),
+		Kind:    kind,
+	}
+}
+
+func TestBackupChain(t *testing.T) {
+	const (
+		full = config.BackupModeFull
+		incr = config.BackupModeIncremental
+		diff = config.BackupModeDifferential
+	)
+
+	tests := []struct {
+		name    string
+		kinds   []string // one backup per day, in order
+		target  int      // index of the restored backup
+		want    []int    // indexes of the chain, oldest first
+		wantErr string
+	}{
+		{"full", []string{full, incr}, 0, []int{0}, ""},
+		{"snapshot", []string{KindSnapshot}, 0, []int{0}, ""},
+		{"incrementals", []string{full, incr, incr, incr}, 3, []int{0, 1, 2, 3}, ""},
+		{"incremental after newer full", []string{full, incr, full, incr}, 3, []int{2, 3}, ""},
+		{"earlier incremental", []string{full, incr, incr, incr}, 1, []int{0, 1}, ""},
+		{"differential skips incrementals", []string{full, incr, incr, diff}, 3, []int{0, 3}, ""},
+		{"differential skips differentials", []string{full, diff, diff}, 2, []int{0, 2}, ""},
+		{"incremental on differential", []string{full, incr, diff, incr}, 3, []int{0, 2, 3}, ""},
+		{"missing full", []string{incr, incr}, 1, nil, "no full backup found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var backups []*BackupInfo
+			for i, kind := range tt.kinds {
+				backups = append(backups, testBackup(i+1, kind))
+			}
+
+			// Backups of other paths never join the chain
+			other := testBackup(1, full)
+			other.Path = "other"
+			backups = append(backups, other)
+
+			// Listings aren't sorted
+			shuffled := append([]*BackupInfo(nil), backups...)
+			for i, j := 0, len(shuffled)-1; i < j; i, j = i+1, j-1 {
+				shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+			}
+
+			chain, err := BackupChain(shuffled, backups[tt.target])
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("BackupChain() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("BackupChain() error = %v", err)
+			}
+
+			var got []string
+			for _, backup := range chain {
+				got = append(got, backup.Key)
+			}
+			var want []string
+			for _, i := range tt.want {
+				want = append(want, backups[i].Key)
+			}
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("BackupChain() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestChainDependencies(t *testing.T) {
+	backups := []*BackupInfo{
+		testBackup(1, config.BackupModeFull),
+		testBackup(2, config.BackupModeIncremental),
+		testBackup(3, config.BackupModeIncremental),
+		testBackup(4, config.BackupModeFull),
+		testBackup(5, config.BackupModeDifferential),
+	}
+
+	required := ChainDependencies(backups, []*BackupInfo{backups[2], backups[4]})
+
+	for i, want := range []bool{true, true, false, true, false} {
+		if required[backups[i].Key] != want {
+			t.Errorf("backup %d required = %v, want %v", i, required[backups[i].Key], want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"strings"
+	"time"
+
+	"github.com/volcie/stash/internal/config"
+)
+
+// archiveExtensions are the file extensions of every archive format stash writes
+var archiveExtensions = []string{".tar.gz", ".tar.zst", ".tar.xz", ".tar"}
+
+// SnapshotExtension is the extension of deduplicated backups, small manifests listing their chunks
+const SnapshotExtension = ".snapshot"
+
+// ManifestExtension is the extension of the manifest uploaded next to every backup, listing its files with their checksums
+const ManifestExtension = ".manifest.json.gz"
+
+// KindSnapshot is the kind of deduplicated backups
+const KindSnapshot = "snapshot"
+
+// kindSuffixes mark incremental and differential backups in the key, before the archive extension
+var kindSuffixes = map[string]string{
+	config.BackupModeIncremental:  ".incr",
+	config.BackupModeDifferential: ".diff",
+}
+
+// KeyExtension returns the key extension of a backup of the given kind in the given archive format,
+// e.g. ".incr.tar.gz" for an incremental gzip archive
+func KeyExtension(kind, archiveExt string) string {
+	return kindSuffixes[kind] + archiveExt
+}
+
+// ManifestKey returns the key of the manifest stored next to the backup with the given key
+func ManifestKey(key string) string {
+	if strings.HasSuffix(key, SnapshotExtension) {
+		return strings.TrimSuffix(key, SnapshotExtension) + ManifestExtension
+	}
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(key, ext) {
+			return strings.TrimSuffix(key, ext) + ManifestExtension
+		}
+	}
+	return key + ManifestExtension
+}
+
+// kindFromExtension returns the backup kind encoded in a key extension
+func kindFromExtension(ext string) string {
+	if ext == SnapshotExtension {
+		return KindSnapshot
+	}
+	for kind, suffix := range kindSuffixes {
+		if strings.HasPrefix(ext, suffix+".") {
+			return kind
+		}
+	}
+	return config.BackupModeFull
+}
+
+// buildBackupKey returns the key for a backup in the layout shared by every backend:
+// prefix/service/path/timestamp.ext, where ext is the archive extension (e.g. .tar.gz) or .snapshot
+func buildBackupKey(prefix, service, pathName, timestamp, ext string) string {
+	parts := []string{service, pathName, timestamp + ext}
+	if prefix != "" {
+		parts = append([]string{prefix}, parts...)
+	}
+	return strings.Join(parts, "/")
+}
+
+// parseBackupKey extracts backup information from a key built by buildBackupKey.
+// Returns nil if the key is not a stash backup.
+func parseBackupKey(prefix, key string) *BackupInfo {
+	// Expected format: prefix/service/path/timestamp.ext
+	if !strings.HasPrefix(key, prefix) {
+		return nil
+	}
+
+	relativePath := strings.TrimPrefix(key, prefix+"/")
+	parts := strings.Split(relativePath, "/")
+
+	if len(parts) < 3 {
+		return nil
+	}
+
+	service := parts[0]
+	pathName := strings.Join(parts[1:len(parts)-1], "/")
+	filename := parts[len(parts)-1]
+
+	// Extract timestamp from filename
+	var timestamp string
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(filename, ext) {
+			timestamp = strings.TrimSuffix(filename, ext)
+			break
+		}
+	}
+
+	kind := config.BackupModeFull
+	if strings.HasSuffix(filename, SnapshotExtension) {
+		timestamp = strings.TrimSuffix(filename, SnapshotExtension)
+		kind = KindSnapshot
+	}
+	for suffixKind, suffix := range kindSuffixes {
+		if strings.HasSuffix(timestamp, suffix) {
+			timestamp = strings.TrimSuffix(timestamp, suffix)
+			kind = suffixKind
+			break
+		}
+	}
+
+	// Validate that the filename is just a timestamp (no extra parts like service-path-timestamp)
+	// Expected format: YYYYMMDD-HHMMSS (exactly 15 characters)
+	if len(timestamp) != 15 || timestamp[8] != '-' {
+		// Not a valid timestamp format, silently skip (probably old backup format)
+		return nil
+	}
+
+	date, err := time.Parse("20060102-150405", timestamp)
+	if err != nil {
+		// Invalid timestamp format, silently skip
+		return nil
+	}
+
+	return &BackupInfo{
+		Service: service,
+		Path:    pathName,
+		Date:    date,
+		Key:     key,
+		Kind:    kind,
+	}
+}
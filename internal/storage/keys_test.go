@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/volcie/stash/internal/config"
+)
+
+func TestBackupKeyRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		kind       string
+		archiveExt string
+		wantExt    string
+	}{
+		{"full gzip", config.BackupModeFull, ".tar.gz", ".tar.gz"},
+		{"full zstd", config.BackupModeFull, ".tar.zst", ".tar.zst"},
+		{"full xz", config.BackupModeFull, ".tar.xz", ".tar.xz"},
+		{"full uncompressed", config.BackupModeFull, ".tar", ".tar"},
+		{"incremental gzip", config.BackupModeIncremental, ".tar.gz", ".incr.tar.gz"},
+		{"incremental zstd", config.BackupModeIncremental, ".tar.zst", ".incr.tar.zst"},
+		{"differential xz", config.BackupModeDifferential, ".tar.xz", ".diff.tar.xz"},
+		{"differential uncompressed", config.BackupModeDifferential, ".tar", ".diff.tar"},
+		{"snapshot", KindSnapshot, SnapshotExtension, ".snapshot"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ext := tt.archiveExt
+			if tt.kind != KindSnapshot {
+				ext = KeyExtension(tt.kind, tt.archiveExt)
+			}
+			if ext != tt.wantExt {
+				t.Fatalf("KeyExtension() = %q, want %q", ext, tt.wantExt)
+			}
+			if got := kindFromExtension(ext); got != tt.kind {
+				t.Errorf("kindFromExtension(%q) = %q, want %q", ext, got, tt.kind)
+			}
+
+			for _, prefix := range []string{"", "backups"} {
+				key := buildBackupKey(prefix, "web", "data/uploads", "20250102-030405", ext)
+
+				info := parseBackupKey(prefix, key)
+				if info == nil {
+					t.Fatalf("parseBackupKey(%q, %q) = nil", prefix, key)
+				}
+				if info.Service != "web" || info.Path != "data/uploads" || info.Kind != tt.kind || info.Key != key {
+					t.Errorf("parseBackupKey(%q) = %+v", key, info)
+				}
+				if got := info.Date.Format("20060102-150405"); got != "20250102-030405" {
+					t.Errorf("parseBackupKey(%q) date = %s", key, got)
+				}
+
+				// The manifest keeps the kind suffix, only the archive extension is replaced
+				wantManifest := strings.TrimSuffix(key, tt.archiveExt) + ManifestExtension
+				if got := ManifestKey(key); got != wantManifest {
+					t.Errorf("ManifestKey(%q) = %q, want %q", key, got, wantManifest)
+				}
+				// Manifests are stored next to backups and must not be listed as one
+				if info := parseBackupKey(prefix, wantManifest); info != nil {
+					t.Errorf("manifest %q parsed as a backup", wantManifest)
+				}
+			}
+		})
+	}
+}
+
+func TestParseBackupKeyRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		key    string
+	}{
+		{"manifest", "", "web/data/20250102-030405" + ManifestExtension},
+		// Encryption keeps the archive extension, age files aren't backups of their own
+		{"age extension", "", "web/data/20250102-030405.tar.gz.age"},
+		{"old naming", "", "web/data/web-data-20250102-030405.tar.gz"},
+		{"invalid timestamp", "", "web/data/20251302-030405.tar.gz"},
+		{"missing path", "", "web/20250102-030405.tar.gz"},
+		{"other prefix", "backups", "other/web/data/20250102-030405.tar.gz"},
+		{"chunk", "", "chunks/ab/abcdef"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if info := parseBackupKey(tt.prefix, tt.key); info != nil {
+				t.Errorf("parseBackupKey(%q, %q) = %+v, want nil", tt.prefix, tt.key, info)
+			}
+		})
+	}
+}
+
+func TestManifestKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"web/data/20250102-030405.tar.gz", "web/data/20250102-030405.manifest.json.gz"},
+		{"web/data/20250102-030405.tar", "web/data/20250102-030405.manifest.json.gz"},
+		{"web/data/20250102-030405.incr.tar.zst", "web/data/20250102-030405.incr.manifest.json.gz"},
+		{"web/data/20250102-030405.diff.tar.xz", "web/data/20250102-030405.diff.manifest.json.gz"},
+		{"web/data/20250102-030405.snapshot", "web/data/20250102-030405.manifest.json.gz"},
+		{"web/data/backup", "web/data/backup.manifest.json.gz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := ManifestKey(tt.key); got != tt.want {
+				t.Errorf("ManifestKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
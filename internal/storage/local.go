@@ -0,0 +1,397 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LocalClient stores backups in a directory on a local disk or mounted NAS share
+type LocalClient struct {
+	root   string
+	prefix string
+}
+
+func NewLocalClient(root, prefix string) (*LocalClient, error) {
+	// The root must already exist so a missing NAS mount doesn't silently fill the local disk
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("cannot access storage directory '%s': %w", root, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("storage path '%s' is not a directory", root)
+	}
+
+	logrus.Debugf("Using local storage directory: %s", root)
+
+	return &LocalClient{
+		root:   filepath.Clean(root),
+		prefix: strings.Trim(prefix, "/"),
+	}, nil
+}
+
+func (l *LocalClient) Upload(ctx context.Context, reader io.Reader, service, pathName, ext string) (*BackupInfo, error) {
+	timestamp := time.Now().Format("20060102-150405")
+	return l.UploadWithTimestamp(ctx, reader, service, pathName, timestamp, ext)
+}
+
+func (l *LocalClient) UploadWithTimestamp(ctx context.Context, reader io.Reader, service, pathName, timestamp, ext string) (*BackupInfo, error) {
+	key := l.buildKey(service, pathName, timestamp, ext)
+	targetPath := l.keyPath(key)
+
+	logrus.Infof("Copying backup to %s", targetPath)
+
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	// Write to a temp file in the same directory and rename it into place so
+	// readers never see a partially written archive
+	tempFile, err := os.CreateTemp(filepath.Dir(targetPath), "."+filepath.Base(targetPath)+".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	size, err := io.Copy(tempFile, &contextReader{ctx: ctx, reader: reader})
+	if err != nil {
+		tempFile.Close()
+		return nil, fmt.Errorf("failed to write backup: %w", err)
+	}
+
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return nil, fmt.Errorf("failed to sync backup: %w", err)
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close backup: %w", err)
+	}
+
+	if err := os.Rename(tempFile.Name(), targetPath); err != nil {
+		return nil, fmt.Errorf("failed to move backup into place: %w", err)
+	}
+
+	backupTime, _ := time.Parse("20060102-150405", timestamp)
+
+	return &BackupInfo{
+		Service: service,
+		Path:    pathName,
+		Date:    backupTime,
+		Key:     key,
+		Size:    size,
+		Kind:    kindFromExtension(ext),
+	}, nil
+}
+
+// MoveIntoPlace renames an existing archive file into the backup layout without copying it.
+// Fails if the file is on a different filesystem than the storage directory.
+func (l *LocalClient) MoveIntoPlace(sourcePath, service, pathName, timestamp, ext string) (*BackupInfo, error) {
+	key := l.buildKey(service, pathName, timestamp, ext)
+	targetPath := l.keyPath(key)
+
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	if err := os.Rename(sourcePath, targetPath); err != nil {
+		return nil, fmt.Errorf("failed to move backup into place: %w", err)
+	}
+
+	info, err := os.Stat(targetPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat backup: %w", err)
+	}
+
+	backupTime, _ := time.Parse("20060102-150405", timestamp)
+
+	return &BackupInfo{
+		Service: service,
+		Path:    pathName,
+		Date:    backupTime,
+		Key:     key,
+		Size:    info.Size(),
+		Kind:    kindFromExtension(ext),
+	}, nil
+}
+
+func (l *LocalClient) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	path := l.keyPath(key)
+
+	logrus.Infof("Reading backup from %s", path)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup: %w", err)
+	}
+
+	return file, nil
+}
+
+func (l *LocalClient) List(ctx context.Context, service string) ([]*BackupInfo, error) {
+	searchDir := filepath.Join(l.root, filepath.FromSlash(l.prefix))
+	if service != "" {
+		searchDir = filepath.Join(searchDir, service)
+	}
+
+	logrus.Debugf("Listing local backups in: %s", searchDir)
+
+	var backups []*BackupInfo
+	err := filepath.WalkDir(searchDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == searchDir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(l.root, path)
+		if err != nil {
+			return nil
+		}
+
+		backup := l.parseKey(filepath.ToSlash(relPath))
+		if backup == nil {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			logrus.Warnf("Failed to stat %s: %v", path, err)
+			return nil
+		}
+		backup.Size = info.Size()
+
+		backups = append(backups, backup)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list local backups: %w", err)
+	}
+
+	return backups, nil
+}
+
+func (l *LocalClient) Stat(ctx context.Context, key string) (*BackupInfo, error) {
+	info, err := os.Stat(l.keyPath(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat backup: %w", err)
+	}
+
+	backup := l.parseKey(key)
+	if backup == nil {
+		return nil, fmt.Errorf("not a stash backup key: %s", key)
+	}
+	backup.Size = info.Size()
+
+	return backup, nil
+}
+
+func (l *LocalClient) Delete(ctx context.Context, key string) error {
+	path := l.keyPath(key)
+
+	logrus.Infof("Deleting backup %s", path)
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to delete backup: %w", err)
+	}
+
+	// Older backups have no manifest
+	if err := os.Remove(l.keyPath(ManifestKey(key))); err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("Failed to delete manifest of %s: %v", key, err)
+	}
+
+	l.pruneEmptyDirs(filepath.Dir(path))
+	return nil
+}
+
+func (l *LocalClient) DeleteMultiple(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	logrus.Infof("Deleting %d local backups", len(keys))
+
+	var failed int
+	for _, key := range keys {
+		if err := l.Delete(ctx, key); err != nil {
+			logrus.Warnf("%v", err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to delete %d of %d backups", failed, len(keys))
+	}
+
+	return nil
+}
+
+func (l *LocalClient) VerifyUpload(ctx context.Context, key, sha256 string) error {
+	file, err := os.Open(l.keyPath(key))
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer file.Close()
+
+	return checkSHA256(&contextReader{ctx: ctx, reader: file}, sha256)
+}
+
+func (l *LocalClient) Location() string {
+	return filepath.Join(l.root, filepath.FromSlash(l.prefix))
+}
+
+// Close does nothing, local storage holds no connection
+func (l *LocalClient) Close() error {
+	return nil
+}
+
+func (l *LocalClient) buildKey(service, pathName, timestamp, ext string) string {
+	return buildBackupKey(l.prefix, service, pathName, timestamp, ext)
+}
+
+func (l *LocalClient) parseKey(key string) *BackupInfo {
+	return parseBackupKey(l.prefix, key)
+}
+
+// keyPath converts a slash separated backup key into a path under the storage root
+func (l *LocalClient) keyPath(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(key))
+}
+
+// pruneEmptyDirs removes empty directories left behind by deletions, stopping at the storage root
+func (l *LocalClient) pruneEmptyDirs(dir string) {
+	for dir != l.root && strings.HasPrefix(dir, l.root) {
+		if err := os.Remove(dir); err != nil {
+			return // Not empty or not removable
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func (l *LocalClient) PutObject(ctx context.Context, name string, data []byte) error {
+	targetPath := l.objectPath(name)
+
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return fmt.Errorf("failed to create object directory: %w", err)
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(targetPath), "."+filepath.Base(targetPath)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return fmt.Errorf("failed to write object %s: %w", name, err)
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("failed to close object %s: %w", name, err)
+	}
+
+	if err := os.Rename(tempFile.Name(), targetPath); err != nil {
+		return fmt.Errorf("failed to move object %s into place: %w", name, err)
+	}
+
+	return nil
+}
+
+func (l *LocalClient) GetObject(ctx context.Context, name string) (io.ReadCloser, error) {
+	file, err := os.Open(l.objectPath(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open object %s: %w", name, err)
+	}
+	return file, nil
+}
+
+func (l *LocalClient) ListObjects(ctx context.Context, dir string) ([]*ObjectInfo, error) {
+	searchDir := l.objectPath(dir)
+	base := l.objectPath("")
+
+	var objects []*ObjectInfo
+	err := filepath.WalkDir(searchDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == searchDir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+
+		// Skip directories and temp files of writes in progress
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil // Removed while listing
+		}
+
+		relPath, err := filepath.Rel(base, path)
+		if err != nil {
+			return nil
+		}
+
+		objects = append(objects, &ObjectInfo{
+			Name:    filepath.ToSlash(relPath),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects in %s: %w", searchDir, err)
+	}
+
+	return objects, nil
+}
+
+func (l *LocalClient) DeleteObjects(ctx context.Context, names []string) error {
+	var failed int
+	for _, name := range names {
+		path := l.objectPath(name)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logrus.Warnf("Failed to delete object %s: %v", path, err)
+			failed++
+			continue
+		}
+		l.pruneEmptyDirs(filepath.Dir(path))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to delete %d of %d objects", failed, len(names))
+	}
+
+	return nil
+}
+
+// objectPath converts an object name into a path under the storage root and prefix
+func (l *LocalClient) objectPath(name string) string {
+	return filepath.Join(l.root, filepath.FromSlash(l.prefix), filepath.FromSlash(name))
+}
+
+// contextReader stops a copy early once the context is cancelled
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.reader.Read(p)
+}
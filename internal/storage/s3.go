@@ -1,12 +1,19 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -25,6 +32,12 @@ type S3Client struct {
 	multipartThreshold  int64
 	multipartPartSize   int64
 	multipartConcurrency int
+
+	// verifyUploads sends SHA-256 checksums with uploads. The part checksums of multipart
+	// uploads are kept by key until VerifyUpload compares them with what S3 stored.
+	verifyUploads bool
+	partSums      map[string]*partHasher
+	partSumsMu    sync.Mutex
 }
 
 type BackupInfo struct {
@@ -34,19 +47,27 @@ type BackupInfo struct {
 	Key     string
 	Size    int64
 	ETag    string
+	Kind    string // full, incremental or differential
 }
 
 func NewS3Client(bucket, prefix string) (*S3Client, error) {
-	return NewS3ClientWithMultipart(bucket, prefix, 100*1024*1024, 10*1024*1024, 10)
+	return NewS3ClientWithMultipart(bucket, prefix, "", 100*1024*1024, 10*1024*1024, 10)
 }
 
-func NewS3ClientWithMultipart(bucket, prefix string, multipartThreshold, partSize int64, concurrency int) (*S3Client, error) {
+// NewS3ClientWithMultipart creates an S3 client with custom multipart settings.
+// An empty region falls back to AWS_REGION / AWS_DEFAULT_REGION.
+func NewS3ClientWithMultipart(bucket, prefix, region string, multipartThreshold, partSize int64, concurrency int) (*S3Client, error) {
 	// Validate environment variables
-	if err := validateS3Environment(); err != nil {
+	if err := validateS3Environment(region); err != nil {
 		return nil, err
 	}
 
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+	var opts []func(*config.LoadOptions) error
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
@@ -81,13 +102,13 @@ func NewS3ClientWithMultipart(bucket, prefix string, multipartThreshold, partSiz
 	}, nil
 }
 
-func (s *S3Client) Upload(ctx context.Context, reader io.Reader, service, pathName string) (*BackupInfo, error) {
+func (s *S3Client) Upload(ctx context.Context, reader io.Reader, service, pathName, ext string) (*BackupInfo, error) {
 	timestamp := time.Now().Format("20060102-150405")
-	return s.UploadWithTimestamp(ctx, reader, service, pathName, timestamp)
+	return s.UploadWithTimestamp(ctx, reader, service, pathName, timestamp, ext)
 }
 
-func (s *S3Client) UploadWithTimestamp(ctx context.Context, reader io.Reader, service, pathName, timestamp string) (*BackupInfo, error) {
-	key := s.buildKey(service, pathName, timestamp)
+func (s *S3Client) UploadWithTimestamp(ctx context.Context, reader io.Reader, service, pathName, timestamp, ext string) (*BackupInfo, error) {
+	key := s.buildKey(service, pathName, timestamp, ext)
 
 	logrus.Infof("Uploading backup to s3://%s/%s", s.bucket, key)
 
@@ -104,28 +125,65 @@ func (s *S3Client) UploadWithTimestamp(ctx context.Context, reader io.Reader, se
 				logrus.Debugf("Using multipart upload (file size: %d MB)", size/(1024*1024))
 			}
 		}
+	} else if _, ok := reader.(io.Seeker); !ok {
+		// Unknown length stream, PutObject needs a size so let the uploader chunk it
+		useMultipart = true
+		logrus.Debugf("Using multipart upload (streamed, size unknown)")
 	}
 
 	var etag string
 
+	// S3 rejects an upload whose content doesn't match the x-amz-checksum-sha256 sent with it
+	var checksumAlgorithm types.ChecksumAlgorithm
+	if s.verifyUploads {
+		checksumAlgorithm = types.ChecksumAlgorithmSha256
+	}
+
 	if useMultipart {
+		// Multipart objects only get a checksum of their part checksums, hash the parts to check it later
+		var sums *partHasher
+		if s.verifyUploads {
+			sums = newPartHasher(reader, s.uploader.PartSize)
+			reader = sums
+		}
+
 		// Use multipart upload
 		result, err := s.uploader.Upload(ctx, &s3.PutObjectInput{
-			Bucket: aws.String(s.bucket),
-			Key:    aws.String(key),
-			Body:   reader,
+			Bucket:            aws.String(s.bucket),
+			Key:               aws.String(key),
+			Body:              reader,
+			ChecksumAlgorithm: checksumAlgorithm,
 		})
 		if err != nil {
 			return nil, fmt.Errorf("failed to upload to S3: %w", err)
 		}
 		etag = strings.Trim(*result.ETag, "\"")
+
+		if sums != nil {
+			s.partSumsMu.Lock()
+			if s.partSums == nil {
+				s.partSums = make(map[string]*partHasher)
+			}
+			s.partSums[key] = sums
+			s.partSumsMu.Unlock()
+		}
 	} else {
 		// Use regular PutObject for smaller files
-		result, err := s.client.PutObject(ctx, &s3.PutObjectInput{
-			Bucket: aws.String(s.bucket),
-			Key:    aws.String(key),
-			Body:   reader,
-		})
+		input := &s3.PutObjectInput{
+			Bucket:            aws.String(s.bucket),
+			Key:               aws.String(key),
+			Body:              reader,
+			ChecksumAlgorithm: checksumAlgorithm,
+		}
+
+		// A checksum computed while the archive was written saves the SDK hashing it again
+		if s.verifyUploads {
+			if checksum := uploadSHA256(ctx); checksum != "" {
+				input.ChecksumSHA256 = aws.String(checksum)
+			}
+		}
+
+		result, err := s.client.PutObject(ctx, input)
 		if err != nil {
 			return nil, fmt.Errorf("failed to upload to S3: %w", err)
 		}
@@ -154,6 +212,7 @@ func (s *S3Client) UploadWithTimestamp(ctx context.Context, reader io.Reader, se
 		Key:     key,
 		Size:    size,
 		ETag:    etag,
+		Kind:    kindFromExtension(ext),
 	}, nil
 }
 
@@ -208,6 +267,30 @@ func (s *S3Client) List(ctx context.Context, service string) ([]*BackupInfo, err
 	return backups, nil
 }
 
+func (s *S3Client) Stat(ctx context.Context, key string) (*BackupInfo, error) {
+	head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat S3 object: %w", err)
+	}
+
+	backup := s.parseKey(key)
+	if backup == nil {
+		return nil, fmt.Errorf("not a stash backup key: %s", key)
+	}
+
+	if head.ContentLength != nil {
+		backup.Size = *head.ContentLength
+	}
+	if head.ETag != nil {
+		backup.ETag = strings.Trim(*head.ETag, "\"")
+	}
+
+	return backup, nil
+}
+
 func (s *S3Client) Delete(ctx context.Context, key string) error {
 	logrus.Infof("Deleting backup s3://%s/%s", s.bucket, key)
 
@@ -219,6 +302,15 @@ func (s *S3Client) Delete(ctx context.Context, key string) error {
 		return fmt.Errorf("failed to delete S3 object: %w", err)
 	}
 
+	// Deleting a missing key succeeds, so older backups without a manifest need no special case
+	_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(ManifestKey(key)),
+	})
+	if err != nil {
+		logrus.Warnf("Failed to delete manifest of %s: %v", key, err)
+	}
+
 	return nil
 }
 
@@ -227,83 +319,196 @@ func (s *S3Client) DeleteMultiple(ctx context.Context, keys []string) error {
 		return nil
 	}
 
+	// Each backup is deleted along with its manifest
 	var objects []types.ObjectIdentifier
 	for _, key := range keys {
 		objects = append(objects, types.ObjectIdentifier{
 			Key: aws.String(key),
+		}, types.ObjectIdentifier{
+			Key: aws.String(ManifestKey(key)),
 		})
 	}
 
 	logrus.Infof("Deleting %d backups from S3", len(keys))
 
-	_, err := s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
-		Bucket: aws.String(s.bucket),
-		Delete: &types.Delete{
-			Objects: objects,
-		},
-	})
-	if err != nil {
-		return fmt.Errorf("failed to delete S3 objects: %w", err)
+	// DeleteObjects accepts at most 1000 keys per request
+	for start := 0; start < len(objects); start += 1000 {
+		end := start + 1000
+		if end > len(objects) {
+			end = len(objects)
+		}
+
+		_, err := s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &types.Delete{
+				Objects: objects[start:end],
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete S3 objects: %w", err)
+		}
 	}
 
 	return nil
 }
 
-func (s *S3Client) buildKey(service, pathName, timestamp string) string {
-	parts := []string{s.prefix, service, pathName, fmt.Sprintf("%s.tar.gz", timestamp)}
-	return strings.Join(parts, "/")
+func (s *S3Client) PutObject(ctx context.Context, name string, data []byte) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(name)),
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload object %s to S3: %w", name, err)
+	}
+	return nil
 }
 
-func (s *S3Client) buildServicePrefix(service string) string {
-	return filepath.Join(s.prefix, service) + "/"
+func (s *S3Client) GetObject(ctx context.Context, name string) (io.ReadCloser, error) {
+	result, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(name)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download object %s from S3: %w", name, err)
+	}
+	return result.Body, nil
 }
 
-func (s *S3Client) parseKey(key string) *BackupInfo {
-	// Expected format: prefix/service/path/timestamp.tar.gz
-	if !strings.HasPrefix(key, s.prefix) {
-		return nil
+func (s *S3Client) ListObjects(ctx context.Context, dir string) ([]*ObjectInfo, error) {
+	base := s.objectKey("")
+	if base != "" {
+		base += "/"
 	}
 
-	relativePath := strings.TrimPrefix(key, s.prefix+"/")
-	parts := strings.Split(relativePath, "/")
+	var objects []*ObjectInfo
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.objectKey(dir) + "/"),
+	})
 
-	if len(parts) < 3 {
-		return nil
+	for paginator.HasMorePages() {
+		result, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list S3 objects: %w", err)
+		}
+
+		for _, obj := range result.Contents {
+			object := &ObjectInfo{Name: strings.TrimPrefix(*obj.Key, base)}
+			if obj.Size != nil {
+				object.Size = *obj.Size
+			}
+			if obj.LastModified != nil {
+				object.ModTime = *obj.LastModified
+			}
+			objects = append(objects, object)
+		}
 	}
 
-	service := parts[0]
-	pathName := strings.Join(parts[1:len(parts)-1], "/")
-	filename := parts[len(parts)-1]
+	return objects, nil
+}
 
-	// Extract timestamp from filename
-	if !strings.HasSuffix(filename, ".tar.gz") {
-		return nil
+func (s *S3Client) DeleteObjects(ctx context.Context, names []string) error {
+	// DeleteObjects accepts at most 1000 keys per request
+	for start := 0; start < len(names); start += 1000 {
+		end := start + 1000
+		if end > len(names) {
+			end = len(names)
+		}
+
+		var objects []types.ObjectIdentifier
+		for _, name := range names[start:end] {
+			objects = append(objects, types.ObjectIdentifier{
+				Key: aws.String(s.objectKey(name)),
+			})
+		}
+
+		_, err := s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &types.Delete{
+				Objects: objects,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete S3 objects: %w", err)
+		}
 	}
 
-	timestamp := strings.TrimSuffix(filename, ".tar.gz")
+	return nil
+}
 
-	// Validate that the filename is just a timestamp (no extra parts like service-path-timestamp)
-	// Expected format: YYYYMMDD-HHMMSS (exactly 15 characters)
-	if len(timestamp) != 15 || timestamp[8] != '-' {
-		// Not a valid timestamp format, silently skip (probably old backup format)
-		return nil
+// objectKey converts an object name into a key below the prefix
+func (s *S3Client) objectKey(name string) string {
+	return strings.Trim(path.Join(s.prefix, name), "/")
+}
+
+// VerifyUpload compares the SHA-256 checksum S3 stored for an upload with the archive's. Multipart uploads
+// store a checksum of their part checksums, which is compared with the parts hashed during upload.
+func (s *S3Client) VerifyUpload(ctx context.Context, key, sha256Hex string) error {
+	digest, err := hex.DecodeString(sha256Hex)
+	if err != nil {
+		return fmt.Errorf("invalid SHA-256 %s: %w", sha256Hex, err)
 	}
 
-	date, err := time.Parse("20060102-150405", timestamp)
+	s.partSumsMu.Lock()
+	sums := s.partSums[key]
+	delete(s.partSums, key)
+	s.partSumsMu.Unlock()
+
+	head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(s.bucket),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
 	if err != nil {
-		// Invalid timestamp format, silently skip
-		return nil
+		return fmt.Errorf("failed to stat S3 object: %w", err)
 	}
 
-	return &BackupInfo{
-		Service: service,
-		Path:    pathName,
-		Date:    date,
-		Key:     key,
+	stored := aws.ToString(head.ChecksumSHA256)
+	if stored == "" {
+		return fmt.Errorf("S3 returned no SHA-256 checksum for %s, the storage may not support checksums", key)
+	}
+
+	expected := base64.StdEncoding.EncodeToString(digest)
+	if strings.Contains(stored, "-") {
+		if sums == nil {
+			return fmt.Errorf("no part checksums recorded for multipart upload %s", key)
+		}
+		if sums.sum() != expected {
+			return fmt.Errorf("uploaded data does not match the archive")
+		}
+		expected = sums.composite()
 	}
+
+	if stored != expected {
+		return fmt.Errorf("S3 stored SHA-256 checksum %s, expected %s", stored, expected)
+	}
+
+	return nil
 }
 
-func validateS3Environment() error {
+func (s *S3Client) Location() string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.prefix)
+}
+
+// Close does nothing, S3 requests don't keep a session open
+func (s *S3Client) Close() error {
+	return nil
+}
+
+func (s *S3Client) buildKey(service, pathName, timestamp, ext string) string {
+	return buildBackupKey(s.prefix, service, pathName, timestamp, ext)
+}
+
+func (s *S3Client) buildServicePrefix(service string) string {
+	return filepath.Join(s.prefix, service) + "/"
+}
+
+func (s *S3Client) parseKey(key string) *BackupInfo {
+	return parseBackupKey(s.prefix, key)
+}
+
+func validateS3Environment(configuredRegion string) error {
 	// Check for required AWS credentials
 	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
 	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
@@ -317,7 +522,10 @@ func validateS3Environment() error {
 	}
 
 	// Check for region (some providers require it)
-	region := os.Getenv("AWS_REGION")
+	region := configuredRegion
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
 	if region == "" {
 		region = os.Getenv("AWS_DEFAULT_REGION")
 	}
@@ -364,6 +572,68 @@ func testS3Connectivity(ctx context.Context, client *s3.Client, bucket string) e
 	return nil
 }
 
+// partHasher computes the SHA-256 of a stream and of each of its multipart upload parts
+type partHasher struct {
+	reader   io.Reader
+	partSize int64
+	full     hash.Hash
+	part     hash.Hash
+	partRead int64
+	parts    [][]byte
+}
+
+func newPartHasher(reader io.Reader, partSize int64) *partHasher {
+	return &partHasher{
+		reader:   reader,
+		partSize: partSize,
+		full:     sha256.New(),
+		part:     sha256.New(),
+	}
+}
+
+func (ph *partHasher) Read(p []byte) (int, error) {
+	n, err := ph.reader.Read(p)
+	ph.full.Write(p[:n])
+
+	for data := p[:n]; len(data) > 0; {
+		chunk := data
+		if remaining := ph.partSize - ph.partRead; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		ph.part.Write(chunk)
+		ph.partRead += int64(len(chunk))
+		data = data[len(chunk):]
+
+		if ph.partRead == ph.partSize {
+			ph.parts = append(ph.parts, ph.part.Sum(nil))
+			ph.part.Reset()
+			ph.partRead = 0
+		}
+	}
+
+	return n, err
+}
+
+// sum returns the base64 SHA-256 of everything read
+func (ph *partHasher) sum() string {
+	return base64.StdEncoding.EncodeToString(ph.full.Sum(nil))
+}
+
+// composite returns the checksum S3 stores for a multipart upload: the SHA-256 of the
+// concatenated part checksums, followed by the number of parts
+func (ph *partHasher) composite() string {
+	parts := ph.parts
+	if ph.partRead > 0 {
+		parts = append(parts, ph.part.Sum(nil))
+	}
+
+	combined := sha256.New()
+	for _, part := range parts {
+		combined.Write(part)
+	}
+	return fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(combined.Sum(nil)), len(parts))
+}
+
 func getOrDefault(value, defaultValue string) string {
 	if value == "" {
 		return defaultValue
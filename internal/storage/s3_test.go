@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestPartHasherComposite(t *testing.T) {
+	const helloSHA256 = "dQnlvaDHYtK6x/kNdYtbImP6Acy8VCq1498WO+CObKk="
+
+	tests := []struct {
+		name          string
+		data          []byte
+		partSize      int64
+		wantComposite string
+		wantSum       string
+	}{
+		// Values as computed by S3 for uploads cut into parts of partSize from the first byte
+		{"single part", []byte("hello world!"), 100, "EzL1EytF3gPnKedks4+aLkBX1nYKiAdmIzGzfd6pNuQ=-1", helloSHA256},
+		{"exactly one part", []byte("hello world!"), 12, "EzL1EytF3gPnKedks4+aLkBX1nYKiAdmIzGzfd6pNuQ=-1", helloSHA256},
+		{"short final part", []byte("hello world!"), 5, "D3qZqhMCO0j+h+RS7RQR8UFdX4mTed1iexltHESNUwA=-3", helloSHA256},
+		{"full final part", []byte("hello world!"), 4, "xd/eXQPZ8adUqwCNdaSA+1M4fu6KgyjUMTRMu1lBb7k=-3", helloSHA256},
+		{"minimum part size", bytes.Repeat([]byte("a"), 12<<20), 5 << 20, "bhdVETadfOMmDD3vO4nYRHpoqEPVPUWudnGjmHuq3+o=-3", "KDIjfGYv5TpIcHS0KAIu+3Zon5mLr3N6FGkTQlkNfDk="},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Part boundaries must not depend on how the uploader reads
+			readers := map[string]func(io.Reader) io.Reader{
+				"whole":    func(r io.Reader) io.Reader { return r },
+				"one byte": iotest.OneByteReader,
+				"half":     iotest.HalfReader,
+			}
+			for name, wrap := range readers {
+				hasher := newPartHasher(wrap(bytes.NewReader(tt.data)), tt.partSize)
+				got, err := io.ReadAll(hasher)
+				if err != nil {
+					t.Fatalf("%s: read error = %v", name, err)
+				}
+				if !bytes.Equal(got, tt.data) {
+					t.Fatalf("%s: partHasher changed the data", name)
+				}
+				if composite := hasher.composite(); composite != tt.wantComposite {
+					t.Errorf("%s: composite() = %s, want %s", name, composite, tt.wantComposite)
+				}
+				if sum := hasher.sum(); sum != tt.wantSum {
+					t.Errorf("%s: sum() = %s, want %s", name, sum, tt.wantSum)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadSHA256(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{"attached", WithSHA256(context.Background(), "7509e5bda0c762d2bac7f90d758b5b2263fa01ccbc542ab5e3df163be08e6ca9"), "dQnlvaDHYtK6x/kNdYtbImP6Acy8VCq1498WO+CObKk="},
+		{"none", context.Background(), ""},
+		{"empty", WithSHA256(context.Background(), ""), ""},
+		{"invalid", WithSHA256(context.Background(), "not hex"), ""},
+		{"wrong length", WithSHA256(context.Background(), strings.Repeat("ab", 16)), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := uploadSHA256(tt.ctx); got != tt.want {
+				t.Errorf("uploadSHA256() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeS3 answers the requests of an upload and its verification, storing the SHA-256
+// checksum sent with each object the way S3 does
+type fakeS3 struct {
+	mu        sync.Mutex
+	checksums map[string]string
+	puts      int
+	deletes   []int // number of keys in each DeleteObjects request
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	switch r.Method {
+	case http.MethodPut:
+		io.Copy(io.Discard, r.Body)
+		f.puts++
+		if checksum := r.Header.Get("X-Amz-Checksum-Sha256"); checksum != "" {
+			f.checksums[key] = checksum
+		}
+		w.Header().Set("ETag", `"etag"`)
+	case http.MethodHead:
+		checksum, ok := f.checksums[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("X-Amz-Checksum-Sha256", checksum)
+		w.Header().Set("Content-Length", "12")
+	case http.MethodPost:
+		body, _ := io.ReadAll(r.Body)
+		keys := strings.Count(string(body), "<Key>")
+		if keys > 1000 {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "<Error><Code>MalformedXML</Code></Error>")
+			return
+		}
+		f.deletes = append(f.deletes, keys)
+		io.WriteString(w, "<DeleteResult></DeleteResult>")
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newFakeS3Client(t *testing.T) (*S3Client, *fakeS3) {
+	t.Helper()
+
+	fake := &fakeS3{checksums: make(map[string]string)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+	})
+
+	return &S3Client{
+		client:             client,
+		uploader:           manager.NewUploader(client),
+		bucket:             "bucket",
+		multipartThreshold: 100 << 20,
+		verifyUploads:      true,
+	}, fake
+}
+
+func TestS3UploadSendsKnownChecksum(t *testing.T) {
+	client, fake := newFakeS3Client(t)
+	const helloHex = "7509e5bda0c762d2bac7f90d758b5b2263fa01ccbc542ab5e3df163be08e6ca9"
+
+	ctx := WithSHA256(context.Background(), helloHex)
+	info, err := client.UploadWithTimestamp(ctx, strings.NewReader("hello world!"), "web", "data", "20250102-030405", ".tar.gz")
+	if err != nil {
+		t.Fatalf("UploadWithTimestamp() error = %v", err)
+	}
+
+	if got := fake.checksums[info.Key]; got != "dQnlvaDHYtK6x/kNdYtbImP6Acy8VCq1498WO+CObKk=" {
+		t.Errorf("sent checksum %q, want the known SHA-256", got)
+	}
+	if err := client.VerifyUpload(context.Background(), info.Key, helloHex); err != nil {
+		t.Errorf("VerifyUpload() error = %v", err)
+	}
+
+	// The attached checksum is sent as is, S3 itself rejects content that doesn't match it
+	otherHex := strings.Repeat("00", 32)
+	info, err = client.UploadWithTimestamp(WithSHA256(context.Background(), otherHex), strings.NewReader("hello world!"), "web", "data", "20250103-030405", ".tar.gz")
+	if err != nil {
+		t.Fatalf("UploadWithTimestamp() error = %v", err)
+	}
+	if got := fake.checksums[info.Key]; got != "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=" {
+		t.Errorf("sent checksum %q, want the attached one", got)
+	}
+}
+
+func TestS3VerifyUpload(t *testing.T) {
+	const (
+		helloHex    = "7509e5bda0c762d2bac7f90d758b5b2263fa01ccbc542ab5e3df163be08e6ca9"
+		helloBase64 = "dQnlvaDHYtK6x/kNdYtbImP6Acy8VCq1498WO+CObKk="
+		otherHex    = "0000000000000000000000000000000000000000000000000000000000000000"
+	)
+
+	// Parts hashed during a multipart upload of "hello world!" in parts of 5 bytes
+	hashParts := func() *partHasher {
+		hasher := newPartHasher(strings.NewReader("hello world!"), 5)
+		io.Copy(io.Discard, hasher)
+		return hasher
+	}
+
+	tests := []struct {
+		name     string
+		stored   string // checksum S3 returns, none if empty
+		parts    *partHasher
+		expected string
+		wantErr  string
+	}{
+		{"single part", helloBase64, nil, helloHex, ""},
+		{"single part mismatch", helloBase64, nil, otherHex, "expected"},
+		{"multipart", "D3qZqhMCO0j+h+RS7RQR8UFdX4mTed1iexltHESNUwA=-3", hashParts(), helloHex, ""},
+		{"multipart other parts", "D3qZqhMCO0j+h+RS7RQR8UFdX4mTed1iexltHESNUwA=-2", hashParts(), helloHex, "expected"},
+		{"multipart other data", "D3qZqhMCO0j+h+RS7RQR8UFdX4mTed1iexltHESNUwA=-3", hashParts(), otherHex, "does not match the archive"},
+		{"multipart without parts", "D3qZqhMCO0j+h+RS7RQR8UFdX4mTed1iexltHESNUwA=-3", nil, helloHex, "no part checksums"},
+		{"no checksum stored", "", nil, helloHex, "returned no SHA-256 checksum"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, fake := newFakeS3Client(t)
+			const key = "web/data/20250102-030405.tar.gz"
+			fake.checksums[key] = tt.stored
+			if tt.parts != nil {
+				client.partSums = map[string]*partHasher{key: tt.parts}
+			}
+
+			err := client.VerifyUpload(context.Background(), key, tt.expected)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("VerifyUpload() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("VerifyUpload() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestS3DeleteMultipleBatches(t *testing.T) {
+	client, fake := newFakeS3Client(t)
+
+	// Each backup is deleted with its manifest, 600 backups make 1200 keys
+	var keys []string
+	for i := range 600 {
+		keys = append(keys, fmt.Sprintf("web/data/20250102-%06d.tar.gz", i))
+	}
+
+	if err := client.DeleteMultiple(context.Background(), keys); err != nil {
+		t.Fatalf("DeleteMultiple() error = %v", err)
+	}
+	if len(fake.deletes) != 2 || fake.deletes[0] != 1000 || fake.deletes[1] != 200 {
+		t.Errorf("DeleteObjects requests with %v keys, want [1000 200]", fake.deletes)
+	}
+}
@@ -0,0 +1,437 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"github.com/volcie/stash/internal/config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPClient stores backups on a remote host over SFTP
+type SFTPClient struct {
+	sshClient  *ssh.Client
+	sftpClient *sftp.Client
+	addr       string
+	root       string
+	prefix     string
+}
+
+// NewSFTPClient connects to the host described by cfg using key-based authentication,
+// verifying the host key against a known_hosts file
+func NewSFTPClient(cfg config.SFTPConfig) (*SFTPClient, error) {
+	signer, err := loadSSHSigner(cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	knownHostsFile := cfg.KnownHostsFile
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate home directory for known_hosts: %w", err)
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known_hosts file %s: %w", knownHostsFile, err)
+	}
+
+	port := cfg.Port
+	if port == 0 {
+		port = 22
+	}
+
+	sshConfig := &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         10 * time.Second,
+	}
+
+	return NewSFTPClientWithSSH(net.JoinHostPort(cfg.Host, strconv.Itoa(port)), sshConfig, cfg.Path, cfg.Prefix)
+}
+
+// NewSFTPClientWithSSH connects to addr with a caller supplied SSH configuration
+func NewSFTPClientWithSSH(addr string, sshConfig *ssh.ClientConfig, root, prefix string) (*SFTPClient, error) {
+	sshClient, err := ssh.Dial("tcp", addr, sshConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+
+	sftpClient, err := sftp.NewClient(sshClient, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		sshClient.Close()
+		return nil, fmt.Errorf("failed to start SFTP session on %s: %w", addr, err)
+	}
+
+	// The root must already exist, same as local storage
+	info, err := sftpClient.Stat(root)
+	if err != nil {
+		sftpClient.Close()
+		sshClient.Close()
+		return nil, fmt.Errorf("cannot access remote directory '%s' on %s: %w", root, addr, err)
+	}
+	if !info.IsDir() {
+		sftpClient.Close()
+		sshClient.Close()
+		return nil, fmt.Errorf("remote path '%s' on %s is not a directory", root, addr)
+	}
+
+	logrus.Debugf("Connected to SFTP server %s (root: %s)", addr, root)
+
+	return &SFTPClient{
+		sshClient:  sshClient,
+		sftpClient: sftpClient,
+		addr:       addr,
+		root:       path.Clean(root),
+		prefix:     strings.Trim(prefix, "/"),
+	}, nil
+}
+
+func (s *SFTPClient) Upload(ctx context.Context, reader io.Reader, service, pathName, ext string) (*BackupInfo, error) {
+	timestamp := time.Now().Format("20060102-150405")
+	return s.UploadWithTimestamp(ctx, reader, service, pathName, timestamp, ext)
+}
+
+func (s *SFTPClient) UploadWithTimestamp(ctx context.Context, reader io.Reader, service, pathName, timestamp, ext string) (*BackupInfo, error) {
+	key := s.buildKey(service, pathName, timestamp, ext)
+	targetPath := s.keyPath(key)
+
+	logrus.Infof("Uploading backup to sftp://%s%s", s.addr, targetPath)
+
+	if err := s.sftpClient.MkdirAll(path.Dir(targetPath)); err != nil {
+		return nil, fmt.Errorf("failed to create remote directory: %w", err)
+	}
+
+	// Upload under a temporary name and rename so a partial upload is never listed as a backup
+	tempPath := path.Join(path.Dir(targetPath), fmt.Sprintf(".%s.tmp-%d", path.Base(targetPath), time.Now().UnixNano()))
+	file, err := s.sftpClient.Create(tempPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create remote file: %w", err)
+	}
+
+	size, err := file.ReadFrom(&contextReader{ctx: ctx, reader: reader})
+	if err != nil {
+		file.Close()
+		s.sftpClient.Remove(tempPath)
+		return nil, fmt.Errorf("failed to upload via SFTP: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		s.sftpClient.Remove(tempPath)
+		return nil, fmt.Errorf("failed to close remote file: %w", err)
+	}
+
+	if err := s.rename(tempPath, targetPath); err != nil {
+		s.sftpClient.Remove(tempPath)
+		return nil, fmt.Errorf("failed to move remote file into place: %w", err)
+	}
+
+	backupTime, _ := time.Parse("20060102-150405", timestamp)
+
+	return &BackupInfo{
+		Service: service,
+		Path:    pathName,
+		Date:    backupTime,
+		Key:     key,
+		Size:    size,
+		Kind:    kindFromExtension(ext),
+	}, nil
+}
+
+func (s *SFTPClient) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	remotePath := s.keyPath(key)
+
+	logrus.Infof("Downloading backup from sftp://%s%s", s.addr, remotePath)
+
+	file, err := s.sftpClient.Open(remotePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download via SFTP: %w", err)
+	}
+
+	return file, nil
+}
+
+func (s *SFTPClient) List(ctx context.Context, service string) ([]*BackupInfo, error) {
+	searchDir := path.Join(s.root, s.prefix)
+	if service != "" {
+		searchDir = path.Join(searchDir, service)
+	}
+
+	logrus.Debugf("Listing SFTP backups in: %s", searchDir)
+
+	if _, err := s.sftpClient.Stat(searchDir); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list SFTP backups: %w", err)
+	}
+
+	var backups []*BackupInfo
+	walker := s.sftpClient.Walk(searchDir)
+	for walker.Step() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if err := walker.Err(); err != nil {
+			logrus.Warnf("Error accessing %s: %v", walker.Path(), err)
+			continue
+		}
+
+		if walker.Stat().IsDir() {
+			continue
+		}
+
+		relPath := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), s.root), "/")
+		backup := s.parseKey(relPath)
+		if backup == nil {
+			continue
+		}
+		backup.Size = walker.Stat().Size()
+
+		backups = append(backups, backup)
+	}
+
+	return backups, nil
+}
+
+func (s *SFTPClient) Stat(ctx context.Context, key string) (*BackupInfo, error) {
+	info, err := s.sftpClient.Stat(s.keyPath(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat SFTP backup: %w", err)
+	}
+
+	backup := s.parseKey(key)
+	if backup == nil {
+		return nil, fmt.Errorf("not a stash backup key: %s", key)
+	}
+	backup.Size = info.Size()
+
+	return backup, nil
+}
+
+func (s *SFTPClient) Delete(ctx context.Context, key string) error {
+	remotePath := s.keyPath(key)
+
+	logrus.Infof("Deleting backup sftp://%s%s", s.addr, remotePath)
+
+	if err := s.sftpClient.Remove(remotePath); err != nil {
+		return fmt.Errorf("failed to delete SFTP backup: %w", err)
+	}
+
+	// Older backups have no manifest
+	if err := s.sftpClient.Remove(s.keyPath(ManifestKey(key))); err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("Failed to delete manifest of %s: %v", key, err)
+	}
+
+	return nil
+}
+
+func (s *SFTPClient) DeleteMultiple(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	logrus.Infof("Deleting %d backups via SFTP", len(keys))
+
+	var failed int
+	for _, key := range keys {
+		if err := s.Delete(ctx, key); err != nil {
+			logrus.Warnf("%v", err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to delete %d of %d backups", failed, len(keys))
+	}
+
+	return nil
+}
+
+// VerifyUpload reads the stored backup back over the connection, SFTP has no server-side checksums
+func (s *SFTPClient) VerifyUpload(ctx context.Context, key, sha256 string) error {
+	file, err := s.sftpClient.Open(s.keyPath(key))
+	if err != nil {
+		return fmt.Errorf("failed to open SFTP backup: %w", err)
+	}
+	defer file.Close()
+
+	return checkSHA256(&contextReader{ctx: ctx, reader: file}, sha256)
+}
+
+func (s *SFTPClient) Location() string {
+	return fmt.Sprintf("sftp://%s%s", s.addr, path.Join(s.root, s.prefix))
+}
+
+// Close ends the SFTP session and the underlying SSH connection
+func (s *SFTPClient) Close() error {
+	s.sftpClient.Close()
+	return s.sshClient.Close()
+}
+
+func (s *SFTPClient) buildKey(service, pathName, timestamp, ext string) string {
+	return buildBackupKey(s.prefix, service, pathName, timestamp, ext)
+}
+
+func (s *SFTPClient) parseKey(key string) *BackupInfo {
+	return parseBackupKey(s.prefix, key)
+}
+
+// keyPath converts a backup key into an absolute path on the remote host
+func (s *SFTPClient) keyPath(key string) string {
+	return path.Join(s.root, key)
+}
+
+func (s *SFTPClient) PutObject(ctx context.Context, name string, data []byte) error {
+	targetPath := s.objectPath(name)
+
+	if err := s.sftpClient.MkdirAll(path.Dir(targetPath)); err != nil {
+		return fmt.Errorf("failed to create remote directory: %w", err)
+	}
+
+	tempPath := path.Join(path.Dir(targetPath), fmt.Sprintf(".%s.tmp-%d", path.Base(targetPath), time.Now().UnixNano()))
+	file, err := s.sftpClient.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("failed to create remote file: %w", err)
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		s.sftpClient.Remove(tempPath)
+		return fmt.Errorf("failed to upload object %s via SFTP: %w", name, err)
+	}
+
+	if err := file.Close(); err != nil {
+		s.sftpClient.Remove(tempPath)
+		return fmt.Errorf("failed to close remote file: %w", err)
+	}
+
+	if err := s.rename(tempPath, targetPath); err != nil {
+		s.sftpClient.Remove(tempPath)
+		return fmt.Errorf("failed to move remote file into place: %w", err)
+	}
+
+	return nil
+}
+
+func (s *SFTPClient) GetObject(ctx context.Context, name string) (io.ReadCloser, error) {
+	file, err := s.sftpClient.Open(s.objectPath(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download object %s via SFTP: %w", name, err)
+	}
+	return file, nil
+}
+
+func (s *SFTPClient) ListObjects(ctx context.Context, dir string) ([]*ObjectInfo, error) {
+	searchDir := s.objectPath(dir)
+	base := s.objectPath("")
+
+	if _, err := s.sftpClient.Stat(searchDir); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list SFTP objects: %w", err)
+	}
+
+	var objects []*ObjectInfo
+	walker := s.sftpClient.Walk(searchDir)
+	for walker.Step() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if err := walker.Err(); err != nil {
+			logrus.Warnf("Error accessing %s: %v", walker.Path(), err)
+			continue
+		}
+
+		// Skip directories and temp files of uploads in progress
+		info := walker.Stat()
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+
+		objects = append(objects, &ObjectInfo{
+			Name:    strings.TrimPrefix(strings.TrimPrefix(walker.Path(), base), "/"),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	return objects, nil
+}
+
+func (s *SFTPClient) DeleteObjects(ctx context.Context, names []string) error {
+	var failed int
+	for _, name := range names {
+		if err := s.sftpClient.Remove(s.objectPath(name)); err != nil && !os.IsNotExist(err) {
+			logrus.Warnf("Failed to delete object %s: %v", name, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to delete %d of %d objects", failed, len(names))
+	}
+
+	return nil
+}
+
+// objectPath converts an object name into an absolute path below the prefix on the remote host
+func (s *SFTPClient) objectPath(name string) string {
+	return path.Join(s.root, s.prefix, name)
+}
+
+// rename prefers the atomic posix-rename extension and falls back to a plain rename
+func (s *SFTPClient) rename(oldPath, newPath string) error {
+	if _, ok := s.sftpClient.HasExtension("posix-rename@openssh.com"); ok {
+		return s.sftpClient.PosixRename(oldPath, newPath)
+	}
+	return s.sftpClient.Rename(oldPath, newPath)
+}
+
+func loadSSHSigner(keyFile string) (ssh.Signer, error) {
+	if keyFile == "" {
+		return nil, fmt.Errorf("sftp.key_file is required")
+	}
+
+	keyData, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH key %s: %w", keyFile, err)
+	}
+
+	// Encrypted keys take their passphrase from the environment, like the S3 credentials
+	if passphrase := os.Getenv("STASH_SFTP_KEY_PASSPHRASE"); passphrase != "" {
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(keyData, []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SSH key %s: %w", keyFile, err)
+		}
+		return signer, nil
+	}
+
+	signer, err := ssh.ParsePrivateKey(keyData)
+	if err != nil {
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			return nil, fmt.Errorf("SSH key %s is encrypted, set STASH_SFTP_KEY_PASSPHRASE", keyFile)
+		}
+		return nil, fmt.Errorf("failed to parse SSH key %s: %w", keyFile, err)
+	}
+
+	return signer, nil
+}
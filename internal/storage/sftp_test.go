@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestSFTPClient connects an SFTPClient to an in-process SFTP server on a loopback listener,
+// serving the local directory root
+func newTestSFTPClient(t *testing.T, root, prefix string) *SFTPClient {
+	t.Helper()
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, userKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userSigner, err := ssh.NewSignerFromKey(userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(userSigner.PublicKey().Marshal()) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, nil
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen on loopback: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, serverConfig)
+		}
+	}()
+
+	clientConfig := &ssh.ClientConfig{
+		User:            "stash",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(userSigner)},
+		HostKeyCallback: ssh.FixedHostKey(hostSigner.PublicKey()),
+		Timeout:         10 * time.Second,
+	}
+
+	client, err := NewSFTPClientWithSSH(listener.Addr().String(), clientConfig, root, prefix)
+	if err != nil {
+		t.Fatalf("failed to connect to test SFTP server: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+// serveSFTP runs an SSH server on conn answering sftp subsystem requests. Errors end up as
+// failures on the client side, the test may be over by the time the server sees them.
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for req := range requests {
+				// The payload is the subsystem name as an SSH string
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+			}
+		}()
+
+		go func() {
+			defer channel.Close()
+			server, err := sftp.NewServer(channel)
+			if err != nil {
+				return
+			}
+			server.Serve()
+		}()
+	}
+}
+
+func TestSFTPClientUploadListDownloadDelete(t *testing.T) {
+	root := t.TempDir()
+	client := newTestSFTPClient(t, root, "backups")
+	ctx := context.Background()
+
+	archiveExt := KeyExtension("incremental", ".tar.zst")
+	backup, err := client.UploadWithTimestamp(ctx, strings.NewReader("archive"), "app", "data", "20240102-030405", archiveExt)
+	if err != nil {
+		t.Fatalf("UploadWithTimestamp() error = %v", err)
+	}
+	if backup.Kind != "incremental" || backup.Size != int64(len("archive")) {
+		t.Errorf("UploadWithTimestamp() = kind %q size %d, want incremental %d", backup.Kind, backup.Size, len("archive"))
+	}
+
+	manifestExt := KeyExtension("incremental", ManifestExtension)
+	if _, err := client.UploadWithTimestamp(ctx, strings.NewReader("manifest"), "app", "data", "20240102-030405", manifestExt); err != nil {
+		t.Fatalf("UploadWithTimestamp() manifest error = %v", err)
+	}
+
+	manifestPath := filepath.Join(root, filepath.FromSlash(ManifestKey(backup.Key)))
+	if _, err := os.Stat(manifestPath); err != nil {
+		t.Fatalf("manifest not stored next to the backup: %v", err)
+	}
+
+	// Temporary upload files must not be left behind
+	entries, err := os.ReadDir(filepath.Join(root, "backups", "app", "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("backup directory holds %d files, want the backup and its manifest", len(entries))
+	}
+
+	backups, err := client.List(ctx, "app")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(backups) != 1 || backups[0].Key != backup.Key {
+		t.Fatalf("List() = %v, want only %s", backups, backup.Key)
+	}
+	if backups[0].Service != "app" || backups[0].Path != "data" || backups[0].Size != int64(len("archive")) {
+		t.Errorf("List() = %+v", backups[0])
+	}
+
+	reader, err := client.Download(ctx, backup.Key)
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	content, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatalf("failed to read download: %v", err)
+	}
+	if string(content) != "archive" {
+		t.Errorf("Download() = %q, want %q", content, "archive")
+	}
+
+	if err := client.Delete(ctx, backup.Key); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(backup.Key))); !os.IsNotExist(err) {
+		t.Errorf("backup still exists after Delete(): %v", err)
+	}
+	if _, err := os.Stat(manifestPath); !os.IsNotExist(err) {
+		t.Errorf("manifest still exists after Delete(): %v", err)
+	}
+
+	backups, err = client.List(ctx, "app")
+	if err != nil {
+		t.Fatalf("List() after Delete() error = %v", err)
+	}
+	if len(backups) != 0 {
+		t.Errorf("List() after Delete() = %v, want none", backups)
+	}
+}
+
+func TestSFTPClientListMissingService(t *testing.T) {
+	client := newTestSFTPClient(t, t.TempDir(), "")
+
+	backups, err := client.List(context.Background(), "missing")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(backups) != 0 {
+		t.Errorf("List() = %v, want none", backups)
+	}
+}
@@ -0,0 +1,370 @@
+package verify
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/volcie/stash/internal/archive"
+	"github.com/volcie/stash/internal/config"
+	"github.com/volcie/stash/internal/dedup"
+	"github.com/volcie/stash/internal/notifications"
+	"github.com/volcie/stash/internal/storage"
+)
+
+// Checks a backup can be verified against, from strongest to weakest
+const (
+	CheckManifest = "manifest"
+	CheckETag     = "etag"
+	CheckFraming  = "framing"
+)
+
+type Service struct {
+	cfg      *config.Config
+	notifier *notifications.DiscordNotifier
+}
+
+type VerifyOptions struct {
+	ServiceName string // empty verifies every configured service
+	Destination string // named destination to verify, default is the first
+	Date        string
+	All         bool // every matching backup instead of the latest of each path
+}
+
+type VerifyResult struct {
+	Service    string
+	Path       string
+	BackupInfo *storage.BackupInfo
+	Check      string   // what the archive was checked against, see Check*
+	Files      int      // archive entries read
+	Problems   []string // every mismatch found, empty when the backup is intact
+	Duration   time.Duration
+	Error      error
+}
+
+func NewService(cfg *config.Config, noNotify bool) (*Service, error) {
+	var notifier *notifications.DiscordNotifier
+	if !noNotify && cfg.Notifications.DiscordWebhook != "" {
+		notifier = notifications.NewDiscordNotifier(
+			cfg.Notifications.DiscordWebhook,
+			cfg.Notifications.OnSuccess,
+			cfg.Notifications.OnError,
+			cfg.Notifications.OnWarning,
+		)
+	}
+
+	return &Service{
+		cfg:      cfg,
+		notifier: notifier,
+	}, nil
+}
+
+// VerifyBackups downloads the selected backups and checks each one can be read to the end and
+// matches its manifest. Corrupt backups are reported through notifications.
+func (s *Service) VerifyBackups(ctx context.Context, opts *VerifyOptions) ([]*VerifyResult, error) {
+	var services []string
+	if opts.ServiceName == "" {
+		for serviceName := range s.cfg.Services {
+			services = append(services, serviceName)
+		}
+		sort.Strings(services)
+	} else {
+		if _, exists := s.cfg.Services[opts.ServiceName]; !exists {
+			return nil, fmt.Errorf("service %s not found in configuration", opts.ServiceName)
+		}
+		services = []string{opts.ServiceName}
+	}
+
+	backend, err := storage.NewBackendByName(s.cfg, opts.Destination)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage backend: %w", err)
+	}
+	defer backend.Close()
+
+	archiver, err := s.newArchiver()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*VerifyResult
+	for _, serviceName := range services {
+		backups, err := backend.List(ctx, serviceName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list backups for service %s: %w", serviceName, err)
+		}
+
+		selected, err := selectBackups(backups, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		logrus.Infof("Verifying %d backups for service: %s", len(selected), serviceName)
+
+		for _, backup := range selected {
+			result := s.verifyBackup(ctx, backend, archiver, backups, backup)
+			results = append(results, result)
+
+			if result.Error != nil {
+				s.sendNotification(serviceName, result)
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// selectBackups returns the backups matching the date filter, only the latest of each path unless all are requested
+func selectBackups(backups []*storage.BackupInfo, opts *VerifyOptions) ([]*storage.BackupInfo, error) {
+	if opts.Date != "" {
+		layout := "20060102"
+		if len(opts.Date) == len("20060102-150405") {
+			layout = "20060102-150405"
+		}
+		if _, err := time.Parse(layout, opts.Date); err != nil {
+			return nil, fmt.Errorf("invalid date format: expected YYYYMMDD or YYYYMMDD-HHMMSS, got %s", opts.Date)
+		}
+
+		var filtered []*storage.BackupInfo
+		for _, backup := range backups {
+			if backup.Date.Format(layout) == opts.Date {
+				filtered = append(filtered, backup)
+			}
+		}
+		backups = filtered
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].Path != backups[j].Path {
+			return backups[i].Path < backups[j].Path
+		}
+		return backups[i].Date.After(backups[j].Date)
+	})
+
+	if opts.All {
+		return backups, nil
+	}
+
+	var selected []*storage.BackupInfo
+	for _, backup := range backups {
+		if len(selected) == 0 || selected[len(selected)-1].Path != backup.Path {
+			selected = append(selected, backup)
+		}
+	}
+	return selected, nil
+}
+
+// verifyBackup reads a backup to the end, checking its compression and tar framing, and compares
+// the archive and the files in it with the manifest stored next to it
+func (s *Service) verifyBackup(ctx context.Context, backend storage.Backend, archiver *archive.Archiver, backups []*storage.BackupInfo, backup *storage.BackupInfo) *VerifyResult {
+	startTime := time.Now()
+
+	result := &VerifyResult{
+		Service:    backup.Service,
+		Path:       backup.Path,
+		BackupInfo: backup,
+		Check:      CheckFraming,
+	}
+	defer func() {
+		result.Duration = time.Since(startTime)
+		if len(result.Problems) > 0 && result.Error == nil {
+			result.Error = fmt.Errorf("backup is corrupt: %d problems found", len(result.Problems))
+		}
+	}()
+
+	logrus.Infof("Verifying %s", backup.Key)
+
+	// An incremental backup is only restorable along with the backups it builds on
+	if _, err := storage.BackupChain(backups, backup); err != nil {
+		result.Problems = append(result.Problems, err.Error())
+	}
+
+	manifest := s.loadManifest(ctx, backend, archiver, backup)
+	etag := md5ETag(backup)
+	switch {
+	case manifest != nil:
+		result.Check = CheckManifest
+	case etag != "":
+		result.Check = CheckETag
+	}
+
+	reader, size, err := dedup.OpenBackup(ctx, backend, archiver, backup)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+	defer reader.Close()
+
+	fmt.Println() // Add line break before progress bar
+	progressBar := progressbar.NewOptions(int(size),
+		progressbar.OptionSetDescription(fmt.Sprintf("Verifying %s/%s", backup.Service, backup.Path)),
+		progressbar.OptionSetWidth(40),
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionSetTheme(progressbar.Theme{
+			Saucer:        "█",
+			SaucerHead:    "█",
+			SaucerPadding: "░",
+			BarStart:      "|",
+			BarEnd:        "|",
+		}),
+	)
+	defer func() {
+		progressBar.Finish()
+		fmt.Println() // Add newline after progress bar
+	}()
+
+	// Hash the stored archive as it is read
+	archiveSHA := sha256.New()
+	archiveMD5 := md5.New()
+	counter := &countingWriter{}
+	stream := io.TeeReader(reader, io.MultiWriter(archiveSHA, archiveMD5, counter, progressBar))
+
+	expected := make(map[string]archive.ManifestEntry)
+	if manifest != nil {
+		for _, entry := range manifest.Files {
+			expected[entry.Path] = entry
+		}
+	}
+
+	err = archiver.WalkArchive(stream, func(header *tar.Header, content io.Reader) error {
+		result.Files++
+
+		var sum string
+		if header.Typeflag == tar.TypeReg {
+			fileHash := sha256.New()
+			if _, err := io.Copy(fileHash, content); err != nil {
+				return fmt.Errorf("failed to read %s: %w", header.Name, err)
+			}
+			sum = hex.EncodeToString(fileHash.Sum(nil))
+		}
+
+		if manifest == nil {
+			return nil
+		}
+
+		entry, listed := expected[header.Name]
+		if !listed {
+			result.Problems = append(result.Problems, fmt.Sprintf("%s is not listed in the manifest", header.Name))
+			return nil
+		}
+		delete(expected, header.Name)
+
+		if entry.Type == archive.EntryFile && (entry.Size != header.Size || entry.SHA256 != sum) {
+			result.Problems = append(result.Problems, fmt.Sprintf("%s does not match its checksum", header.Name))
+		}
+		return nil
+	})
+	if err != nil {
+		result.Problems = append(result.Problems, fmt.Sprintf("archive is unreadable after %d entries: %v", result.Files, err))
+		return result
+	}
+
+	// Reading stops at the end of the tar stream, the stored checksums cover everything after it too
+	if _, err := io.Copy(io.Discard, stream); err != nil {
+		result.Error = fmt.Errorf("failed to read backup: %w", err)
+		return result
+	}
+
+	if manifest != nil {
+		missing := make([]string, 0, len(expected))
+		for name := range expected {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
+		for _, name := range missing {
+			result.Problems = append(result.Problems, fmt.Sprintf("%s is missing from the archive", name))
+		}
+
+		if counter.written != manifest.ArchiveSize || hex.EncodeToString(archiveSHA.Sum(nil)) != manifest.ArchiveSHA256 {
+			result.Problems = append(result.Problems, fmt.Sprintf("archive checksum does not match the manifest (%d bytes read, %d expected)", counter.written, manifest.ArchiveSize))
+		}
+	} else if etag != "" && hex.EncodeToString(archiveMD5.Sum(nil)) != etag {
+		result.Problems = append(result.Problems, "archive checksum does not match its ETag")
+	}
+
+	if len(result.Problems) == 0 {
+		logrus.Infof("Verified %s: %d entries intact", backup.Key, result.Files)
+	}
+	return result
+}
+
+// loadManifest downloads the manifest of a backup, nil if there is none. Backups made
+// before manifests were introduced, or whose manifest upload failed, have none.
+func (s *Service) loadManifest(ctx context.Context, backend storage.Backend, archiver *archive.Archiver, backup *storage.BackupInfo) *archive.Manifest {
+	manifest, err := archiver.LoadManifest(ctx, backend, backup)
+	if err != nil {
+		logrus.Warnf("No usable manifest for %s, checking the archive alone: %v", backup.Key, err)
+		return nil
+	}
+
+	return manifest
+}
+
+// md5ETag returns the ETag of a backup if it is the MD5 of its content, which is only the case
+// for S3 objects uploaded in a single part without KMS encryption
+func md5ETag(backup *storage.BackupInfo) string {
+	if backup.Kind == storage.KindSnapshot || len(backup.ETag) != md5.Size*2 {
+		return ""
+	}
+	if _, err := hex.DecodeString(backup.ETag); err != nil {
+		return ""
+	}
+	return strings.ToLower(backup.ETag)
+}
+
+// newArchiver creates an archiver able to decrypt archives with the configured keys
+func (s *Service) newArchiver() (*archive.Archiver, error) {
+	identities, err := archive.LoadIdentities(s.cfg.Backup.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load decryption keys: %w", err)
+	}
+
+	archiver := archive.NewArchiver(s.cfg.Backup.CompressionFormat(), false)
+	archiver.SetIdentities(identities)
+	return archiver, nil
+}
+
+func (s *Service) sendNotification(serviceName string, result *VerifyResult) {
+	if s.notifier == nil {
+		return
+	}
+
+	details := make(map[string]string)
+	details["Service"] = serviceName
+	details["Path"] = result.Path
+	details["Backup Key"] = result.BackupInfo.Key
+	details["Backup Date"] = result.BackupInfo.Date.Format("2006-01-02 15:04:05")
+	details["Checked Against"] = result.Check
+
+	if len(result.Problems) > 0 {
+		details["Problems"] = strings.Join(firstN(result.Problems, 5), "\n")
+	}
+
+	s.notifier.SendBackupNotification(notifications.Error, serviceName, "verify", details, result.Error)
+}
+
+// firstN returns at most n items
+func firstN(items []string, n int) []string {
+	if len(items) > n {
+		return items[:n]
+	}
+	return items
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	written int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.written += int64(len(p))
+	return len(p), nil
+}
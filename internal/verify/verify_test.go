@@ -0,0 +1,170 @@
+package verify
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/volcie/stash/internal/archive"
+	"github.com/volcie/stash/internal/config"
+	"github.com/volcie/stash/internal/storage"
+)
+
+// storeBackup backs up a small directory into a local store with its manifest, uncompressed
+// so the stored archive can be tampered with, and returns the store and the backup
+func storeBackup(t *testing.T) (string, *storage.LocalClient, *storage.BackupInfo) {
+	t.Helper()
+	ctx := context.Background()
+
+	source := t.TempDir()
+	files := map[string]string{
+		"index.html":       "<html>hello</html>",
+		"uploads/note.txt": "a note worth keeping",
+	}
+	for name, content := range files {
+		path := filepath.Join(source, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root := t.TempDir()
+	backend, err := storage.NewLocalClient(root, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archiver := archive.NewArchiver(config.CompressionNone, false)
+	var buf bytes.Buffer
+	stats, err := archiver.CreateArchive(&buf, source, nil)
+	if err != nil {
+		t.Fatalf("CreateArchive() error = %v", err)
+	}
+	ext := storage.KeyExtension(config.BackupModeFull, archiver.Extension())
+	if _, err := backend.UploadWithTimestamp(ctx, &buf, "web", "data", "20250101-030000", ext); err != nil {
+		t.Fatalf("UploadWithTimestamp() error = %v", err)
+	}
+
+	var manifest bytes.Buffer
+	if err := archiver.WriteManifest(&manifest, stats.Manifest); err != nil {
+		t.Fatal(err)
+	}
+	ext = storage.KeyExtension(config.BackupModeFull, storage.ManifestExtension)
+	if _, err := backend.UploadWithTimestamp(ctx, &manifest, "web", "data", "20250101-030000", ext); err != nil {
+		t.Fatalf("UploadWithTimestamp() manifest error = %v", err)
+	}
+
+	backups, err := backend.List(ctx, "web")
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("List() = %v, %v, want one backup", backups, err)
+	}
+	return root, backend, backups[0]
+}
+
+// verify runs the checks of verify against a single backup
+func verify(t *testing.T, backend storage.Backend, backup *storage.BackupInfo) *VerifyResult {
+	t.Helper()
+	s := &Service{cfg: &config.Config{}}
+	archiver := archive.NewArchiver(config.CompressionNone, false)
+	return s.verifyBackup(context.Background(), backend, archiver, []*storage.BackupInfo{backup}, backup)
+}
+
+// hasProblem reports whether any problem contains text
+func hasProblem(result *VerifyResult, text string) bool {
+	for _, problem := range result.Problems {
+		if strings.Contains(problem, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestVerifyIntactBackup(t *testing.T) {
+	_, backend, backup := storeBackup(t)
+
+	result := verify(t, backend, backup)
+	if result.Error != nil || len(result.Problems) > 0 {
+		t.Fatalf("verify() error = %v, problems = %v, want an intact backup", result.Error, result.Problems)
+	}
+	if result.Check != CheckManifest {
+		t.Errorf("verify() checked against %q, want %q", result.Check, CheckManifest)
+	}
+}
+
+func TestVerifyReportsFlippedByte(t *testing.T) {
+	root, backend, backup := storeBackup(t)
+
+	archivePath := filepath.Join(root, filepath.FromSlash(backup.Key))
+	data, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := bytes.Index(data, []byte("a note worth keeping"))
+	if offset < 0 {
+		t.Fatal("file content not found in the stored archive")
+	}
+	data[offset] ^= 0xff
+	if err := os.WriteFile(archivePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result := verify(t, backend, backup)
+	if result.Error == nil {
+		t.Fatal("verify() passed a corrupted archive")
+	}
+	if !hasProblem(result, "uploads/note.txt does not match its checksum") {
+		t.Errorf("corrupted file not reported, problems = %v", result.Problems)
+	}
+	if !hasProblem(result, "archive checksum does not match the manifest") {
+		t.Errorf("archive checksum mismatch not reported, problems = %v", result.Problems)
+	}
+	if hasProblem(result, "index.html") {
+		t.Errorf("intact file reported, problems = %v", result.Problems)
+	}
+}
+
+func TestVerifyReportsMissingManifestEntry(t *testing.T) {
+	root, backend, backup := storeBackup(t)
+
+	archiver := archive.NewArchiver(config.CompressionNone, false)
+	manifest, err := archiver.LoadManifest(context.Background(), backend, backup)
+	if err != nil {
+		t.Fatalf("LoadManifest() error = %v", err)
+	}
+	var kept []archive.ManifestEntry
+	for _, entry := range manifest.Files {
+		if entry.Path != "index.html" {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == len(manifest.Files) {
+		t.Fatal("index.html not found in the manifest")
+	}
+	manifest.Files = kept
+
+	var buf bytes.Buffer
+	if err := archiver.WriteManifest(&buf, manifest); err != nil {
+		t.Fatal(err)
+	}
+	manifestPath := filepath.Join(root, filepath.FromSlash(storage.ManifestKey(backup.Key)))
+	if err := os.WriteFile(manifestPath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result := verify(t, backend, backup)
+	if result.Error == nil {
+		t.Fatal("verify() passed a backup its manifest doesn't fully describe")
+	}
+	if !hasProblem(result, "index.html is not listed in the manifest") {
+		t.Errorf("unlisted file not reported, problems = %v", result.Problems)
+	}
+	if len(result.Problems) != 1 {
+		t.Errorf("problems = %v, want only the unlisted file", result.Problems)
+	}
+}